@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"net/http"
+)
+
+// viewerID() returns the ID of the user making the request, or 0 for anonymous
+// requests. It is what queries which hide blocked users' content are given.
+func (app *application) viewerID(r *http.Request) int64 {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return 0
+	}
+	return user.ID
+}
+
+// blockedWith() reports whether the user making the request and the other user have
+// blocked each other, in either direction.
+func (app *application) blockedWith(r *http.Request, otherID int64) (bool, error) {
+	userID := app.viewerID(r)
+	if userID == 0 {
+		return false, nil
+	}
+	return app.models.Blocks.Blocked(userID, otherID)
+}
+
+// putBlockHandler() returns the handler which blocks or mutes, depending on the kind,
+// the user named by the ":id" URL parameter.
+func (app *application) putBlockHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		other, ok := app.readUserParam(w, r)
+		if !ok {
+			return
+		}
+
+		user := app.contextGetUser(r)
+		if other.ID == user.ID {
+			app.failedValidationResponse(w, r, map[string]string{"id": "must not be your own user ID"})
+			return
+		}
+
+		block, err := app.models.Blocks.Upsert(user.ID, other.ID, kind)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		block.Name = other.Name
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"block": block}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// deleteBlockHandler() returns the handler which lifts a block or a mute.
+func (app *application) deleteBlockHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		otherID, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		err = app.models.Blocks.Delete(app.contextGetUser(r).ID, otherID, kind)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotFoundRecord):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": kind + " successfully removed"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// getAllBlocksHandler() returns the handler which lists the users the current user has
+// blocked or muted.
+func (app *application) getAllBlocksHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blocks, err := app.models.Blocks.SelectAllForUser(app.contextGetUser(r).ID, kind)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{kind + "s": blocks}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
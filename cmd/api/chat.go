@@ -0,0 +1,680 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"letsgofurther/internal/websocket"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// The subprotocol browsers offer, followed by their authentication token, since
+	// they can't set the Authorization header on a WebSocket.
+	chatTokenProtocol = "bearer"
+	// How long a client may stay silent, pongs included, before it counts as gone. It
+	// is pinged well before then.
+	chatPongWait     = 60 * time.Second
+	chatPingInterval = 25 * time.Second
+	chatWriteTimeout = 10 * time.Second
+	// How long a client gets to answer the close frame before it is cut off.
+	chatCloseGrace = 5 * time.Second
+	// How often each instance announces its users, and how long an announcement lasts.
+	// The users of an instance which stops announcing go offline after a few missed
+	// announcements.
+	chatPresenceInterval = 30 * time.Second
+	chatPresenceExpiry   = 3 * chatPresenceInterval
+	// How many user IDs go into one presence notification, which keeps it well below
+	// the limit on the payload size.
+	chatPresenceBatch = 400
+	// How many messages may wait for a slow client before it is disconnected.
+	chatSendBuffer       = 64
+	chatReadLimit        = 16 * 1024
+	chatMaxSubscriptions = 100
+)
+
+// chatHub keeps track of the chat connections on this instance, and of which users are
+// online on any instance. Messages, typing indicators and presence changes reach it
+// through the notifications on data.ChatChannel, which every instance gets.
+type chatHub struct {
+	// Tells this instance's presence notifications apart from those of the others.
+	instance string
+
+	mu      sync.Mutex
+	clients map[*chatClient]struct{}
+	// The users connected to this instance, with their number of connections.
+	local map[int64]int
+	// The users connected to other instances, with when each instance last said so.
+	remote        map[int64]map[string]time.Time
+	closed        bool
+	notifications chan *data.ChatNotification
+}
+
+// A chatClient is one connection. Its subscriptions map the conversations it follows
+// to their participants, and are guarded by the hub's mutex.
+type chatClient struct {
+	userID        int64
+	conn          *websocket.Conn
+	send          chan []byte
+	subscriptions map[int64][]int64
+	limiter       *rate.Limiter
+
+	done        chan struct{}
+	once        sync.Once
+	closeCode   int
+	closeReason string
+}
+
+func newChatHub() (*chatHub, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chatHub{
+		instance:      hex.EncodeToString(b),
+		clients:       make(map[*chatClient]struct{}),
+		local:         make(map[int64]int),
+		remote:        make(map[int64]map[string]time.Time),
+		notifications: make(chan *data.ChatNotification, 1024),
+	}, nil
+}
+
+// handleNotification() queues a notification on data.ChatChannel. Like
+// listingFeed.handleNotification(), it runs on the listener's goroutine and drops the
+// notification rather than block.
+func (h *chatHub) handleNotification(payload string) {
+	var n data.ChatNotification
+	err := json.Unmarshal([]byte(payload), &n)
+	if err != nil {
+		return
+	}
+	// This instance's users are already known from its own connections.
+	if n.Type == data.ChatPresence && n.Instance == h.instance {
+		return
+	}
+
+	select {
+	case h.notifications <- &n:
+	default:
+	}
+}
+
+// register() adds a client, and reports whether it is the user's first connection to
+// this instance. It fails once the server is shutting down.
+func (h *chatHub) register(c *chatClient) (bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false, false
+	}
+
+	wasOnline := h.online(c.userID)
+	h.clients[c] = struct{}{}
+	h.local[c.userID]++
+	if !wasOnline {
+		h.broadcastPresence(c.userID, true)
+	}
+	return h.local[c.userID] == 1, true
+}
+
+// unregister() removes a client, and reports whether it was the user's last connection
+// to this instance.
+func (h *chatHub) unregister(c *chatClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; !ok {
+		return false
+	}
+	delete(h.clients, c)
+
+	h.local[c.userID]--
+	if h.local[c.userID] > 0 {
+		return false
+	}
+	delete(h.local, c.userID)
+	if !h.online(c.userID) {
+		h.broadcastPresence(c.userID, false)
+	}
+	return true
+}
+
+// close() disconnects every client when the server starts shutting down. Hijacked
+// connections are the server's no longer, so Shutdown() wouldn't close them.
+func (h *chatHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for c := range h.clients {
+		c.disconnect(websocket.CloseGoingAway, "the server is shutting down")
+	}
+}
+
+// subscribe() makes the client follow the conversation, and returns which of the other
+// participants are online.
+func (h *chatHub) subscribe(c *chatClient, conv *data.Conversation) ([]int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := c.subscriptions[conv.ID]
+	if !ok && len(c.subscriptions) >= chatMaxSubscriptions {
+		return nil, false
+	}
+	c.subscriptions[conv.ID] = conv.Participants
+
+	online := []int64{}
+	for _, id := range conv.Participants {
+		if id != c.userID && h.online(id) {
+			online = append(online, id)
+		}
+	}
+	return online, true
+}
+
+func (h *chatHub) unsubscribe(c *chatClient, conversationID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(c.subscriptions, conversationID)
+}
+
+// participants() returns the participants of a conversation the client follows.
+func (h *chatHub) participants(c *chatClient, conversationID int64) ([]int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	participants, ok := c.subscriptions[conversationID]
+	return participants, ok
+}
+
+func (h *chatHub) subscribed(conversationID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if _, ok := c.subscriptions[conversationID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver() sends the event to the clients following the conversation, except to those
+// of the given user.
+func (h *chatHub) deliver(conversationID, exceptUserID int64, event []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if _, ok := c.subscriptions[conversationID]; ok && c.userID != exceptUserID {
+			c.push(event)
+		}
+	}
+}
+
+func (h *chatHub) localUsers() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	users := make([]int64, 0, len(h.local))
+	for id := range h.local {
+		users = append(users, id)
+	}
+	return users
+}
+
+// applyPresence() records what another instance says about its users.
+func (h *chatHub) applyPresence(n *data.ChatNotification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range n.Online {
+		wasOnline := h.online(id)
+		if h.remote[id] == nil {
+			h.remote[id] = make(map[string]time.Time)
+		}
+		h.remote[id][n.Instance] = now
+		if !wasOnline {
+			h.broadcastPresence(id, true)
+		}
+	}
+
+	for _, id := range n.Offline {
+		wasOnline := h.online(id)
+		delete(h.remote[id], n.Instance)
+		if len(h.remote[id]) == 0 {
+			delete(h.remote, id)
+		}
+		if wasOnline && !h.online(id) {
+			h.broadcastPresence(id, false)
+		}
+	}
+}
+
+// expirePresence() forgets the users of instances which haven't announced them lately.
+func (h *chatHub) expirePresence() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := time.Now().Add(-chatPresenceExpiry)
+	for id, instances := range h.remote {
+		for instance, seen := range instances {
+			if seen.Before(cutoff) {
+				delete(instances, instance)
+			}
+		}
+		if len(instances) == 0 {
+			delete(h.remote, id)
+			if !h.online(id) {
+				h.broadcastPresence(id, false)
+			}
+		}
+	}
+}
+
+// online() reports whether the user is connected to any instance. The caller must hold
+// the mutex.
+func (h *chatHub) online(userID int64) bool {
+	return h.local[userID] > 0 || len(h.remote[userID]) > 0
+}
+
+// broadcastPresence() tells the clients following a conversation with the user that
+// the user came online or went offline. The caller must hold the mutex.
+func (h *chatHub) broadcastPresence(userID int64, online bool) {
+	event := chatEvent(envelope{"type": "presence", "user_id": userID, "online": online})
+
+	for c := range h.clients {
+		if c.userID == userID {
+			continue
+		}
+		for _, participants := range c.subscriptions {
+			if containsID(participants, userID) {
+				c.push(event)
+				break
+			}
+		}
+	}
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// push() queues an event for the client, disconnecting it if it can't keep up.
+func (c *chatClient) push(event []byte) {
+	select {
+	case c.send <- event:
+	default:
+		c.disconnect(websocket.ClosePolicyViolation, "too slow")
+	}
+}
+
+func (c *chatClient) pushError(ref, message string) {
+	c.push(chatEvent(envelope{"type": "error", "ref": ref, "error": message}))
+}
+
+// disconnect() has the client's writer start the closing handshake. Only the first
+// call has any effect.
+func (c *chatClient) disconnect(code int, reason string) {
+	c.once.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// extendReadDeadline() gives a client which showed a sign of life more time, unless it
+// is being disconnected.
+func (c *chatClient) extendReadDeadline() {
+	select {
+	case <-c.done:
+	default:
+		c.conn.SetReadDeadline(time.Now().Add(chatPongWait))
+	}
+}
+
+func chatEvent(event envelope) []byte {
+	js, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	return js
+}
+
+// runChatHub() hands the chat notifications to the clients on this instance, and keeps
+// the presence up to date, until the server shuts down.
+func (app *application) runChatHub() {
+	ticker := time.NewTicker(chatPresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case n := <-app.chat.notifications:
+			app.handleChatNotification(n)
+		case <-ticker.C:
+			app.notifyPresence(app.chat.localUsers(), nil)
+			app.chat.expirePresence()
+		}
+	}
+}
+
+func (app *application) handleChatNotification(n *data.ChatNotification) {
+	switch n.Type {
+	case data.ChatMessage:
+		if !app.chat.subscribed(n.ConversationID) {
+			return
+		}
+
+		msg, err := app.models.Conversations.SelectMessage(n.MessageID)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"message_id": strconv.FormatInt(n.MessageID, 10)})
+			return
+		}
+		app.chat.deliver(n.ConversationID, 0, chatEvent(envelope{"type": "message", "message": msg}))
+	case data.ChatTyping:
+		event := chatEvent(envelope{"type": "typing", "conversation_id": n.ConversationID, "user_id": n.UserID})
+		app.chat.deliver(n.ConversationID, n.UserID, event)
+	case data.ChatPresence:
+		app.chat.applyPresence(n)
+	}
+}
+
+// notifyPresence() tells the other instances about users who came online or went
+// offline on this one.
+func (app *application) notifyPresence(online, offline []int64) {
+	for len(online) > 0 || len(offline) > 0 {
+		n := &data.ChatNotification{Type: data.ChatPresence, Instance: app.chat.instance}
+		n.Online, online = splitBatch(online, chatPresenceBatch)
+		n.Offline, offline = splitBatch(offline, chatPresenceBatch-len(n.Online))
+
+		err := app.models.Conversations.Notify(n)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+	}
+}
+
+// splitBatch() returns the first size IDs, and the rest.
+func splitBatch(ids []int64, size int) ([]int64, []int64) {
+	if len(ids) <= size {
+		return ids, nil
+	}
+	return ids[:size], ids[size:]
+}
+
+// withWebSocketToken() authenticates WebSocket requests from browsers, which offer their
+// authentication token as a subprotocol, as in new WebSocket(url, ["bearer", token]).
+// The token is checked like authenticate() checks the Authorization header. Being sent
+// explicitly rather than as a cookie, it also rules out cross-site WebSocket hijacking,
+// so the Origin header needn't be checked.
+func (app *application) withWebSocketToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		protocols := websocket.Subprotocols(r)
+		if !app.contextGetUser(r).IsAnonymous() || len(protocols) != 2 || protocols[0] != chatTokenProtocol {
+			next(w, r)
+			return
+		}
+
+		token := protocols[1]
+
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := app.models.Users.SelectForToken(data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotFoundRecord):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		next(w, app.contextSetUser(r, user))
+	}
+}
+
+// Open a WebSocket for chatting in real time. The client sends JSON objects whose type
+// is one of:
+//
+//   - "subscribe" and "unsubscribe", with a conversation_id, to follow a conversation or
+//     stop following it;
+//   - "message", with a conversation_id and a body, to send a message to a followed
+//     conversation;
+//   - "typing", with a conversation_id, while the user is typing.
+//
+// The server answers a subscribe with "subscribed", listing which other participants
+// are online, and a message with "sent". Both, and "error", echo the ref the client
+// sent along. For the followed conversations it sends "message" for every new message,
+// the client's own included, "typing", and "presence" when a participant comes online
+// or goes offline.
+func (app *application) chatHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// A browser offering the token as a subprotocol only accepts the connection if the
+	// server selects that protocol.
+	var protocol string
+	if protocols := websocket.Subprotocols(r); len(protocols) > 0 && protocols[0] == chatTokenProtocol {
+		protocol = chatTokenProtocol
+	}
+
+	conn, err := websocket.Upgrade(w, r, protocol)
+	if err != nil {
+		switch {
+		case errors.Is(err, websocket.ErrUnsupportedVersion):
+			app.errorResponse(w, r, http.StatusUpgradeRequired, "only version 13 of the WebSocket protocol is supported")
+		case errors.Is(err, websocket.ErrBadHandshake):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(chatReadLimit)
+	conn.SetWriteTimeout(chatWriteTimeout)
+
+	client := &chatClient{
+		userID:        user.ID,
+		conn:          conn,
+		send:          make(chan []byte, chatSendBuffer),
+		subscriptions: make(map[int64][]int64),
+		limiter:       rate.NewLimiter(5, 20),
+		done:          make(chan struct{}),
+	}
+
+	first, ok := app.chat.register(client)
+	if !ok {
+		conn.WriteClose(websocket.CloseGoingAway, "the server is shutting down")
+		return
+	}
+	if first {
+		app.notifyPresence([]int64{user.ID}, nil)
+	}
+	defer func() {
+		if app.chat.unregister(client) {
+			app.notifyPresence(nil, []int64{user.ID})
+		}
+	}()
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		app.writeChat(client)
+	}()
+
+	app.readChat(client)
+
+	client.disconnect(websocket.CloseNormal, "")
+	<-writerDone
+}
+
+// writeChat() sends the client's events and pings until it is disconnected.
+func (app *application) writeChat(c *chatClient) {
+	ticker := time.NewTicker(chatPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-c.send:
+			err := c.conn.WriteMessage(websocket.OpText, event)
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			err := c.conn.Ping()
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			// The reader gets the client's answer, or gives up after the grace period.
+			c.conn.WriteClose(c.closeCode, c.closeReason)
+			c.conn.SetReadDeadline(time.Now().Add(chatCloseGrace))
+			return
+		}
+	}
+}
+
+// readChat() handles what the client sends until it closes the connection, or the
+// connection breaks.
+func (app *application) readChat(c *chatClient) {
+	c.extendReadDeadline()
+	for {
+		_, msg, err := c.conn.ReadMessage(c.extendReadDeadline)
+		if err != nil {
+			return
+		}
+		c.extendReadDeadline()
+
+		var cmd struct {
+			Type           string `json:"type"`
+			ConversationID int64  `json:"conversation_id"`
+			Body           string `json:"body"`
+			Ref            string `json:"ref"`
+		}
+
+		err = json.Unmarshal(msg, &cmd)
+		if err != nil {
+			c.pushError("", "body must be a JSON object")
+			continue
+		}
+
+		if !c.limiter.Allow() {
+			c.pushError(cmd.Ref, "rate limit exceeded")
+			continue
+		}
+
+		switch cmd.Type {
+		case "subscribe":
+			app.subscribeChat(c, cmd.ConversationID, cmd.Ref)
+		case "unsubscribe":
+			app.chat.unsubscribe(c, cmd.ConversationID)
+			c.push(chatEvent(envelope{"type": "unsubscribed", "ref": cmd.Ref, "conversation_id": cmd.ConversationID}))
+		case "message":
+			app.sendChatMessage(c, cmd.ConversationID, cmd.Body, cmd.Ref)
+		case "typing":
+			if _, ok := app.chat.participants(c, cmd.ConversationID); !ok {
+				c.pushError(cmd.Ref, "not subscribed to the conversation")
+				continue
+			}
+			err := app.models.Conversations.Notify(&data.ChatNotification{
+				Type:           data.ChatTyping,
+				ConversationID: cmd.ConversationID,
+				UserID:         c.userID,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		default:
+			c.pushError(cmd.Ref, "unknown type")
+		}
+	}
+}
+
+func (app *application) subscribeChat(c *chatClient, conversationID int64, ref string) {
+	conv, err := app.models.Conversations.Select(conversationID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		app.logger.PrintError(err, nil)
+		c.pushError(ref, "the server encountered a problem and could not process your request")
+		return
+	}
+	if err != nil || !conv.HasParticipant(c.userID) {
+		c.pushError(ref, "the requested resource could not be found")
+		return
+	}
+
+	online, ok := app.chat.subscribe(c, conv)
+	if !ok {
+		c.pushError(ref, "too many subscriptions")
+		return
+	}
+
+	c.push(chatEvent(envelope{"type": "subscribed", "ref": ref, "conversation_id": conv.ID, "online": online}))
+}
+
+// sendChatMessage() stores a message like postConversationMessageHandler(). Everyone
+// following the conversation, on any instance, gets it once it is stored.
+func (app *application) sendChatMessage(c *chatClient, conversationID int64, body, ref string) {
+	participants, ok := app.chat.participants(c, conversationID)
+	if !ok {
+		c.pushError(ref, "not subscribed to the conversation")
+		return
+	}
+
+	msg := &data.Message{
+		ConversationID: conversationID,
+		SenderID:       &c.userID,
+		Body:           body,
+	}
+
+	v := validator.New()
+	if data.ValidateMessage(v, msg); !v.Valid() {
+		c.pushError(ref, v.Errors["body"])
+		return
+	}
+
+	conv := &data.Conversation{ID: conversationID, Participants: participants}
+	blocked, err := app.blockedInConversation(conv, c.userID)
+	if err == nil && blocked {
+		c.pushError(ref, "your user account doesn't have the necessary permissions to access this resource")
+		return
+	}
+	if err == nil {
+		err = app.insertMessage(msg)
+	}
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		c.pushError(ref, "the server encountered a problem and could not process your request")
+		return
+	}
+
+	c.push(chatEvent(envelope{"type": "sent", "ref": ref, "message": msg}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"letsgofurther/internal/data"
 	"net/http"
+	"sync"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -14,11 +15,26 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// When a request is authenticated with an API key rather than a bearer token, the key
+// is stored in the context as well so that its permissions can be checked.
+const apiKeyContextKey = contextKey("apiKey")
+
+// The user's permissions are loaded at most once per request, however many times they
+// are checked, and kept under this key.
+const permissionsContextKey = contextKey("permissions")
+
+type requestPermissions struct {
+	once        sync.Once
+	permissions data.Permissions
+	err         error
+}
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, permissionsContextKey, &requestPermissions{})
 	return r.WithContext(ctx)
 }
 
@@ -34,3 +50,32 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key used
+// to authenticate it added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() retrieves the API key from the request context. Unlike the
+// user, the key is optional, so nil is returned for requests which weren't
+// authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// The contextGetPermissions() method returns the permissions of the user in the request
+// context, loading them on first use.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, error) {
+	rp, ok := r.Context().Value(permissionsContextKey).(*requestPermissions)
+	if !ok {
+		panic("missing permissions value in request context")
+	}
+
+	rp.once.Do(func() {
+		rp.permissions, rp.err = app.models.Permissions.SelectAllForUser(app.contextGetUser(r).ID)
+	})
+	return rp.permissions, rp.err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+)
+
+// readConversationParam() loads the conversation named by the ":id" URL parameter.
+// Conversations the user doesn't take part in are reported as not found.
+func (app *application) readConversationParam(w http.ResponseWriter, r *http.Request) (*data.Conversation, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	conv, err := app.models.Conversations.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if !conv.HasParticipant(app.contextGetUser(r).ID) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return conv, true
+}
+
+// blockedInConversation() reports whether the user and any other participant of the
+// conversation have blocked each other, in which case the user can't write to it.
+func (app *application) blockedInConversation(conv *data.Conversation, userID int64) (bool, error) {
+	for _, id := range conv.Participants {
+		if id == userID {
+			continue
+		}
+		blocked, err := app.models.Blocks.Blocked(userID, id)
+		if err != nil || blocked {
+			return blocked, err
+		}
+	}
+	return false, nil
+}
+
+// insertMessage() stores the message and records the message.sent event in one unit of
+// work, so that the other participants are notified of every message, and only of
+// messages which were actually stored.
+func (app *application) insertMessage(msg *data.Message) error {
+	return app.models.Transaction(func(tx data.Models) error {
+		err := tx.Conversations.InsertMessage(msg)
+		if err != nil {
+			return err
+		}
+		return tx.Events.Record(data.EventMessageSent, msg)
+	})
+}
+
+// notifyNewMessage() sends a new_message notification to every participant of the
+// conversation but the sender. It is subscribed to the message.sent event, and when the
+// event is dispatched again, only the participants who weren't notified yet are.
+func (app *application) notifyNewMessage(event *data.Event) error {
+	var msg data.Message
+	err := json.Unmarshal(event.Data, &msg)
+	if err != nil {
+		return err
+	}
+	// Messages of deleted users aren't worth telling anyone about.
+	if msg.SenderID == nil {
+		return nil
+	}
+
+	conv, err := app.models.Conversations.Select(msg.ConversationID)
+	if err != nil {
+		if errors.Is(err, data.ErrNotFoundRecord) {
+			return nil
+		}
+		return err
+	}
+
+	sender, err := app.models.Users.Select(*msg.SenderID)
+	if err != nil {
+		if errors.Is(err, data.ErrNotFoundRecord) {
+			return nil
+		}
+		return err
+	}
+
+	for _, id := range conv.Participants {
+		if id == sender.ID {
+			continue
+		}
+		_, err := app.models.Notifications.DispatchForEvent(event.ID, id, data.NotificationNewMessage, map[string]any{
+			"conversationID": conv.ID,
+			"messageID":      msg.ID,
+			"senderName":     sender.Name,
+			"body":           msg.Body,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start a conversation with another user, optionally about a listing. If the two of
+// them already have one about the same listing, that one is returned instead.
+func (app *application) postConversationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID    int64  `json:"user_id"`
+		ListingID *int64 `json:"listing_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	v.Check(input.UserID > 0, "user_id", "must be provided")
+	v.Check(input.UserID != user.ID, "user_id", "must not be your own user ID")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	other, err := app.models.Users.Select(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			v.AddError("user_id", "no such user")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	blocked, err := app.blockedWith(r, other.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		v.AddError("user_id", "you can't message this user")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.ListingID != nil {
+		_, err := app.models.Listings.Select(*input.ListingID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotFoundRecord):
+				v.AddError("listing_id", "no such listing")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	conv := &data.Conversation{
+		ListingID:    input.ListingID,
+		Participants: []int64{user.ID, other.ID},
+	}
+
+	started, err := app.models.Conversations.Start(conv)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	headers := make(http.Header)
+	if started {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/v1/conversations/%d/messages", conv.ID))
+	}
+
+	err = app.writeJSON(w, status, envelope{"conversation": conv}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the current user's conversations, the most recently active first.
+func (app *application) getAllConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	conversations, metadata, err := app.models.Conversations.SelectAllForUser(app.contextGetUser(r).ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"conversations": conversations, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the messages of a conversation, the newest first. The before parameter takes the
+// ID of the oldest message the client has, to page further back.
+func (app *application) getConversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.readConversationParam(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	var before int64
+	if s := qs.Get("before"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		v.Check(err == nil && id > 0, "before", "must be a positive integer")
+		before = id
+	}
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(limit > 0 && limit <= 100, "limit", "must be between 1 and 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	messages, err := app.models.Conversations.SelectMessages(conv.ID, before, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"messages": messages}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Send a message to a conversation. Clients connected to the chat get it right away;
+// this endpoint is for those which aren't.
+func (app *application) postConversationMessageHandler(w http.ResponseWriter, r *http.Request) {
+	conv, ok := app.readConversationParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Body string `json:"body"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	msg := &data.Message{
+		ConversationID: conv.ID,
+		SenderID:       &user.ID,
+		Body:           input.Body,
+	}
+
+	v := validator.New()
+	if data.ValidateMessage(v, msg); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	blocked, err := app.blockedInConversation(conv, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.insertMessage(msg)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"message": msg}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
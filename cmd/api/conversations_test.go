@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/jsonlog"
+	"testing"
+)
+
+func (m *fakeUserModel) Select(id int64) (*data.User, error) {
+	for _, user := range m.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, data.ErrNotFoundRecord
+}
+
+type fakeConversationModel struct {
+	data.ConversationModel
+	conv *data.Conversation
+}
+
+func (m *fakeConversationModel) Select(id int64) (*data.Conversation, error) {
+	if id != m.conv.ID {
+		return nil, data.ErrNotFoundRecord
+	}
+	return m.conv, nil
+}
+
+// A fakeNotificationModel keeps who got notified about which event, like
+// DispatchForEvent does, and fails for the users in failFor.
+type fakeNotificationModel struct {
+	data.NotificationModel
+	notified map[[2]int64]bool
+	sent     map[int64]int
+	failFor  map[int64]bool
+}
+
+func (m *fakeNotificationModel) DispatchForEvent(eventID, userID int64, notificationType string, payload map[string]any) (*data.Notification, error) {
+	if m.failFor[userID] {
+		return nil, errors.New("dispatch failed")
+	}
+	key := [2]int64{eventID, userID}
+	if m.notified[key] {
+		return nil, nil
+	}
+	m.notified[key] = true
+	m.sent[userID]++
+	return &data.Notification{UserID: userID, Type: notificationType, Data: payload}, nil
+}
+
+// A message.sent event which is dispatched again, after its subscriber failed half way,
+// notifies nobody twice.
+func TestNotifyNewMessageRetried(t *testing.T) {
+	senderID := int64(1)
+	notifications := &fakeNotificationModel{notified: make(map[[2]int64]bool), sent: make(map[int64]int), failFor: map[int64]bool{3: true}}
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models: data.Models{
+			Users:         &fakeUserModel{users: map[string]*data.User{"alice@example.com": {ID: senderID, Name: "Alice"}}},
+			Conversations: &fakeConversationModel{conv: &data.Conversation{ID: 7, Participants: []int64{1, 2, 3}}},
+			Notifications: notifications,
+		},
+	}
+
+	event := &data.Event{
+		ID:   42,
+		Type: data.EventMessageSent,
+		Data: []byte(`{"id":5,"conversation_id":7,"sender_id":1,"body":"Is it still available?"}`),
+	}
+
+	err := app.notifyNewMessage(event)
+	if err == nil {
+		t.Fatal("got no error while notifying user 3 fails")
+	}
+
+	delete(notifications.failFor, 3)
+	err = app.notifyNewMessage(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, want := range map[int64]int{1: 0, 2: 1, 3: 1} {
+		if got := notifications.sent[userID]; got != want {
+			t.Errorf("got user %d notified %d times; want %d", userID, got, want)
+		}
+	}
+}
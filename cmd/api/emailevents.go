@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Receive bounce and complaint notifications from the mail provider, in a generic
+// format which a small adapter for any provider, or a local stub, can produce:
+//
+//	POST /v1/webhooks/email-events
+//	X-Webhook-Secret: <the -email-webhook-secret value>
+//
+//	{"events": [{"type": "hard_bounce", "email": "alice@example.com",
+//	             "diagnostic": "550 5.1.1 user unknown", "occurred_at": "2026-10-19T09:30:00Z"}]}
+//
+// The type is one of hard_bounce, soft_bounce and complaint; diagnostic and occurred_at
+// are optional. The secret goes in its own header, since the Authorization header is
+// taken by user authentication. Without a configured secret the endpoint doesn't exist.
+func (app *application) postEmailEventsHandler(w http.ResponseWriter, r *http.Request) {
+	secret := app.config.mailer.webhookSecret
+	if secret == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Webhook-Secret")), []byte(secret)) != 1 {
+		app.errorResponse(w, r, http.StatusUnauthorized, "invalid or missing webhook secret")
+		return
+	}
+
+	var input struct {
+		Events []*data.EmailEvent `json:"events"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Events) > 0, "events", "must contain at least 1 event")
+	v.Check(len(input.Events) <= 100, "events", "must not contain more than 100 events")
+
+	for i, event := range input.Events {
+		ev := validator.New()
+		if data.ValidateEmailEvent(ev, event); !ev.Valid() {
+			for key, message := range ev.Errors {
+				v.AddError(fmt.Sprintf("events[%d].%s", i, key), message)
+			}
+		}
+		if event.OccurredAt.IsZero() {
+			event.OccurredAt = time.Now()
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suppressed := 0
+	for _, event := range input.Events {
+		ok, err := app.models.EmailSuppressions.RecordEvent(event)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if ok {
+			suppressed++
+			app.logger.PrintInfo("email address suppressed", map[string]string{
+				"reason": event.Type,
+			})
+		}
+	}
+
+	env := envelope{"recorded": len(input.Events), "suppressed": suppressed}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Let email be sent to a user's address again, for instance after they fixed their
+// mailbox.
+func (app *application) deleteUserEmailSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.EmailSuppressions.Delete(user.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("email address suppression lifted", map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "email suppression successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // The logError() method is a generic helper for logging an error message. Later in the
@@ -70,6 +73,13 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// The preconditionFailedResponse() method is used when the resource changed since the
+// client fetched the version it names in its If-Match header.
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has changed since you fetched it, please fetch it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -101,3 +111,23 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can only be accessed with an authentication token, not an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) twoFactorAlreadyEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is already enabled for this account"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// The loginThrottledResponse() method tells the client how many seconds to wait, both in
+// a Retry-After header and in the message.
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, delay time.Duration) {
+	seconds := int(math.Ceil(delay.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := fmt.Sprintf("too many failed login attempts, please try again in %d seconds", seconds)
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
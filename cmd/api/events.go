@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long a claimed event is reserved for the dispatcher which claimed it.
+	eventLease = 5 * time.Minute
+	// How long an idle dispatcher waits for a wake-up before looking for due events
+	// anyway. Wake-ups come through Postgres, and can get lost when the listening
+	// connection drops.
+	eventPollInterval = 5 * time.Second
+	// The wait before the first retry, which doubles with each further attempt up to
+	// eventMaxBackoff.
+	eventBaseBackoff = 10 * time.Second
+	eventMaxBackoff  = time.Hour
+)
+
+// subscribeEvents() registers the in-process subscribers to the domain events.
+func (app *application) subscribeEvents() {
+	// Downstream systems learn about events through their webhook subscriptions.
+	for _, eventType := range data.WebhookEventTypes {
+		app.events.Subscribe(eventType, func(event *data.Event) error {
+			_, err := app.models.Webhooks.Enqueue(event.ID, event.Type, event.Data)
+			return err
+		})
+	}
+
+	// The other participants of a conversation are told about new messages.
+	app.events.Subscribe(data.EventMessageSent, app.notifyNewMessage)
+}
+
+// startEventDispatchers() starts the dispatchers which hand recorded events to the
+// subscribers. Like the email outbox workers, they stop when the server shuts down,
+// after finishing the event they are dispatching.
+func (app *application) startEventDispatchers() {
+	for i := 0; i < app.config.events.workers; i++ {
+		app.wg.Add(1)
+		go app.eventDispatcher()
+	}
+}
+
+func (app *application) eventDispatcher() {
+	defer app.wg.Done()
+
+	for {
+		event, err := app.models.Events.Claim(eventLease)
+		if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+			app.logger.PrintError(err, nil)
+		}
+
+		if err != nil {
+			select {
+			case <-app.shutdown:
+				return
+			case <-app.events.Woken():
+				continue
+			case <-time.After(eventPollInterval):
+				continue
+			}
+		}
+
+		app.dispatchEvent(event)
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+}
+
+// dispatchEvent() hands the event to its subscribers, and records how it went. If any
+// of them fails, all of them get the event again after a backoff.
+func (app *application) dispatchEvent(event *data.Event) {
+	err := func() (err error) {
+		// Recover any panic in a subscriber, treating it like any other failure.
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New("panic while dispatching event")
+			}
+		}()
+		return app.events.Publish(event)
+	}()
+	if err == nil {
+		err = app.models.Events.MarkDispatched(event.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+
+	properties := map[string]string{
+		"event_id": strconv.FormatInt(event.ID, 10),
+		"type":     event.Type,
+		"attempts": strconv.Itoa(event.Attempts),
+	}
+
+	if event.Attempts >= app.config.events.maxAttempts {
+		app.logger.PrintError(err, properties)
+		err = app.models.Events.DeadLetter(event.ID, err.Error())
+	} else {
+		app.logger.PrintInfo("dispatching event failed: "+err.Error(), properties)
+		err = app.models.Events.Retry(event.ID, err.Error(), time.Now().Add(retryBackoff(event.Attempts, eventBaseBackoff, eventMaxBackoff)))
+	}
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
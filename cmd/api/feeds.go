@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/feed"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The formats listing feeds come in.
+const (
+	feedFormatAtom = "atom"
+	feedFormatRSS  = "rss"
+)
+
+// getListingsFeedHandler() returns the handler which serves the newest listings as an
+// Atom or RSS feed, depending on the format. It takes the same query string parameters
+// as GET /v1/listings, but sorts by -created_at by default.
+//
+// Feed readers poll, so the feed comes with an ETag and a Last-Modified time, and a
+// reader which sends either back gets a 304 Not Modified response without a body while
+// nothing changed. The ETag is the one to rely on: Last-Modified can't tell that a
+// listing was deleted.
+func (app *application) getListingsFeedHandler(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := validator.New()
+
+		qs := r.URL.Query()
+		title, categories, filters := app.readListingFilters(qs, "-created_at", 20, v)
+		v.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		listings, _, err := app.models.Listings.SelectAll(title, categories, app.viewerID(r), filters)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		f := app.listingsFeed(r, title, categories, listings)
+
+		var body []byte
+		var contentType string
+		switch format {
+		case feedFormatRSS:
+			body, err = feed.RSS(f)
+			contentType = feed.RSSContentType
+		default:
+			body, err = feed.Atom(f)
+			contentType = feed.AtomContentType
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		lastModified := f.Updated()
+
+		w.Header().Set("ETag", etag)
+		if !lastModified.IsZero() {
+			w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+
+		if app.notModified(r, etag, lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// listingsFeed() describes the listings as a feed. Its ID and links are absolute URLs
+// under the -base-url, as feed readers require.
+func (app *application) listingsFeed(r *http.Request, title string, categories []string, listings []*data.Listing) *feed.Feed {
+	query := ""
+	if r.URL.RawQuery != "" {
+		query = "?" + r.URL.RawQuery
+	}
+	selfURL := app.config.baseURL + r.URL.Path + query
+
+	feedTitle := "Diggo listings"
+	var filters []string
+	if title != "" {
+		filters = append(filters, fmt.Sprintf("matching %q", title))
+	}
+	if len(categories) > 0 {
+		filters = append(filters, "in "+strings.Join(categories, ", "))
+	}
+	if len(filters) > 0 {
+		feedTitle += " " + strings.Join(filters, " ")
+	}
+
+	f := &feed.Feed{
+		ID:          selfURL,
+		Title:       feedTitle,
+		Description: "The newest listings on Diggo.",
+		SelfURL:     selfURL,
+		Link:        app.config.baseURL + "/v1/listings" + query,
+	}
+
+	for _, listing := range listings {
+		link := fmt.Sprintf("%s/v1/listings/%d", app.config.baseURL, listing.ID)
+
+		updated := listing.UpdatedAt
+		if updated.Before(listing.CreatedAt) {
+			updated = listing.CreatedAt
+		}
+
+		f.Entries = append(f.Entries, &feed.Entry{
+			ID:         link,
+			Title:      listing.Title,
+			Link:       link,
+			Summary:    fmt.Sprintf("%s\n\nPrice: %d dallas", listing.Description, listing.Price),
+			Categories: listing.Categories,
+			Published:  listing.CreatedAt,
+			Updated:    updated.Truncate(time.Second),
+		})
+	}
+
+	return f
+}
@@ -5,11 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"letsgofurther/internal/mailer"
 	"letsgofurther/internal/validator"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -156,6 +161,56 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readLocale() helper picks the locale for the user from the Accept-Language
+// header: the one the client prefers most among those there are email templates for.
+// A preference for a regional variant, such as "de-AT", is met by the language, "de".
+// Without a match it returns mailer.DefaultLocale.
+func (app *application) readLocale(r *http.Request) string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+
+	var preferences []preference
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		preferences = append(preferences, preference{tag: tag, q: q})
+	}
+
+	// Keep the order of the header for equal weights.
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].q > preferences[j].q
+	})
+
+	for _, p := range preferences {
+		language, _, _ := strings.Cut(p.tag, "-")
+		for _, locale := range app.mailer.Locales() {
+			if locale == p.tag || locale == language {
+				return locale
+			}
+		}
+	}
+
+	return mailer.DefaultLocale
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
@@ -174,3 +229,92 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The notModified() helper reports whether the client's cached copy of a response with
+// the given ETag and Last-Modified time is still fresh, going by the If-None-Match and
+// If-Modified-Since headers. As RFC 9110 asks, If-Modified-Since is ignored when
+// If-None-Match is present, and ETags are compared weakly.
+func (app *application) notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	// HTTP dates only have a resolution of seconds.
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// The preconditionFailed() helper reports whether the request has an If-Match header
+// which doesn't match the current ETag of the resource it changes. Unlike If-None-Match,
+// If-Match compares ETags strongly, so a weak ETag never matches.
+func (app *application) preconditionFailed(r *http.Request, etag string) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(im, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return false
+		}
+	}
+	return true
+}
+
+// etagMatches() reports whether a list of ETags, as sent in If-None-Match, contains the
+// ETag or is "*".
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// The clientIP() helper returns the address of the client which made the request, for
+// security decisions like throttling logins or checking an API key's allowlist. Clients
+// can send any X-Forwarded-For header they like, so it is only believed as far as it
+// was written by the -trusted-proxy proxies: the address is that of the peer, unless
+// the peer is a trusted proxy, in which case the header is walked back from the end
+// until an address which isn't a trusted proxy is found.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0 && app.trustedProxy(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+
+	return addr.String()
+}
+
+func (app *application) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range app.config.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"letsgofurther/internal/mailer"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	app := &application{}
+	app.config.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "203.0.113.7:5123", nil, "203.0.113.7"},
+		{"spoofed by an untrusted peer", "203.0.113.7:5123", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"through a trusted proxy", "10.0.0.2:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client-sent entries before the proxy's", "10.0.0.2:80", []string{"192.0.2.99, 198.51.100.1"}, "198.51.100.1"},
+		{"through two trusted proxies", "10.0.0.2:80", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"several headers", "10.0.0.2:80", []string{"192.0.2.99", "198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.2:80", nil, "10.0.0.2"},
+		{"garbage in the header", "10.0.0.2:80", []string{"nonsense"}, "10.0.0.2"},
+		{"IPv6 peer", "[2001:db8::1]:443", []string{"198.51.100.1"}, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			r.Header.Set("X-Real-IP", "192.0.2.200")
+
+			if got := app.clientIP(r); got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLocale(t *testing.T) {
+	mail, err := mailer.New(mailer.NewMemorySender(), "Diggo <info@diggo.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{mailer: mail}
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		want           string
+	}{
+		{"no header", "", "en"},
+		{"default locale", "en", "en"},
+		{"translation", "de", "de"},
+		{"upper case", "DE", "de"},
+		{"region", "de-AT", "de"},
+		{"no templates", "fr", "en"},
+		{"first match", "fr, de, en", "de"},
+		{"by weight", "en;q=0.8, de;q=0.9", "de"},
+		{"header order for equal weights", "de;q=0.5, en;q=0.5", "de"},
+		{"region by weight", "en-GB;q=0.7, de-CH", "de"},
+		{"refused", "de;q=0, en", "en"},
+		{"wildcard", "*, de;q=0.1", "de"},
+		{"bad weight", "de;q=high, en;q=0.5", "en"},
+		{"spaces", " de-de ; q=0.9 ", "de"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			if got := app.readLocale(r); got != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		list string
+		etag string
+		want bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`"abc"`, `"abd"`, false},
+		{`"x", "abc"`, `"abc"`, true},
+		{`"x","abc"`, `"abc"`, true},
+		{`*`, `"abc"`, true},
+		// If-None-Match compares weakly.
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`abc`, `"abc"`, false},
+		{``, `"abc"`, false},
+	}
+
+	for _, tt := range tests {
+		if got := etagMatches(tt.list, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %t; want %t", tt.list, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	app := &application{}
+	lastModified := time.Date(2026, 10, 19, 9, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name            string
+		ifNoneMatch     string
+		ifModifiedSince string
+		want            bool
+	}{
+		{"no conditions", "", "", false},
+		{"matching ETag", `"v1"`, "", true},
+		{"other ETag", `"v0"`, "", false},
+		{"not modified since", "", "Mon, 19 Oct 2026 09:00:00 GMT", true},
+		{"modified since", "", "Mon, 19 Oct 2026 08:59:59 GMT", false},
+		{"bad date", "", "yesterday", false},
+		// If-Modified-Since only counts without If-None-Match.
+		{"other ETag, not modified since", `"v0"`, "Mon, 19 Oct 2026 09:00:00 GMT", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+
+			if got := app.notModified(r, `"v1"`, lastModified); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+
+	// Without a Last-Modified time, only the ETag counts.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-Modified-Since", "Mon, 19 Oct 2026 09:00:00 GMT")
+	if app.notModified(r, `"v1"`, time.Time{}) {
+		t.Error("got not modified without a Last-Modified time")
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		want    bool
+	}{
+		{"no If-Match", "", false},
+		{"current ETag", `"3"`, false},
+		{"stale ETag", `"2"`, true},
+		{"one of several", `"2", "3"`, false},
+		{"none of several", `"1", "2"`, true},
+		{"any", `*`, false},
+		// If-Match compares strongly.
+		{"weak ETag", `W/"3"`, true},
+		{"unquoted", `3`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PATCH", "/", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			if got := app.preconditionFailed(r, `"3"`); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"letsgofurther/internal/data"
+	"net/http"
+	"time"
+)
+
+const (
+	// How long the response to a request with an Idempotency-Key is kept for retries.
+	idempotencyKeyTTL = 24 * time.Hour
+	// How long a retry waits for the first request to finish before taking it for
+	// dead and running in its place. It is well beyond the server's WriteTimeout.
+	idempotencyLease  = time.Minute
+	idempotencyMaxKey = 255
+	// The largest request body which is hashed. The handlers behind idempotent()
+	// accept much smaller bodies than this anyway.
+	idempotencyMaxBody = 1 << 20
+)
+
+// idempotent() lets clients safely retry a POST request by sending the same
+// Idempotency-Key header with each attempt. The first response, which is stored for
+// 24 hours, is replayed to any retry with an Idempotent-Replayed header; the handler
+// doesn't run again. Keys belong to the user making the request, or for anonymous
+// requests like signing up to the client's address, and a key may only be used for
+// one request: reusing it with a different method, URL or body gets a 422
+// Unprocessable Entity response. Requests without the header run as usual.
+//
+// Responses with a 5xx status aren't kept, so that a request which failed on the
+// server's side can be retried for real.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > idempotencyMaxKey {
+			app.errorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key header must not be more than %d bytes long", idempotencyMaxKey))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBody))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+				return
+			}
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The hash is keyed, so that what is stored can't be used to guess what was
+		// in the request.
+		h := hmac.New(sha256.New, []byte(app.config.idempotency.secret))
+		fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+		h.Write(body)
+		requestHash := h.Sum(nil)
+
+		// Anonymous users, who can only sign up, share the user ID 0, so their keys
+		// are told apart by the client's address. Otherwise anybody who sent the same
+		// key would get somebody else's response.
+		user := app.contextGetUser(r)
+		userID := user.ID
+		if user.IsAnonymous() {
+			key = app.clientIP(r) + " " + key
+		}
+
+		stored, err := app.models.Idempotency.Claim(userID, key, requestHash, idempotencyKeyTTL, idempotencyLease)
+		if err != nil && !errors.Is(err, data.ErrEditConflict) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		switch {
+		case err != nil || (stored != nil && stored.Status == 0 && hmac.Equal(stored.RequestHash, requestHash)):
+			w.Header().Set("Retry-After", "1")
+			app.errorResponse(w, r, http.StatusConflict, "a request with this Idempotency-Key is still being processed, please try again")
+			return
+		case stored != nil && !hmac.Equal(stored.RequestHash, requestHash):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request")
+			return
+		case stored != nil:
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// The key is ours, and has to be let go of unless a response is stored for it,
+		// even if the handler panics.
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			err := app.models.Idempotency.Release(userID, key)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		rec := &responseRecorder{header: make(http.Header)}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if rec.status < http.StatusInternalServerError {
+			err = app.models.Idempotency.Complete(userID, key, &data.IdempotentResponse{
+				RequestHash: requestHash,
+				Status:      rec.status,
+				Header:      rec.header,
+				Body:        rec.body.Bytes(),
+			})
+			if err != nil {
+				// The request did succeed, so the client gets its response, but a
+				// retry will run it again.
+				app.logError(r, err)
+			} else {
+				completed = true
+			}
+		}
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// A responseRecorder keeps a response in memory, so that it can be stored before it is
+// sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// purgeIdempotencyKeys() deletes the expired idempotency keys at the given interval,
+// for as long as the process runs. Expired keys are reused anyway, but would otherwise
+// pile up.
+func (app *application) purgeIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := app.models.Idempotency.DeleteExpired()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
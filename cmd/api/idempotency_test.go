@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/jsonlog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeIdempotencyModel keeps the keys claimed in memory, by user ID and key. Keys
+// don't expire.
+type fakeIdempotencyModel struct {
+	data.IdempotencyModel
+	mu       sync.Mutex
+	keys     map[int64]map[string]*data.IdempotentResponse
+	released []string
+}
+
+func (m *fakeIdempotencyModel) Claim(userID int64, key string, requestHash []byte, ttl, lease time.Duration) (*data.IdempotentResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keys == nil {
+		m.keys = make(map[int64]map[string]*data.IdempotentResponse)
+	}
+	if m.keys[userID] == nil {
+		m.keys[userID] = make(map[string]*data.IdempotentResponse)
+	}
+	if stored, ok := m.keys[userID][key]; ok {
+		resp := *stored
+		return &resp, nil
+	}
+	m.keys[userID][key] = &data.IdempotentResponse{RequestHash: requestHash}
+	return nil, nil
+}
+
+func (m *fakeIdempotencyModel) Complete(userID int64, key string, resp *data.IdempotentResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys[userID][key] = resp
+	return nil
+}
+
+func (m *fakeIdempotencyModel) Release(userID int64, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keys[userID][key].Status == 0 {
+		delete(m.keys[userID], key)
+		m.released = append(m.released, key)
+	}
+	return nil
+}
+
+func newIdempotencyTestApp() (*application, *fakeIdempotencyModel) {
+	idempotency := &fakeIdempotencyModel{}
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models: data.Models{Idempotency: idempotency},
+	}
+	app.config.idempotency.secret = "not-so-secret"
+	return app, idempotency
+}
+
+// sendIdempotent() sends a POST request with the Idempotency-Key as the user, from the
+// client address.
+func sendIdempotent(handler http.HandlerFunc, app *application, user *data.User, ip, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/listings", strings.NewReader(body))
+	r.RemoteAddr = ip + ":5123"
+	r.Header.Set("Idempotency-Key", key)
+	r = app.contextSetUser(r, user)
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// A createdHandler counts the requests it has run, and tells them apart by their
+// number.
+type createdHandler struct {
+	mu   sync.Mutex
+	runs int
+}
+
+func (h *createdHandler) serve(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.runs++
+	runs := h.runs
+	h.mu.Unlock()
+
+	w.Header().Set("Location", "/v1/listings/1")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, strings.Repeat("x", runs))
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	alice := &data.User{ID: 1}
+	bob := &data.User{ID: 2}
+
+	tests := []struct {
+		name       string
+		user       *data.User
+		ip         string
+		wantReplay bool
+	}{
+		{"same user", alice, testIP, true},
+		{"same user from elsewhere", alice, "198.51.100.1", true},
+		{"different user", bob, testIP, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newIdempotencyTestApp()
+			next := &createdHandler{}
+			handler := app.idempotent(next.serve)
+
+			first := sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+			retry := sendIdempotent(handler, app, tt.user, tt.ip, "key-1", `{"title":"Bike"}`)
+
+			if first.Code != http.StatusCreated || retry.Code != http.StatusCreated {
+				t.Fatalf("got statuses %d and %d; want %d", first.Code, retry.Code, http.StatusCreated)
+			}
+			if replayed := retry.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplay {
+				t.Errorf("got the retry replayed %t; want %t", replayed, tt.wantReplay)
+			}
+			if first.Header().Get("Idempotent-Replayed") != "" {
+				t.Error("got the first request replayed")
+			}
+
+			wantRuns := 2
+			if tt.wantReplay {
+				wantRuns = 1
+				if !bytes.Equal(retry.Body.Bytes(), first.Body.Bytes()) || retry.Header().Get("Location") != "/v1/listings/1" {
+					t.Errorf("got replay %q, Location %q; want %q", retry.Body, retry.Header().Get("Location"), first.Body)
+				}
+			}
+			if next.runs != wantRuns {
+				t.Errorf("got the handler run %d times; want %d", next.runs, wantRuns)
+			}
+		})
+	}
+}
+
+// Anonymous requests, like signing up, are only replayed to the client which made them.
+func TestIdempotentAnonymous(t *testing.T) {
+	app, idempotency := newIdempotencyTestApp()
+	next := &createdHandler{}
+	handler := app.idempotent(next.serve)
+
+	body := `{"email":"alice@example.com","password":"pa55word"}`
+	sendIdempotent(handler, app, data.AnonymousUser, testIP, "signup", body)
+	other := sendIdempotent(handler, app, data.AnonymousUser, "198.51.100.1", "signup", body)
+	retry := sendIdempotent(handler, app, data.AnonymousUser, testIP, "signup", body)
+
+	if other.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("got the response to another client replayed")
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("got the retry of the same client run again")
+	}
+	if next.runs != 2 {
+		t.Errorf("got the handler run %d times; want 2", next.runs)
+	}
+
+	// What is stored for the key gives nothing of the request away without the secret.
+	stored := idempotency.keys[0][testIP+" signup"]
+	if stored == nil {
+		t.Fatalf("got keys %v stored; want %q", idempotency.keys[0], testIP+" signup")
+	}
+	app.config.idempotency.secret = "another-secret"
+	rehashed := sendIdempotent(handler, app, data.AnonymousUser, testIP, "signup", body)
+	if rehashed.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d with another secret; want %d", rehashed.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotentDifferentRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"different body", "/v1/listings", `{"title":"Car"}`},
+		{"different URL", "/v1/listings?draft=true", `{"title":"Bike"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _ := newIdempotencyTestApp()
+			next := &createdHandler{}
+			handler := app.idempotent(next.serve)
+			alice := &data.User{ID: 1}
+
+			sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Idempotency-Key", "key-1")
+			r = app.contextSetUser(r, alice)
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d", w.Code, http.StatusUnprocessableEntity)
+			}
+			if next.runs != 1 {
+				t.Errorf("got the handler run %d times; want 1", next.runs)
+			}
+		})
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	app, _ := newIdempotencyTestApp()
+	alice := &data.User{ID: 1}
+
+	// The retry arrives while the first request is still being handled.
+	var retry *httptest.ResponseRecorder
+	var handler http.HandlerFunc
+	handler = app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		retry = sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	first := sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+
+	if first.Code != http.StatusCreated {
+		t.Errorf("got status %d for the first request; want %d", first.Code, http.StatusCreated)
+	}
+	if retry.Code != http.StatusConflict {
+		t.Errorf("got status %d for the retry; want %d", retry.Code, http.StatusConflict)
+	}
+	if retry.Header().Get("Retry-After") == "" {
+		t.Error("got no Retry-After header")
+	}
+}
+
+// A request which failed on the server's side runs again when it is retried.
+func TestIdempotentServerError(t *testing.T) {
+	app, idempotency := newIdempotencyTestApp()
+	alice := &data.User{ID: 1}
+
+	runs := 0
+	handler := app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		if runs == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	first := sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+	if first.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d; want %d", first.Code, http.StatusServiceUnavailable)
+	}
+	if len(idempotency.released) != 1 || len(idempotency.keys[alice.ID]) != 0 {
+		t.Errorf("got keys %v stored, %v released; want the key released", idempotency.keys[alice.ID], idempotency.released)
+	}
+
+	retry := sendIdempotent(handler, app, alice, testIP, "key-1", `{"title":"Bike"}`)
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("got status %d, replayed %q; want %d run again", retry.Code, retry.Header().Get("Idempotent-Replayed"), http.StatusCreated)
+	}
+	if runs != 2 {
+		t.Errorf("got the handler run %d times; want 2", runs)
+	}
+}
+
+func TestIdempotentWithoutKey(t *testing.T) {
+	app, idempotency := newIdempotencyTestApp()
+	next := &createdHandler{}
+	handler := app.idempotent(next.serve)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/v1/listings", strings.NewReader(`{"title":"Bike"}`))
+		r = app.contextSetUser(r, &data.User{ID: 1})
+		handler(httptest.NewRecorder(), r)
+	}
+
+	if next.runs != 2 {
+		t.Errorf("got the handler run %d times; want 2", next.runs)
+	}
+	if len(idempotency.keys) != 0 {
+		t.Errorf("got keys %v stored; want none", idempotency.keys)
+	}
+}
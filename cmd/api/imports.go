@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// How many rows are written in one transaction. The progress of an import is
+	// updated after each batch.
+	importBatchSize = 500
+	importMaxBytes  = 20 << 20
+	// The longest NDJSON line.
+	importMaxLine = 64 << 10
+	// How long reading an upload may take. The server's ReadTimeout is far too short
+	// for a large upload over a slow line.
+	importTimeout = 10 * time.Minute
+)
+
+// The columns of a CSV import, which must all be present, in any order.
+var importColumns = []string{"external_ref", "title", "description", "price", "categories"}
+
+// An importRow is one row of an upload, parsed into a listing. Its errors are those
+// found while parsing it; the "row" error means that there is no listing at all.
+type importRow struct {
+	number  int
+	listing *data.Listing
+	errors  map[string]string
+}
+
+// An importReader reads the rows of an upload one by one, returning io.EOF at the end.
+// Any other error means that the rest of the upload can't be read.
+type importReader interface {
+	next() (*importRow, error)
+}
+
+type csvImportReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	number  int
+}
+
+// newCSVImportReader() reads the header line, which names the columns.
+func newCSVImportReader(body io.Reader) (*csvImportReader, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, fmt.Errorf("body must start with a header line: %v", err)
+	}
+
+	// Exports, and files saved by spreadsheets, start with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], "\uFEFF")
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("body must have a %q column", name)
+		}
+	}
+
+	return &csvImportReader{r: r, columns: columns}, nil
+}
+
+func (ir *csvImportReader) next() (*importRow, error) {
+	record, err := ir.r.Read()
+	if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("body contains badly-formed CSV (at line %d)", parseErr.Line)
+		}
+		return nil, err
+	}
+
+	ir.number++
+	row := &importRow{number: ir.number, listing: &data.Listing{}, errors: make(map[string]string)}
+	if err != nil {
+		row.errors["row"] = fmt.Sprintf("must have %d fields", ir.r.FieldsPerRecord)
+		return row, nil
+	}
+
+	ref := record[ir.columns["external_ref"]]
+	row.listing.ExternalRef = &ref
+	// The text columns of an export are escaped for spreadsheets, which is undone
+	// here.
+	row.listing.Title = spreadsheetUnsafe(record[ir.columns["title"]])
+	row.listing.Description = spreadsheetUnsafe(record[ir.columns["description"]])
+
+	price := strings.TrimSpace(record[ir.columns["price"]])
+	if price != "" {
+		row.listing.Price, err = strconv.ParseInt(price, 10, 64)
+		if err != nil {
+			row.errors["price"] = "must be an integer value"
+		}
+	}
+
+	// Categories are comma-separated like in the query string of GET /v1/listings,
+	// which means that the field has to be quoted when there are several.
+	row.listing.Categories = []string{}
+	for _, category := range strings.Split(spreadsheetUnsafe(record[ir.columns["categories"]]), ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			row.listing.Categories = append(row.listing.Categories, category)
+		}
+	}
+
+	return row, nil
+}
+
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	number  int
+}
+
+func newNDJSONImportReader(body io.Reader) *ndjsonImportReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 4096), importMaxLine)
+	return &ndjsonImportReader{scanner: scanner}
+}
+
+func (ir *ndjsonImportReader) next() (*importRow, error) {
+	var line []byte
+	for len(line) == 0 {
+		if !ir.scanner.Scan() {
+			err := ir.scanner.Err()
+			switch {
+			case err == nil:
+				return nil, io.EOF
+			case errors.Is(err, bufio.ErrTooLong):
+				return nil, fmt.Errorf("body must not contain lines longer than %d bytes", importMaxLine)
+			default:
+				return nil, err
+			}
+		}
+		// Blank lines are skipped, and don't count as rows.
+		line = bytes.TrimSpace(ir.scanner.Bytes())
+	}
+
+	ir.number++
+	row := &importRow{number: ir.number, listing: &data.Listing{}, errors: make(map[string]string)}
+
+	var input struct {
+		ExternalRef string   `json:"external_ref"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Price       int64    `json:"price"`
+		Categories  []string `json:"categories"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&input)
+	// A line holds exactly one object; anything after it would be silently dropped.
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body contains trailing data")
+	}
+
+	// A value of the wrong type leaves its field empty, but the other fields are still
+	// decoded.
+	row.listing.ExternalRef = &input.ExternalRef
+	row.listing.Title = input.Title
+	row.listing.Description = input.Description
+	row.listing.Price = input.Price
+	row.listing.Categories = input.Categories
+
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			row.errors[typeErr.Field] = "has the wrong type"
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			row.errors["row"] = "contains unknown key " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+		default:
+			row.errors["row"] = "must be a JSON object"
+		}
+	}
+
+	return row, nil
+}
+
+// withListingImport() routes POST /v1/listings/import to the import. httprouter
+// doesn't allow a fixed path segment next to the ":id" of POST
+// /v1/listings/:id/reviews, so the import can't have a route of its own.
+func (app *application) withListingImport(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("id") != "import" {
+			app.methodNotAllowedResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Import listings from CSV (Content-Type: text/csv) or NDJSON (Content-Type:
+// application/x-ndjson). A CSV upload starts with a header line naming the columns:
+// external_ref, title, description, price and categories, which is comma-separated.
+// An NDJSON upload has one listing per line, as a JSON object with the same keys.
+//
+// The upload is stored, and the client gets a 202 Accepted response with the import's
+// Location once it has been received. The rows are imported in the background, and GET
+// /v1/imports/:id shows the progress, and the rows which were rejected.
+//
+// Listings are matched to those of earlier imports by their external_ref, so importing
+// a listing again updates it, unless it has been sold. Rows which are invalid or
+// belong to a sold listing are skipped.
+func (app *application) postListingImportHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var format string
+	switch mediaType {
+	case "text/csv":
+		format = data.ImportFormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		format = data.ImportFormatNDJSON
+	default:
+		app.errorResponse(w, r, http.StatusUnsupportedMediaType, "the body must be text/csv or application/x-ndjson")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	err := rc.SetReadDeadline(time.Now().Add(importTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The upload is spooled to a temporary file rather than kept in memory, since it
+	// can be large.
+	file, err := os.CreateTemp("", "listings-import-*")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Once the import runs in the background, the file is its to remove.
+	spooled := false
+	defer func() {
+		if !spooled {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	_, err = io.Copy(file, http.MaxBytesReader(w, r.Body, importMaxBytes))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var reader importReader
+	if format == data.ImportFormatCSV {
+		csvReader, err := newCSVImportReader(file)
+		if err != nil {
+			app.failedValidationResponse(w, r, map[string]string{"body": err.Error()})
+			return
+		}
+		reader = csvReader
+	} else {
+		reader = newNDJSONImportReader(file)
+	}
+
+	user := app.contextGetUser(r)
+
+	imp := &data.Import{UserID: user.ID, Format: format}
+	err = app.models.Imports.Insert(imp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The import is sent as it was when it started, since the background goroutine
+	// changes it as it goes.
+	started := *imp
+
+	spooled = true
+	app.background(func() {
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		err := app.runImport(imp, reader)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"import_id": strconv.FormatInt(imp.ID, 10)})
+		}
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/imports/%d", imp.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"import": started}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runImport() reads the upload to the end, importing it batch by batch. An upload
+// which can't be read to the end makes the import fail, but the batches read until then
+// stay imported. Only database errors are returned.
+func (app *application) runImport(imp *data.Import, reader importReader) error {
+	var batch []*data.Listing
+	var rowErrors []*data.ImportRowError
+	// The external references seen so far, with the row they were first seen in.
+	seen := make(map[string]int)
+
+	flush := func() error {
+		err := app.models.Transaction(func(tx data.Models) error {
+			var created, updated []*data.Listing
+			var sold []string
+			if len(batch) > 0 {
+				var err error
+				created, updated, sold, err = tx.Listings.Import(imp.UserID, batch)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Sold listings can't be changed, which makes their rows fail.
+			for _, ref := range sold {
+				rowErrors = append(rowErrors, &data.ImportRowError{
+					Row:         seen[ref],
+					ExternalRef: ref,
+					Errors:      map[string]string{"external_ref": "belongs to a listing which has been sold and can't be changed"},
+				})
+			}
+
+			for _, listing := range created {
+				err := tx.Events.Record(data.EventListingCreated, listing)
+				if err != nil {
+					return err
+				}
+			}
+			for _, listing := range updated {
+				err := tx.Events.Record(data.EventListingUpdated, listing)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := tx.Imports.InsertErrors(imp.ID, rowErrors)
+			if err != nil {
+				return err
+			}
+
+			imp.Inserted += len(created)
+			imp.Updated += len(updated)
+			imp.Unchanged += len(batch) - len(created) - len(updated) - len(sold)
+			imp.Failed += len(rowErrors)
+			return tx.Imports.UpdateProgress(imp)
+		})
+
+		batch, rowErrors = nil, nil
+		return err
+	}
+
+	for {
+		row, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			imp.Status = data.ImportCompleted
+			break
+		}
+		if err != nil {
+			imp.Status = data.ImportFailed
+			imp.Error = err.Error()
+			break
+		}
+
+		imp.Rows++
+
+		v := &validator.Validator{Errors: row.errors}
+
+		// A row which couldn't be parsed at all has no listing to validate.
+		var ref string
+		if _, unreadable := row.errors["row"]; !unreadable {
+			ref = *row.listing.ExternalRef
+			data.ValidateListing(v, row.listing)
+			data.ValidateExternalRef(v, ref)
+
+			if first, ok := seen[ref]; ok && ref != "" {
+				v.AddError("external_ref", fmt.Sprintf("must not repeat the one of row %d", first))
+			} else {
+				seen[ref] = row.number
+			}
+		}
+
+		if v.Valid() {
+			batch = append(batch, row.listing)
+		} else {
+			rowErrors = append(rowErrors, &data.ImportRowError{Row: row.number, ExternalRef: ref, Errors: v.Errors})
+		}
+
+		if len(batch)+len(rowErrors) >= importBatchSize {
+			err := flush()
+			if err != nil {
+				return app.failImport(imp, err)
+			}
+		}
+	}
+
+	err := flush()
+	if err != nil {
+		return app.failImport(imp, err)
+	}
+	return nil
+}
+
+// failImport() records that an import stopped because of a database error, and
+// returns the error.
+func (app *application) failImport(imp *data.Import, err error) error {
+	imp.Status = data.ImportFailed
+	imp.Error = "the server encountered a problem and could not finish the import"
+
+	updateErr := app.models.Imports.UpdateProgress(imp)
+	if updateErr != nil {
+		app.logger.PrintError(updateErr, nil)
+	}
+	return err
+}
+
+// Show the progress of an import, with a page of the rows which were rejected.
+func (app *application) getImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	imp, err := app.models.Imports.Select(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	rowErrors, metadata, err := app.models.Imports.SelectErrors(imp.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	imp.RowErrors = rowErrors
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": imp, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAllRows reads the rows of an upload up to io.EOF.
+func readAllRows(t *testing.T, ir importReader) []*importRow {
+	t.Helper()
+
+	var rows []*importRow
+	for {
+		row, err := ir.next()
+		if errors.Is(err, io.EOF) {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestCSVImportReaderHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"columns in order", "external_ref,title,description,price,categories\n", ""},
+		{"columns in any order and case", "Price, TITLE,categories,description,external_ref,extra\n", ""},
+		{"byte order mark", "\uFEFFexternal_ref,title,description,price,categories\n", ""},
+		{"empty", "", "body must not be empty"},
+		{"missing column", "external_ref,title,description,price\n", `body must have a "categories" column`},
+		{"bad CSV", "external_ref,\"title\n", "body must start with a header line"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCSVImportReader(strings.NewReader(tt.body))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+				t.Errorf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCSVImportReader(t *testing.T) {
+	body := "title,external_ref,description,price,categories\n" +
+		"Road bike,SKU-1,Barely used,15000,\"bikes, sport\"\n" +
+		"Lamp,SKU-2,,,\n" +
+		"Chair,SKU-3,Wobbly,cheap,furniture\n" +
+		"Too,few\n" +
+		"'=Sofa,SKU-4,'-50%,100,'+living\n"
+
+	ir, err := newCSVImportReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := readAllRows(t, ir)
+	if len(rows) != 5 {
+		t.Fatalf("got %d rows; want 5", len(rows))
+	}
+
+	for i, row := range rows {
+		if row.number != i+1 {
+			t.Errorf("row %d has number %d", i+1, row.number)
+		}
+	}
+
+	bike := rows[0]
+	if len(bike.errors) != 0 || *bike.listing.ExternalRef != "SKU-1" || bike.listing.Title != "Road bike" ||
+		bike.listing.Description != "Barely used" || bike.listing.Price != 15000 {
+		t.Errorf("got row 1 %+v, errors %v", bike.listing, bike.errors)
+	}
+	if got := bike.listing.Categories; len(got) != 2 || got[0] != "bikes" || got[1] != "sport" {
+		t.Errorf("got categories %q; want [bikes sport]", got)
+	}
+
+	lamp := rows[1]
+	if len(lamp.errors) != 0 || lamp.listing.Price != 0 || len(lamp.listing.Categories) != 0 {
+		t.Errorf("got row 2 %+v, errors %v; empty fields should stay empty", lamp.listing, lamp.errors)
+	}
+
+	if got := rows[2].errors["price"]; got != "must be an integer value" {
+		t.Errorf("got price error %q for row 3", got)
+	}
+	if got := rows[3].errors["row"]; got != "must have 5 fields" {
+		t.Errorf("got row error %q for row 4", got)
+	}
+
+	// Spreadsheet escaping is undone.
+	sofa := rows[4]
+	if sofa.listing.Title != "=Sofa" || sofa.listing.Description != "-50%" || len(sofa.listing.Categories) != 1 || sofa.listing.Categories[0] != "+living" {
+		t.Errorf("got row 5 %+v", sofa.listing)
+	}
+}
+
+func TestCSVImportReaderBadCSV(t *testing.T) {
+	body := "external_ref,title,description,price,categories\n" +
+		"SKU-1,Lamp,,100,\n" +
+		"SKU-2,\"Chair,,100,\n"
+
+	ir, err := newCSVImportReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ir.next(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ir.next()
+	if err == nil || !strings.HasPrefix(err.Error(), "body contains badly-formed CSV") {
+		t.Errorf("got error %v; want badly-formed CSV", err)
+	}
+}
+
+func TestNDJSONImportReader(t *testing.T) {
+	body := `{"external_ref":"SKU-1","title":"Road bike","description":"Barely used","price":15000,"categories":["bikes","sport"]}
+
+   {"external_ref":"SKU-2","title":"Lamp"}
+{"external_ref":"SKU-3","title":"Chair","price":"cheap"}
+{"external_ref":"SKU-4","colour":"red"}
+["SKU-5"]
+{"external_ref":"SKU-6"} {"external_ref":"SKU-7"}
+{"external_ref":"SKU-8"`
+
+	rows := readAllRows(t, newNDJSONImportReader(strings.NewReader(body)))
+	if len(rows) != 7 {
+		t.Fatalf("got %d rows; want 7", len(rows))
+	}
+
+	// Blank lines don't count as rows.
+	for i, row := range rows {
+		if row.number != i+1 {
+			t.Errorf("row %d has number %d", i+1, row.number)
+		}
+	}
+
+	bike := rows[0]
+	if len(bike.errors) != 0 || *bike.listing.ExternalRef != "SKU-1" || bike.listing.Title != "Road bike" ||
+		bike.listing.Price != 15000 || len(bike.listing.Categories) != 2 {
+		t.Errorf("got row 1 %+v, errors %v", bike.listing, bike.errors)
+	}
+	if len(rows[1].errors) != 0 || rows[1].listing.Title != "Lamp" {
+		t.Errorf("got row 2 %+v, errors %v", rows[1].listing, rows[1].errors)
+	}
+
+	// A value of the wrong type is reported against its field, and the rest is kept.
+	chair := rows[2]
+	if chair.errors["price"] != "has the wrong type" || chair.listing.Title != "Chair" {
+		t.Errorf("got row 3 %+v, errors %v", chair.listing, chair.errors)
+	}
+
+	for i, want := range map[int]string{
+		3: `contains unknown key "colour"`,
+		4: "must be a JSON object",
+		5: "must be a JSON object",
+		6: "must be a JSON object",
+	} {
+		if got := rows[i].errors["row"]; got != want {
+			t.Errorf("got row error %q for row %d; want %q", got, i+1, want)
+		}
+	}
+}
+
+func TestNDJSONImportReaderLongLine(t *testing.T) {
+	body := `{"title":"` + strings.Repeat("a", importMaxLine) + `"}` + "\n"
+
+	_, err := newNDJSONImportReader(strings.NewReader(body)).next()
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("got error %v; want a line too long", err)
+	}
+}
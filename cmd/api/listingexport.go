@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// How many rows are written between flushes. The write deadline is extended before
+	// each batch, so that an export can take longer than the server's WriteTimeout.
+	exportBatchSize = 500
+	// How long reading and writing one batch may take.
+	exportWriteTimeout = 30 * time.Second
+)
+
+// The formats listings can be exported in.
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+// The columns of a CSV export. They include those of a CSV import, so that an export
+// can be edited and imported again.
+var exportColumns = []string{
+	"id", "external_ref", "title", "description", "price", "categories",
+	"organization_id", "seller_id", "status", "created_at", "updated_at", "version",
+}
+
+// withListingExport() routes GET /v1/listings/export to the export, and every other
+// GET /v1/listings/:id to next, like withListingStream() does for the stream.
+func (app *application) withListingExport(next http.HandlerFunc) http.HandlerFunc {
+	export := app.requirePermission("listings:export", app.getListingExportHandler)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("id") == "export" {
+			export(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Export every listing which matches the same title, categories and sort parameters
+// as GET /v1/listings, as CSV (format=csv, the default) or NDJSON (format=ndjson). The
+// page and page_size parameters are ignored.
+//
+// The listings are written as they are read from the database, so the response is sent
+// with chunked encoding and has no Content-Length. Once it has started there is no way
+// to report an error but to break the connection off, so a client can only tell that
+// an export is complete from the response having ended properly.
+func (app *application) getListingExportHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+	format := app.readString(qs, "format", exportFormatCSV)
+	v.Check(validator.PermittedValue(format, exportFormatCSV, exportFormatNDJSON), "format", "must be csv or ndjson")
+	title, categories, filters := app.readListingFilters(qs, "id", 1, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var enc listingEncoder
+	filename := "listings-" + time.Now().UTC().Format("20060102T150405Z")
+	switch format {
+	case exportFormatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+		enc = &ndjsonListingEncoder{enc: json.NewEncoder(w)}
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		filename += ".csv"
+		enc = newCSVListingEncoder(w)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	// Exports are large and change with every listing, so caches should stay out of it.
+	w.Header().Set("Cache-Control", "no-store")
+
+	rc := http.NewResponseController(w)
+	extend := func() error {
+		err := rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+
+	err := extend()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The header goes out before the first listing is read, so that an export which
+	// is slow to start isn't mistaken for a server which doesn't answer.
+	w.WriteHeader(http.StatusOK)
+	err = enc.begin()
+	if err == nil {
+		err = enc.flush()
+	}
+	if err == nil {
+		err = rc.Flush()
+	}
+
+	count := 0
+	if err == nil {
+		err = app.models.Listings.Export(title, categories, app.viewerID(r), filters, func(listing *data.Listing) error {
+			err := enc.encode(listing)
+			if err != nil {
+				return err
+			}
+
+			count++
+			if count%exportBatchSize != 0 {
+				return nil
+			}
+			err = enc.flush()
+			if err != nil {
+				return err
+			}
+			err = rc.Flush()
+			if err != nil {
+				return err
+			}
+			return extend()
+		})
+	}
+	if err == nil {
+		err = enc.flush()
+	}
+	if err != nil {
+		// The client may simply have gone away, but as far as it can tell the export
+		// might be complete. Aborting the handler breaks the connection off without
+		// ending the chunked body, which tells it otherwise.
+		app.logger.PrintError(err, map[string]string{"rows": strconv.Itoa(count)})
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// A listingEncoder writes listings in one of the export formats.
+type listingEncoder interface {
+	// begin() writes what comes before the first listing.
+	begin() error
+	encode(listing *data.Listing) error
+	// flush() writes whatever the encoder holds on to.
+	flush() error
+}
+
+type csvListingEncoder struct {
+	out io.Writer
+	w   *csv.Writer
+}
+
+func newCSVListingEncoder(out io.Writer) *csvListingEncoder {
+	w := csv.NewWriter(out)
+	// Lines which end in CRLF are what spreadsheets write themselves.
+	w.UseCRLF = true
+	return &csvListingEncoder{out: out, w: w}
+}
+
+// begin() writes a byte order mark, without which spreadsheets take a CSV file for
+// ANSI rather than UTF-8, and the header line.
+func (e *csvListingEncoder) begin() error {
+	_, err := io.WriteString(e.out, "\uFEFF")
+	if err != nil {
+		return err
+	}
+	return e.w.Write(exportColumns)
+}
+
+func (e *csvListingEncoder) encode(listing *data.Listing) error {
+	var organizationID, sellerID, externalRef string
+	if listing.OrganizationID != nil {
+		organizationID = strconv.FormatInt(*listing.OrganizationID, 10)
+	}
+	if listing.SellerID != nil {
+		sellerID = strconv.FormatInt(*listing.SellerID, 10)
+	}
+	if listing.ExternalRef != nil {
+		externalRef = *listing.ExternalRef
+	}
+
+	return e.w.Write([]string{
+		strconv.FormatInt(listing.ID, 10),
+		// The reference is an identifier of the seller's, which has to come back
+		// unchanged on import.
+		externalRef,
+		spreadsheetSafe(listing.Title),
+		spreadsheetSafe(listing.Description),
+		strconv.FormatInt(listing.Price, 10),
+		spreadsheetSafe(strings.Join(listing.Categories, ",")),
+		organizationID,
+		sellerID,
+		listing.Status,
+		listing.CreatedAt.UTC().Format(time.RFC3339),
+		listing.UpdatedAt.UTC().Format(time.RFC3339),
+		strconv.Itoa(int(listing.Version)),
+	})
+}
+
+func (e *csvListingEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonListingEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonListingEncoder) begin() error {
+	return nil
+}
+
+// encode() writes the listing as one line, the same JSON object GET /v1/listings/:id
+// returns.
+func (e *ndjsonListingEncoder) encode(listing *data.Listing) error {
+	return e.enc.Encode(listing)
+}
+
+func (e *ndjsonListingEncoder) flush() error {
+	return nil
+}
+
+// spreadsheetSafe() keeps a user's text from being taken for a formula when the export
+// is opened in a spreadsheet, where a formula can run commands or send the sheet's
+// contents elsewhere. A cell which could start one is prefixed with an apostrophe,
+// which spreadsheets take to mean text.
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsRune(formulaStarts, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// spreadsheetUnsafe() undoes spreadsheetSafe(), so that an export can be imported
+// again without the apostrophes piling up. Text which really started with an
+// apostrophe followed by one of the characters that start a formula loses the
+// apostrophe.
+func spreadsheetUnsafe(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaStarts, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// The characters which make a spreadsheet take a cell for a formula.
+const formulaStarts = "=+-@\t\r"
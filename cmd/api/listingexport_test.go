@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"letsgofurther/internal/data"
+	"testing"
+	"time"
+)
+
+func TestSpreadsheetSafe(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"Road bike", "Road bike"},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+49 30 123456", "'+49 30 123456"},
+		{"-5% off", "'-5% off"},
+		{"@SUM(A1:A2)", "'@SUM(A1:A2)"},
+		{"\tindented", "'\tindented"},
+		{"\rreturn", "'\rreturn"},
+		{"a=b", "a=b"},
+		{"'quoted'", "'quoted'"},
+	}
+
+	for _, tt := range tests {
+		got := spreadsheetSafe(tt.in)
+		if got != tt.want {
+			t.Errorf("spreadsheetSafe(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		if back := spreadsheetUnsafe(got); back != tt.in {
+			t.Errorf("spreadsheetUnsafe(%q) = %q; want %q", got, back, tt.in)
+		}
+	}
+}
+
+func TestCSVExportImportRoundTrip(t *testing.T) {
+	sellerID := int64(7)
+	ref := "=SKU-1"
+	listing := &data.Listing{
+		ID:          42,
+		ExternalRef: &ref,
+		Title:       "=cmd|' /C calc'!A0",
+		Description: "-10% for pickup",
+		Price:       1500,
+		Categories:  []string{"+bikes", "sport"},
+		SellerID:    &sellerID,
+		Status:      "active",
+		CreatedAt:   time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC),
+		UpdatedAt:   time.Date(2026, 10, 2, 9, 0, 0, 0, time.UTC),
+		Version:     1,
+	}
+
+	var buf bytes.Buffer
+	enc := newCSVListingEncoder(&buf)
+	if err := enc.begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.encode(listing); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The external reference is exported as it is.
+	if !bytes.Contains(buf.Bytes(), []byte(",=SKU-1,")) {
+		t.Errorf("external_ref was changed in the export: %s", buf.Bytes())
+	}
+
+	// The export, byte order mark and all, is imported as it is.
+	ir, err := newCSVImportReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := ir.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row.errors) != 0 {
+		t.Fatalf("got errors %v", row.errors)
+	}
+
+	got := row.listing
+	if *got.ExternalRef != ref || got.Title != listing.Title || got.Description != listing.Description || got.Price != listing.Price {
+		t.Errorf("got %q, %q, %q, %d; want %q, %q, %q, %d",
+			*got.ExternalRef, got.Title, got.Description, got.Price,
+			ref, listing.Title, listing.Description, listing.Price)
+	}
+	if len(got.Categories) != 2 || got.Categories[0] != "+bikes" || got.Categories[1] != "sport" {
+		t.Errorf("got categories %q; want [+bikes sport]", got.Categories)
+	}
+}
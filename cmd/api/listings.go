@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"letsgofurther/internal/data"
 	"letsgofurther/internal/validator"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 )
 
 /* GET */
@@ -28,6 +32,27 @@ func (app *application) getListingById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Users who blocked each other can't see each other's listings.
+	if lis.SellerID != nil {
+		blocked, err := app.blockedWith(r, *lis.SellerID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if blocked {
+			app.notFoundResponse(w, r)
+			return
+		}
+	}
+
+	// A client which has the current version of the listing cached is told so.
+	etag := listingETag(lis)
+	w.Header().Set("ETag", etag)
+	if app.notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"listing": lis}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -41,6 +66,8 @@ func (app *application) postListing(w http.ResponseWriter, r *http.Request) {
 		Description string   `json:"description"`
 		Price       int64    `json:"price"`
 		Categories  []string `json:"categories"`
+		// Optional, to create the listing on behalf of an organization.
+		OrganizationID *int64 `json:"organization_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -51,10 +78,12 @@ func (app *application) postListing(w http.ResponseWriter, r *http.Request) {
 
 	v := validator.New()
 	lis := &data.Listing{
-		Title:       input.Title,
-		Description: input.Description,
-		Price:       input.Price,
-		Categories:  input.Categories,
+		Title:          input.Title,
+		Description:    input.Description,
+		Price:          input.Price,
+		Categories:     input.Categories,
+		OrganizationID: input.OrganizationID,
+		SellerID:       &app.contextGetUser(r).ID,
 	}
 
 	data.ValidateListing(v, lis)
@@ -63,8 +92,28 @@ func (app *application) postListing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//save to db:
-	err = app.models.Listings.Insert(lis)
+	// Only editors of an organization may list things in its name.
+	if lis.OrganizationID != nil {
+		role, err := app.organizationRole(r, *lis.OrganizationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !role.AtLeast(data.OrganizationEditor) {
+			v.AddError("organization_id", "must be an organization you are an editor of")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	//save to db, together with the event telling subscribers about it:
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Listings.Insert(lis)
+		if err != nil {
+			return err
+		}
+		return tx.Events.Record(data.EventListingCreated, lis)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -75,6 +124,7 @@ func (app *application) postListing(w http.ResponseWriter, r *http.Request) {
 	// empty http.Header map and then use the Set() method to add a new Location header, // interpolating the system-generated ID for our new listing in the URL.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/listings/%d", lis.ID))
+	headers.Set("ETag", listingETag(lis))
 
 	// Write a JSON response with a 201 Created status code, the listing data in the // response body, and the Location header.
 	err = app.writeJSON(w, http.StatusCreated, envelope{"listing": lis}, headers)
@@ -103,13 +153,15 @@ func (app *application) patchListingById(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// If the request contains a X-Expected-Version header, verify that the listing
-	// version in the database matches the expected version specified in the header.
-	if r.Header.Get("X-Expected-Version") != "" {
-		if strconv.FormatInt(int64(listing.Version), 32) != r.Header.Get("X-Expected-Version") {
-			app.editConflictResponse(w, r)
-			return
-		}
+	if !app.authorizeListingChange(w, r, listing) {
+		return
+	}
+
+	// A client which sends the ETag it got for the listing in an If-Match header only
+	// changes it if nobody else did in the meantime.
+	if app.preconditionFailed(r, listingETag(listing)) {
+		app.preconditionFailedResponse(w, r)
+		return
 	}
 
 	var input struct {
@@ -147,9 +199,19 @@ func (app *application) patchListingById(w http.ResponseWriter, r *http.Request)
 	}
 
 	//save to db:
-	err = app.models.Listings.Update(listing)
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Listings.Update(listing)
+		if err != nil {
+			return err
+		}
+		return tx.Events.Record(data.EventListingUpdated, listing)
+	})
 	if err != nil {
 		switch {
+		// The listing changed after it was read. For a client which sent If-Match,
+		// that means its precondition failed after all.
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -158,10 +220,59 @@ func (app *application) patchListingById(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"listing": listing}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", listingETag(listing))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"listing": listing}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeListingChange() checks that the user in the request context may change or
+// delete the listing, and sends the appropriate error response if not. A listing can be
+// changed by moderators, and otherwise by its seller or, if it belongs to an
+// organization, by the organization's editors, managers and owners. Listings from
+// before sellers were recorded can only be changed by moderators.
+func (app *application) authorizeListingChange(w http.ResponseWriter, r *http.Request, listing *data.Listing) bool {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return false
+	}
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return false
+	}
+
+	permissions, err := app.contextGetPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if permissions.Include("listings:moderate") && app.apiKeyAllows(r, "listings:moderate") {
+		return true
+	}
+
+	if listing.OrganizationID == nil {
+		if listing.SellerID == nil || *listing.SellerID != user.ID || !app.apiKeyAllows(r, "listings:write") {
+			app.notPermittedResponse(w, r)
+			return false
+		}
+		return true
+	}
+
+	role, err := app.organizationRole(r, *listing.OrganizationID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !role.AtLeast(data.OrganizationEditor) || !app.apiKeyAllows(r, "listings:write") {
+		app.notPermittedResponse(w, r)
+		return false
 	}
+
+	return true
 }
 
 /* DELETE */
@@ -172,9 +283,39 @@ func (app *application) deleteListingById(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Listings.Delete(id)
+	listing, err := app.models.Listings.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.authorizeListingChange(w, r, listing) {
+		return
+	}
+
+	if app.preconditionFailed(r, listingETag(listing)) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Listings.Delete(id, listing.Version)
+		if err != nil {
+			return err
+		}
+		return tx.Events.Record(data.EventListingDeleted, map[string]int64{"id": id})
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		case errors.Is(err, data.ErrNotFoundRecord):
 			app.notFoundResponse(w, r)
 		default:
@@ -190,37 +331,25 @@ func (app *application) deleteListingById(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) getAllListings(w http.ResponseWriter, r *http.Request) {
-	// To keep things consistent with our other handlers, we'll define an input struct
-	// to hold the expected values from the request query string.
-	var input struct {
-		Title      string
-		Categories []string
-		data.Filters
-	}
-
 	v := validator.New()
 
-	qs := r.URL.Query()
-
-	input.Title = app.readString(qs, "title", "")
-	input.Categories = app.readCSV(qs, "categories", []string{})
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 12, v)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{
-		"id", "created_at", "price", "title",
-		"-id", "-created_at", "-price", "-title",
-	}
-
-	data.ValidateFilters(v, input.Filters)
+	title, categories, filters := app.readListingFilters(r.URL.Query(), "id", 12, v)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	listings, metadata, err := app.models.Listings.SelectAll(input.Title, input.Categories, input.Filters)
+	listings, metadata, err := app.models.Listings.SelectAll(title, categories, app.viewerID(r), filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	etag := listingsETag(listings, metadata)
+	w.Header().Set("ETag", etag)
+	if app.notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	err = app.writeJSON(w, http.StatusOK, envelope{"listings": listings, "metadata": metadata}, nil)
@@ -228,3 +357,41 @@ func (app *application) getAllListings(w http.ResponseWriter, r *http.Request) {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// readListingFilters() reads the title, categories, page, page_size and sort query
+// string parameters which lists of listings are filtered by, and validates them.
+func (app *application) readListingFilters(qs url.Values, defaultSort string, defaultPageSize int, v *validator.Validator) (string, []string, data.Filters) {
+	title := app.readString(qs, "title", "")
+	categories := app.readCSV(qs, "categories", []string{})
+
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", defaultPageSize, v),
+		Sort:     app.readString(qs, "sort", defaultSort),
+		SortSafelist: []string{
+			"id", "created_at", "price", "title",
+			"-id", "-created_at", "-price", "-title",
+		},
+	}
+
+	data.ValidateFilters(v, filters)
+	return title, categories, filters
+}
+
+// listingETag() returns the ETag of the listing, which is its version: every change to
+// a listing increments the version. The seller's rating, which changes without the
+// listing changing, isn't covered, so a cached listing may show an older rating.
+func listingETag(listing *data.Listing) string {
+	return `"` + strconv.FormatInt(int64(listing.Version), 10) + `"`
+}
+
+// listingsETag() returns the ETag of a page of listings, which changes whenever a
+// listing on it changes, or the page holds different listings.
+func listingsETag(listings []*data.Listing, metadata data.Metadata) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d\n", metadata.CurrentPage, metadata.TotalRecords)
+	for _, listing := range listings {
+		fmt.Fprintf(h, "%d %d\n", listing.ID, listing.Version)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// How often an idle stream gets a comment line, so that proxies don't close it
+	// and the client notices a dead connection.
+	streamHeartbeatInterval = 15 * time.Second
+	// How long writing one event to a stream may take. The server's WriteTimeout
+	// would end every stream after 30 seconds, so streams extend their own deadline
+	// before each write instead.
+	streamWriteTimeout = 10 * time.Second
+	// How many events a client which reconnects with Last-Event-ID can catch up on.
+	// A client which missed more is told to reload instead.
+	streamReplayLimit = 500
+	// How many events may wait for a slow client before it is disconnected. It
+	// catches up on what it missed when it reconnects.
+	streamBuffer = 64
+)
+
+// The events the listing stream carries.
+var listingStreamEvents = []string{data.EventListingCreated, data.EventListingUpdated, data.EventListingDeleted}
+
+// listingFeed fans the listing events out to the clients of GET /v1/listings/stream
+// on this instance. It hears about events through the notifications on
+// data.EventsChannel, which reach every instance.
+type listingFeed struct {
+	mu            sync.Mutex
+	subscribers   map[*feedSubscriber]struct{}
+	closed        bool
+	notifications chan int64
+}
+
+// A feedSubscriber is one client, with the same filters as GET /v1/listings.
+type feedSubscriber struct {
+	title      string
+	categories []string
+	viewerID   int64
+	events     chan *data.Event
+}
+
+func newListingFeed() *listingFeed {
+	return &listingFeed{
+		subscribers:   make(map[*feedSubscriber]struct{}),
+		notifications: make(chan int64, 1024),
+	}
+}
+
+// handleNotification() queues a listing event for the feed. It is called on the
+// listener's goroutine, so it must not block: if the feed is that far behind, the
+// event is dropped for the clients on this instance.
+func (f *listingFeed) handleNotification(payload string) {
+	id, eventType, ok := data.ParseEventNotification(payload)
+	if !ok || !validator.PermittedValue(eventType, listingStreamEvents...) {
+		return
+	}
+
+	select {
+	case f.notifications <- id:
+	default:
+	}
+}
+
+// subscribe() adds a client, returning nil once the server is shutting down.
+func (f *listingFeed) subscribe(title string, categories []string, viewerID int64) *feedSubscriber {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+
+	sub := &feedSubscriber{
+		title:      title,
+		categories: categories,
+		viewerID:   viewerID,
+		events:     make(chan *data.Event, streamBuffer),
+	}
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (f *listingFeed) unsubscribe(sub *feedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// close() ends every stream. It runs when the server starts shutting down, which
+// would otherwise wait for the streams until it gives up.
+func (f *listingFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (f *listingFeed) snapshot() []*feedSubscriber {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subs := make([]*feedSubscriber, 0, len(f.subscribers))
+	for sub := range f.subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// runListingFeed() loads every event the feed hears about and sends it to the
+// clients it matches, until the server shuts down.
+func (app *application) runListingFeed() {
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case id := <-app.listingFeed.notifications:
+			subs := app.listingFeed.snapshot()
+			if len(subs) == 0 {
+				continue
+			}
+
+			event, err := app.models.Events.Select(id)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"event_id": strconv.FormatInt(id, 10)})
+				continue
+			}
+
+			matching, err := app.matchListingEvent(event, subs)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+
+			app.listingFeed.mu.Lock()
+			for _, sub := range matching {
+				if _, ok := app.listingFeed.subscribers[sub]; !ok {
+					continue
+				}
+				select {
+				case sub.events <- event:
+				default:
+					// The client can't keep up; it catches up when it reconnects.
+					delete(app.listingFeed.subscribers, sub)
+					close(sub.events)
+				}
+			}
+			app.listingFeed.mu.Unlock()
+		}
+	}
+}
+
+// matchListingEvent() returns the subscribers whose filters the event matches, in the
+// way GET /v1/listings would have listed it. Deletions only carry the listing's ID, so
+// they go to everyone.
+func (app *application) matchListingEvent(event *data.Event, subs []*feedSubscriber) ([]*feedSubscriber, error) {
+	if event.Type == data.EventListingDeleted {
+		return subs, nil
+	}
+
+	var listing data.Listing
+	err := json.Unmarshal(event.Data, &listing)
+	if err != nil {
+		return nil, err
+	}
+
+	var titles []string
+	var viewerIDs []int64
+	for _, sub := range subs {
+		titles = append(titles, sub.title)
+		if sub.viewerID != 0 {
+			viewerIDs = append(viewerIDs, sub.viewerID)
+		}
+	}
+
+	matchingTitles, err := app.models.Listings.MatchTitle(listing.Title, titles)
+	if err != nil {
+		return nil, err
+	}
+
+	var visible map[int64]bool
+	if listing.SellerID != nil && len(viewerIDs) > 0 {
+		visible, err = app.models.Listings.VisibleTo(*listing.SellerID, viewerIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var matching []*feedSubscriber
+	for _, sub := range subs {
+		if !matchingTitles[sub.title] || !hasAllCategories(listing.Categories, sub.categories) {
+			continue
+		}
+		if visible != nil && sub.viewerID != 0 && !visible[sub.viewerID] {
+			continue
+		}
+		matching = append(matching, sub)
+	}
+	return matching, nil
+}
+
+func hasAllCategories(categories, wanted []string) bool {
+	have := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		have[c] = true
+	}
+	for _, c := range wanted {
+		if !have[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// withListingStream() routes GET /v1/listings/stream to the stream, and every other
+// GET /v1/listings/:id to next. httprouter doesn't allow a fixed path segment next to
+// a parameter, so the stream can't have a route of its own.
+func (app *application) withListingStream(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("id") == "stream" {
+			app.getListingStreamHandler(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Stream listing events as Server-Sent Events, filtered by the same title and
+// categories parameters as GET /v1/listings. Each event's ID is that of the domain
+// event, so a client reconnecting with Last-Event-ID gets what it missed first. A
+// client which missed too much gets a "reset" event, after which it should reload the
+// listings.
+func (app *application) getListingStreamHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+	title := app.readString(qs, "title", "")
+	categories := app.readCSV(qs, "categories", []string{})
+
+	var lastEventID int64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		v.Check(err == nil && id >= 0, "Last-Event-ID", "must be a non-negative integer")
+		lastEventID = id
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	sub := app.listingFeed.subscribe(title, categories, app.viewerID(r))
+	if sub == nil {
+		app.errorResponse(w, r, http.StatusServiceUnavailable, "the server is shutting down")
+		return
+	}
+	defer app.listingFeed.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx and similar proxies not to buffer the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+
+	write := func(chunk []byte) error {
+		// Without support for deadlines, the stream ends at the server's WriteTimeout
+		// and the client reconnects.
+		err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	// Ask clients to wait a few seconds before reconnecting.
+	err := write([]byte("retry: 5000\n\n"))
+	if err != nil {
+		return
+	}
+
+	// Events which arrive while catching up are already queued on sub.events; the
+	// ones sent while catching up are skipped there.
+	replayed := make(map[int64]bool)
+	if lastEventID > 0 {
+		events, err := app.models.Events.SelectSince(lastEventID, listingStreamEvents, streamReplayLimit+1)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		if len(events) > streamReplayLimit {
+			if write([]byte("event: reset\ndata: {}\n\n")) != nil {
+				return
+			}
+		} else {
+			events, err := app.matchReplayedEvents(events, sub)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return
+			}
+			for _, event := range events {
+				if write(formatStreamEvent(event)) != nil {
+					return
+				}
+				replayed[event.ID] = true
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if write([]byte(": heartbeat\n\n")) != nil {
+				return
+			}
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if replayed[event.ID] {
+				continue
+			}
+			if write(formatStreamEvent(event)) != nil {
+				return
+			}
+		}
+	}
+}
+
+// matchReplayedEvents() keeps the events which match the subscriber's filters.
+func (app *application) matchReplayedEvents(events []*data.Event, sub *feedSubscriber) ([]*data.Event, error) {
+	var matching []*data.Event
+	for _, event := range events {
+		subs, err := app.matchListingEvent(event, []*feedSubscriber{sub})
+		if err != nil {
+			return nil, err
+		}
+		if len(subs) > 0 {
+			matching = append(matching, event)
+		}
+	}
+	return matching, nil
+}
+
+// formatStreamEvent() encodes the event in the text/event-stream format. The data is
+// compacted onto one line, since a line break would end the data field.
+func formatStreamEvent(event *data.Event) []byte {
+	var js bytes.Buffer
+	if json.Compact(&js, event.Data) != nil {
+		js.Reset()
+		js.WriteString("{}")
+	}
+
+	return []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, js.Bytes()))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"letsgofurther/internal/data"
+	"net/http"
+	"net/netip"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// List every account and address which is currently locked out or has recently
+// failed to log in, so that administrators can spot attacks and help locked out users.
+func (app *application) getAllLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	throttles, err := app.models.LoginThrottles.SelectActive(accountThrottlePolicy.Window)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockouts": throttles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Lift the lockout on a user's account.
+func (app *application) deleteUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.resetLockout(w, r, data.EmailThrottleSubject(user.Email))
+}
+
+// Lift the lockout on a client address.
+func (app *application) deleteIPLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	addr, err := netip.ParseAddr(params.ByName("ip"))
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	app.resetLockout(w, r, data.IPThrottleSubject(addr.String()))
+}
+
+func (app *application) resetLockout(w http.ResponseWriter, r *http.Request, subject string) {
+	found, err := app.models.LoginThrottles.Reset(subject)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !found {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "lockout successfully lifted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
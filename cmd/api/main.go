@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"expvar"
 	"flag"
@@ -9,7 +10,10 @@ import (
 	"letsgofurther/internal/data"
 	"letsgofurther/internal/jsonlog"
 	"letsgofurther/internal/mailer"
+	"letsgofurther/internal/oidc"
+	"letsgofurther/internal/pubsub"
 	"letsgofurther/internal/vcs"
+	"net/netip"
 	"os"
 	"runtime"
 	"sync"
@@ -23,7 +27,9 @@ var version = vcs.Version()
 type config struct {
 	port int
 	env  string
-	db   struct {
+	// The public URL of the API, used to build links in emails.
+	baseURL string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
@@ -34,13 +40,49 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	mailer struct {
+		// Which Sender delivers emails: smtp, file or memory.
+		backend string
+		from    string
+		// The maildir the file backend writes to.
+		dir string
+		// Shared with the mail provider's bounce and complaint webhook.
+		webhookSecret string
+	}
+	outbox struct {
+		workers     int
+		maxAttempts int
+	}
+	webhooks struct {
+		workers     int
+		maxAttempts int
+	}
+	events struct {
+		workers     int
+		maxAttempts int
+	}
 	smtp struct {
 		host     string
 		port     int
 		username string
 		password string
-		sender   string
 	}
+	oidc struct {
+		providers []oidc.Config
+	}
+	idempotency struct {
+		// Keys the hashes of the requests stored with their Idempotency-Key, which
+		// would otherwise give away what was in them, like the passwords signed up with.
+		secret string
+	}
+	authCache struct {
+		ttl        time.Duration
+		maxEntries int
+		enabled    bool
+	}
+	// The reverse proxies in front of the API, whose X-Forwarded-For headers are
+	// believed. Requests from anywhere else are taken to come from their peer address.
+	trustedProxies []netip.Prefix
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
@@ -50,8 +92,20 @@ type application struct {
 	config config
 	logger *jsonlog.Logger
 	models data.Models
+	// Fans the domain events recorded by the models out to the subscribers.
+	events *data.EventBus
+	// The clients of the listing stream on this instance.
+	listingFeed *listingFeed
+	// The chat connections on this instance.
+	chat   *chatHub
 	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	oidc   map[string]*oidc.Provider
+	// Used to make failed logins for unknown email addresses take as long as ones
+	// for existing accounts.
+	passwordTimer *passwordTimer
+	wg            sync.WaitGroup
+	// Closed when the server starts shutting down, to stop long-running workers.
+	shutdown chan struct{}
 }
 
 func main() {
@@ -59,6 +113,7 @@ func main() {
 
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:4000", "Public base URL of the API")
 
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 50, "PostgreSQL max open connections")
@@ -69,13 +124,60 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
-	// Read the SMTP server configuration settings into the config struct, using the
-	// Mailtrap settings as the default values.
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	// Emails are sent over SMTP with the credentials given on the command line; none are
+	// baked in here. During development, `make run` picks -mailer=file instead, which
+	// writes them to a local maildir, so nothing is sent by accident.
+	flag.StringVar(&cfg.mailer.backend, "mailer", "smtp", "Mailer backend (smtp|file|memory)")
+	flag.StringVar(&cfg.mailer.from, "mailer-from", "Diggo <info@diggo.com>", "Mailer sender address")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Maildir for the file mailer backend")
+	flag.StringVar(&cfg.mailer.webhookSecret, "email-webhook-secret", "", "Secret for the bounce and complaint webhook (disabled if empty)")
+
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of email outbox workers")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Attempts at sending an email before it is dead-lettered")
+
+	flag.IntVar(&cfg.webhooks.workers, "webhook-workers", 2, "Number of webhook delivery workers")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 10, "Attempts at a webhook delivery before it fails")
+
+	flag.IntVar(&cfg.events.workers, "event-dispatchers", 1, "Number of domain event dispatchers")
+	flag.IntVar(&cfg.events.maxAttempts, "event-max-attempts", 10, "Attempts at dispatching a domain event before it is dead-lettered")
+
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "761e97a692969c", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "c2228263d7ad0c", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Diggo <info@diggo.com>", "SMTP sender")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+
+	flag.StringVar(&cfg.idempotency.secret, "idempotency-secret", "", "Secret for hashing idempotent requests (random for each run if empty)")
+
+	flag.DurationVar(&cfg.authCache.ttl, "auth-cache-ttl", 30*time.Second, "Authorization cache entry lifetime")
+	flag.IntVar(&cfg.authCache.maxEntries, "auth-cache-max-entries", 10000, "Authorization cache maximum entries")
+	flag.BoolVar(&cfg.authCache.enabled, "auth-cache-enabled", true, "Enable authorization cache")
+
+	// Each -oidc-provider flag registers one OpenID Connect provider for social login,
+	// e.g. -oidc-provider="name=google,issuer=https://accounts.google.com,client-id=...,
+	// client-secret=...,redirect-url=https://diggo.de/login/google".
+	flag.Func("oidc-provider", "OpenID Connect provider (repeatable)", func(s string) error {
+		provider, err := oidc.ParseConfig(s)
+		if err != nil {
+			return err
+		}
+		cfg.oidc.providers = append(cfg.oidc.providers, provider)
+		return nil
+	})
+
+	// Each -trusted-proxy flag names a proxy address or CIDR range, e.g.
+	// -trusted-proxy=10.0.0.0/8.
+	flag.Func("trusted-proxy", "Reverse proxy address or CIDR range whose X-Forwarded-For is trusted (repeatable)", func(s string) error {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, prefix.Masked())
+		return nil
+	})
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -89,6 +191,18 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	// Without a secret of its own, an instance can't recognise the retries of requests
+	// which other instances, or itself before a restart, took first.
+	if cfg.idempotency.secret == "" {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		cfg.idempotency.secret = string(secret)
+		logger.PrintInfo("no idempotency secret set, using a random one", nil)
+	}
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
@@ -112,15 +226,121 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	// Other instances tell us about changes through Postgres, on a connection of its
+	// own.
+	listener := pubsub.NewListener(cfg.db.dsn, func(err error) {
+		logger.PrintError(err, nil)
+	})
+	defer listener.Close()
+
+	models := data.NewModels(db)
+	if cfg.authCache.enabled {
+		cache := data.NewAuthCache(db, cfg.authCache.ttl, cfg.authCache.maxEntries)
+		cache.ErrorLog = func(err error) {
+			logger.PrintError(err, nil)
+		}
+		models = data.NewCachedModels(db, cache)
+
+		// If the listening connection drops, we may have missed some invalidations, so
+		// start over with an empty cache.
+		err = listener.Subscribe(data.AuthCacheChannel, cache.HandleNotification)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		listener.OnReconnect(cache.Flush)
+
+		// Publish the cache hit and miss counts.
+		expvar.Publish("auth_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+	}
+
+	// Recording a domain event wakes the dispatchers, on whichever instance, and
+	// reaches the clients of the listing stream on every instance.
+	events := data.NewEventBus()
+	feed := newListingFeed()
+	err = listener.Subscribe(data.EventsChannel, func(payload string) {
+		events.Wake()
+		feed.handleNotification(payload)
+	})
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	listener.OnReconnect(events.Wake)
+
+	// Chat messages, typing indicators and presence reach the users on every instance.
+	chat, err := newChatHub()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	err = listener.Subscribe(data.ChatChannel, chat.handleNotification)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	go listener.Run(context.Background())
+
+	sender, err := newMailSender(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	logger.PrintInfo("mailer backend selected", map[string]string{"backend": cfg.mailer.backend})
+
+	// Parse the email templates now, so that a broken one stops us from starting.
+	mail, err := mailer.New(sender, cfg.mailer.from)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	timer, err := newPasswordTimer()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:        cfg,
+		logger:        logger,
+		models:        models,
+		events:        events,
+		listingFeed:   feed,
+		chat:          chat,
+		mailer:        mail.WithSuppressionList(models.EmailSuppressions),
+		oidc:          make(map[string]*oidc.Provider),
+		passwordTimer: timer,
+		shutdown:      make(chan struct{}),
+	}
+
+	err = app.checkNotificationTemplates()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	for _, provider := range cfg.oidc.providers {
+		app.oidc[provider.Name] = oidc.NewProvider(provider)
 	}
 
+	app.startEmailOutbox()
+	expvar.Publish("email_outbox", expvar.Func(func() any {
+		depth, err := app.models.EmailOutbox.Depth()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil
+		}
+		return depth
+	}))
+
+	app.subscribeEvents()
+	app.startEventDispatchers()
+	app.startWebhookDeliveries()
+	go app.runListingFeed()
+	go app.runChatHub()
+
+	// Accounts whose deletion grace period is over are deleted for good.
+	go app.purgeDeletedAccounts(time.Hour)
+	go app.purgeIdempotencyKeys(time.Hour)
+
 	// Call app.serve() to start the server.
 	err = app.serve()
 	if err != nil {
@@ -167,3 +387,17 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool.
 	return db, nil
 }
+
+// newMailSender() returns the mailer.Sender selected by the -mailer flag.
+func newMailSender(cfg config) (mailer.Sender, error) {
+	switch cfg.mailer.backend {
+	case "smtp":
+		return mailer.NewSMTPSender(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileSender(cfg.mailer.dir)
+	case "memory":
+		return mailer.NewMemorySender(), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", cfg.mailer.backend)
+	}
+}
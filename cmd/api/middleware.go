@@ -24,6 +24,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			// Use the builtin recover function to check if there has been a panic or
 			// not.
 			if err := recover(); err != nil {
+				// A handler which has already sent part of its response aborts with
+				// http.ErrAbortHandler to break the connection off. That is left to the
+				// server, since an error response can't follow.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
 				// If there was a panic, set a "Connection: close" header on the
 				// response. This acts as a trigger to make Go's HTTP server
 				// automatically close the current connection after a response has been
@@ -135,6 +141,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// using the invalidAuthenticationTokenResponse() helper (which we will create
 		// in a moment).
 		headerParts := strings.Split(authorizationHeader, " ")
+
+		// Partner integrations authenticate with a long-lived API key in the format
+		// "ApiKey <key>" instead. On success both the owning user and the key itself
+		// are added to the request context.
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			user, key, err := app.userForAPIKey(r, headerParts[1])
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrNotFoundRecord):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetAPIKey(r, key)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -178,6 +206,39 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// userForAPIKey() checks a plaintext API key and returns the key along with its owner.
+// Unknown, mismatched, expired keys and requests from addresses outside the key's
+// allowlist all result in ErrNotFoundRecord, so that the client can't tell which check
+// failed.
+func (app *application) userForAPIKey(r *http.Request, plaintext string) (*data.User, *data.APIKey, error) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		return nil, nil, data.ErrNotFoundRecord
+	}
+
+	key, err := app.models.APIKeys.SelectByPrefix(data.APIKeyPrefix(plaintext))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip := app.clientIP(r)
+	if !key.Matches(plaintext) || key.Expired() || !key.AllowsIP(ip) {
+		return nil, nil, data.ErrNotFoundRecord
+	}
+
+	user, err := app.models.Users.Select(key.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = app.models.APIKeys.Touch(key.ID, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, key, nil
+}
+
 // Create a new requireAuthenticatedUser() middleware to check that a user is not
 // anonymous.
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
@@ -193,8 +254,26 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	})
 }
 
-// Checks that a user is both authenticated and activated.
+// Checks that a user is both authenticated and activated. API keys are limited to the
+// permissions they were created with, and routes which don't name a permission aren't
+// covered by any of them, so requests made with an API key are turned away.
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivated(fn)
+}
+
+// requireActivated() checks that a user is both authenticated and activated, whatever
+// they authenticated with. Routes which let API keys through must check the key's
+// permissions themselves.
+func (app *application) requireActivated(next http.HandlerFunc) http.HandlerFunc {
 	// Rather than returning this http.HandlerFunc we assign it to the variable fn.
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -212,15 +291,48 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// Account management endpoints (API keys, two-factor settings, ...) must not be
+// reachable with an API key, otherwise a leaked key could be used to mint more keys or
+// take over the account. requireBearerToken() only lets activated users through who
+// authenticated with a regular authentication token. It checks for an API key itself,
+// rather than relying on requireActivatedUser() to turn them away, so that these routes
+// stay closed to API keys whatever other routes let them through.
+func (app *application) requireBearerToken(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivated(fn)
+}
+
+// requireScope() lets activated users through, and requests made with an API key only
+// if the key carries the permission. Unlike requirePermission(), it doesn't ask for the
+// user to hold the permission: it is for routes every user may use, which API keys
+// should only reach when they were meant to.
+func (app *application) requireScope(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !app.apiKeyAllows(r, code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivated(fn)
+}
+
 // Note that the first parameter for the middleware function is the permission code that
 // we require the user to have.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
-
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.SelectAllForUser(user.ID)
+		// Get the slice of permissions for the user in the request context.
+		permissions, err := app.contextGetPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -231,12 +343,25 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			app.notPermittedResponse(w, r)
 			return
 		}
+		// Requests made with an API key are further limited to the subset of
+		// permissions the key was created with.
+		if !app.apiKeyAllows(r, code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
 		// Otherwise they have the required permission so we call the next handler in
 		// the chain.
 		next.ServeHTTP(w, r)
 	}
-	// Wrap this with the requireActivatedUser() middleware before returning it.
-	return app.requireActivatedUser(fn)
+	// Wrap this with the requireActivated() middleware before returning it.
+	return app.requireActivated(fn)
+}
+
+// apiKeyAllows() reports whether the API key the request was authenticated with, if
+// any, carries the given permission.
+func (app *application) apiKeyAllows(r *http.Request, code string) bool {
+	key := app.contextGetAPIKey(r)
+	return key == nil || key.Permissions.Include(code)
 }
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
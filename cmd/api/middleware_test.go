@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/jsonlog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	activated := &data.User{ID: 1, Activated: true}
+
+	tests := []struct {
+		name       string
+		user       *data.User
+		apiKey     *data.APIKey
+		wantStatus int
+	}{
+		{"authentication token", activated, nil, http.StatusOK},
+		// Not even a key with every permission gets through.
+		{"API key", activated, &data.APIKey{UserID: 1, Permissions: data.Permissions{"*"}}, http.StatusForbidden},
+		{"anonymous", data.AnonymousUser, nil, http.StatusUnauthorized},
+		{"not activated", &data.User{ID: 2}, nil, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelInfo)}
+
+			ran := false
+			handler := app.requireBearerToken(func(w http.ResponseWriter, r *http.Request) {
+				ran = true
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me/api-keys", nil)
+			r = app.contextSetUser(r, tt.user)
+			if tt.apiKey != nil {
+				r = app.contextSetAPIKey(r, tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantStatus)
+			}
+			if ran != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("got the handler run %t", ran)
+			}
+		})
+	}
+}
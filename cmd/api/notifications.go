@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// notify() dispatches a notification to the user on the channels they chose for its
+// type. It is called after the action the notification is about has succeeded, so a
+// failure is only logged rather than failing the request.
+func (app *application) notify(userID int64, notificationType string, payload map[string]any) {
+	_, err := app.models.Notifications.Dispatch(userID, notificationType, payload)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"user_id": strconv.FormatInt(userID, 10),
+			"type":    notificationType,
+		})
+	}
+}
+
+// checkNotificationTemplates() makes sure there is an email template for every type of
+// notification, so that a missing one stops the server from starting.
+func (app *application) checkNotificationTemplates() error {
+	templates := make(map[string]bool)
+	for _, name := range app.mailer.Templates() {
+		templates[name] = true
+	}
+
+	for notificationType := range data.NotificationTypes {
+		if !templates[data.NotificationTemplate(notificationType)] {
+			return fmt.Errorf("no email template %s for notifications of type %s", data.NotificationTemplate(notificationType), notificationType)
+		}
+	}
+	return nil
+}
+
+// The user's inbox, newest first, with the number of unread notifications. With
+// ?unread=true only the unread ones are listed.
+func (app *application) getAllNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+
+	unread := app.readString(r.URL.Query(), "unread", "false")
+	v.Check(validator.PermittedValue(unread, "true", "false"), "unread", "must be true or false")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	notifications, metadata, err := app.models.Notifications.SelectAllForUser(user.ID, unread == "true", filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	unreadCount, err := app.models.Notifications.CountUnread(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"notifications": notifications, "unread_count": unreadCount, "metadata": metadata}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Mark notifications as read: the ones listed in "ids", or all of them with
+// {"all": true}.
+func (app *application) putNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+		All bool    `json:"all"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.All != (len(input.IDs) > 0), "ids", "must be provided, unless all is true")
+	v.Check(len(input.IDs) <= 100, "ids", "must not contain more than 100 entries")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	marked, err := app.models.Notifications.MarkRead(user.ID, input.IDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	unreadCount, err := app.models.Notifications.CountUnread(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"marked": marked, "unread_count": unreadCount}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The channels the user gets each type of notification on.
+func (app *application) getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	preferences, err := app.models.Notifications.SelectPreferences(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": preferences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Choose the channels for the notification type named by the ":type" URL parameter.
+// Channels left out of the request body keep their current setting.
+func (app *application) putNotificationPreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	notificationType := httprouter.ParamsFromContext(r.Context()).ByName("type")
+
+	v := validator.New()
+	if data.ValidateNotificationType(v, notificationType); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Email *bool `json:"email"`
+		InApp *bool `json:"in_app"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	preferences, err := app.models.Notifications.SelectPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var preference *data.NotificationPreference
+	for _, p := range preferences {
+		if p.Type == notificationType {
+			preference = p
+		}
+	}
+
+	if input.Email != nil {
+		preference.Email = *input.Email
+	}
+	if input.InApp != nil {
+		preference.InApp = *input.InApp
+	}
+
+	err = app.models.Notifications.UpsertPreference(user.ID, preference)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preference": preference}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
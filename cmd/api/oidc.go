@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/oidc"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long a user has to complete the login at the provider.
+const oidcAuthRequestTTL = 10 * time.Minute
+
+// Look up the provider named in the ":provider" URL parameter.
+func (app *application) readOIDCProviderParam(r *http.Request) (*oidc.Provider, bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	provider, ok := app.oidc[params.ByName("provider")]
+	return provider, ok
+}
+
+// Start a social login. The response contains the provider URL to send the user's
+// browser to. The state, nonce and PKCE code verifier generated for this login are
+// kept in the database until the callback.
+func (app *application) getOIDCAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readOIDCProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	ar, err := oidc.NewAuthRequest()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertAuthRequest(&data.OIDCAuthRequest{
+		Provider:     provider.Name,
+		State:        ar.State,
+		Nonce:        ar.Nonce,
+		CodeVerifier: ar.CodeVerifier,
+		Expiry:       time.Now().Add(oidcAuthRequestTTL),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), ar)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Clear out logins which were started but never finished.
+	app.background(func() {
+		err := app.models.Identities.DeleteExpiredAuthRequests()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authorization_url": authURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Finish a social login. The frontend forwards the code and state query parameters it
+// was redirected back with. We exchange the code for an ID token, then log in the user
+// linked to the provider account, linking or creating one first if necessary.
+func (app *application) postOIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.readOIDCProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(len(input.Code) <= 2048, "code", "must not be more than 2048 bytes long")
+	v.Check(input.State != "", "state", "must be provided")
+	v.Check(len(input.State) <= 256, "state", "must not be more than 256 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ar, err := app.models.Identities.ConsumeAuthRequest(provider.Name, input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), input.Code, &oidc.AuthRequest{
+		State:        ar.State,
+		Nonce:        ar.Nonce,
+		CodeVerifier: ar.CodeVerifier,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchange), errors.Is(err, oidc.ErrInvalidToken):
+			app.logError(r, err)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForOIDCClaims(provider.Name, claims, app.readLocale(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			v.AddError("email", "the provider has not verified your email address")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.authenticationTokenResponse(w, r, user)
+}
+
+var errUnverifiedEmail = errors.New("unverified email")
+
+// userForOIDCClaims() returns the user linked to the provider account. A provider
+// account seen for the first time is linked to the existing user with the same email
+// address, or to a newly created, already activated user. Either way the email address
+// must have been verified by the provider, otherwise anyone could register an
+// unverified address at the provider and take over the matching account here. New
+// users get the given locale.
+func (app *application) userForOIDCClaims(providerName string, claims *oidc.Claims, locale string) (*data.User, error) {
+	user, err := app.models.Identities.SelectUser(providerName, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrNotFoundRecord) {
+		return nil, err
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, claims.Email); !v.Valid() || !bool(claims.EmailVerified) {
+		return nil, errUnverifiedEmail
+	}
+
+	// The user, their role and the link to the provider account are written in one
+	// unit of work, so no user is left without a role or a way to sign in.
+	err = app.models.Transaction(func(tx data.Models) error {
+		var err error
+		user, err = tx.Users.SelectByEmail(claims.Email)
+		switch {
+		case err == nil:
+			if !user.Activated {
+				err = app.claimUnactivatedUser(tx, user)
+			}
+		case errors.Is(err, data.ErrNotFoundRecord):
+			user, err = app.insertOIDCUser(tx, claims, locale)
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.Identities.Insert(&data.Identity{
+			Provider: providerName,
+			Subject:  claims.Subject,
+			UserID:   user.ID,
+			Email:    claims.Email,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// claimUnactivatedUser() activates an account on behalf of the verified owner of its
+// email address. Anybody can sign up with an address they don't own, and an account
+// stays unactivated until its address is proven, so whoever signed up may not be the
+// owner. The password, tokens and API keys they set up are all revoked, so that they
+// can't get into the account once it is activated.
+func (app *application) claimUnactivatedUser(tx data.Models, user *data.User) error {
+	err := user.Password.SetRandom()
+	if err != nil {
+		return err
+	}
+
+	user.Activated = true
+	err = tx.Users.Update(user)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopeTwoFactorPending, data.ScopeDataExport} {
+		err = tx.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.APIKeys.DeleteAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Events.Record(data.EventUserActivated, user)
+}
+
+func (app *application) insertOIDCUser(tx data.Models, claims *oidc.Claims, locale string) (*data.User, error) {
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if len(name) > 200 {
+		name = name[:200]
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+		Locale:    locale,
+	}
+
+	err := user.Password.SetRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// New users get the same role as those who sign up with a password.
+	err = tx.Roles.AddForUser(user.ID, data.DefaultRole)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user is registered and activated at once, and subscribers to either event
+	// hear of it.
+	err = tx.Events.Record(data.EventUserRegistered, user)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Events.Record(data.EventUserActivated, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
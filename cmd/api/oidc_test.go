@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/oidc"
+	"strings"
+	"testing"
+)
+
+// A fakeIdentityModel has the identities linked so far, by subject.
+type fakeIdentityModel struct {
+	data.IdentityModel
+	users  map[string]*data.User
+	linked []*data.Identity
+}
+
+func (m *fakeIdentityModel) SelectUser(provider, subject string) (*data.User, error) {
+	user, ok := m.users[subject]
+	if !ok {
+		return nil, data.ErrNotFoundRecord
+	}
+	return user, nil
+}
+
+func (m *fakeIdentityModel) Insert(identity *data.Identity) error {
+	m.linked = append(m.linked, identity)
+	return nil
+}
+
+// A fakeUserModel has the users registered with a password, by email address.
+type fakeUserModel struct {
+	data.UserModel
+	users    map[string]*data.User
+	inserted []*data.User
+	updated  []*data.User
+}
+
+func (m *fakeUserModel) SelectByEmail(email string) (*data.User, error) {
+	user, ok := m.users[email]
+	if !ok {
+		return nil, data.ErrNotFoundRecord
+	}
+	return user, nil
+}
+
+func (m *fakeUserModel) Insert(user *data.User) error {
+	user.ID = 100
+	m.inserted = append(m.inserted, user)
+	return nil
+}
+
+func (m *fakeUserModel) Update(user *data.User) error {
+	m.updated = append(m.updated, user)
+	return nil
+}
+
+type fakeRoleModel struct {
+	data.RoleModel
+	added []string
+}
+
+func (m *fakeRoleModel) AddForUser(userID int64, names ...string) error {
+	m.added = append(m.added, names...)
+	return nil
+}
+
+// A fakeTokenModel keeps the scopes of the tokens revoked.
+type fakeTokenModel struct {
+	data.TokenModel
+	revoked []string
+}
+
+func (m *fakeTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	m.revoked = append(m.revoked, scope)
+	return nil
+}
+
+type fakeAPIKeyModel struct {
+	data.APIKeyModel
+	revokedFor []int64
+}
+
+func (m *fakeAPIKeyModel) DeleteAllForUser(userID int64) error {
+	m.revokedFor = append(m.revokedFor, userID)
+	return nil
+}
+
+// A fakeEventModel keeps the types of the events recorded.
+type fakeEventModel struct {
+	data.EventModel
+	recorded []string
+}
+
+func (m *fakeEventModel) Record(eventType string, payload any) error {
+	m.recorded = append(m.recorded, eventType)
+	return nil
+}
+
+func TestUserForOIDCClaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   oidc.Claims
+		wantErr  error
+		wantUser int64
+		// Whether the provider account gets linked to the user.
+		wantLink bool
+		// Whether whoever set up the account is locked out of it.
+		wantRevoked bool
+		wantEvents  []string
+	}{
+		{
+			name:     "verified email of an activated user",
+			claims:   oidc.Claims{Subject: "sub-new", Email: "bob@example.com", EmailVerified: true},
+			wantUser: 2,
+			wantLink: true,
+		},
+		{
+			// Whoever signed up with the address may not own it, so the owner gets
+			// the account without what they set up.
+			name:        "verified email of an unactivated user",
+			claims:      oidc.Claims{Subject: "sub-new", Email: "alice@example.com", EmailVerified: true},
+			wantUser:    1,
+			wantLink:    true,
+			wantRevoked: true,
+			wantEvents:  []string{data.EventUserActivated},
+		},
+		{
+			name:       "new user",
+			claims:     oidc.Claims{Subject: "sub-new", Email: "carol@example.com", EmailVerified: true, Name: "Carol"},
+			wantUser:   100,
+			wantLink:   true,
+			wantEvents: []string{data.EventUserRegistered, data.EventUserActivated},
+		},
+		{
+			name:    "unverified email of an existing user",
+			claims:  oidc.Claims{Subject: "sub-new", Email: "alice@example.com", EmailVerified: false},
+			wantErr: errUnverifiedEmail,
+		},
+		{
+			name:    "no email",
+			claims:  oidc.Claims{Subject: "sub-new", EmailVerified: true},
+			wantErr: errUnverifiedEmail,
+		},
+		{
+			name:    "invalid email",
+			claims:  oidc.Claims{Subject: "sub-new", Email: "alice", EmailVerified: true},
+			wantErr: errUnverifiedEmail,
+		},
+		{
+			// The link was made when the address was verified, and the provider
+			// account stays linked to the user whatever its address says now.
+			name:     "linked account",
+			claims:   oidc.Claims{Subject: "sub-linked", Email: "mallory@example.com", EmailVerified: false},
+			wantUser: 2,
+		},
+	}
+
+	// The password somebody else signed up for alice@example.com with.
+	alicePassword := "pa55word-of-somebody-else"
+	alice := &data.User{ID: 1, Email: "alice@example.com", Activated: false}
+	err := alice.Password.Set(alicePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := *alice
+			bob := &data.User{ID: 2, Email: "bob@example.com", Activated: true}
+
+			identities := &fakeIdentityModel{users: map[string]*data.User{"sub-linked": bob}}
+			users := &fakeUserModel{users: map[string]*data.User{"alice@example.com": &alice, "bob@example.com": bob}}
+			roles := &fakeRoleModel{}
+			tokens := &fakeTokenModel{}
+			apiKeys := &fakeAPIKeyModel{}
+			events := &fakeEventModel{}
+			app := &application{models: data.Models{
+				Identities: identities,
+				Users:      users,
+				Roles:      roles,
+				Tokens:     tokens,
+				APIKeys:    apiKeys,
+				Events:     events,
+			}}
+
+			claims := tt.claims
+			user, err := app.userForOIDCClaims("mock", &claims, "en")
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(identities.linked) != 0 || len(users.inserted) != 0 || len(users.updated) != 0 || len(events.recorded) != 0 {
+					t.Errorf("got %d identities linked, %d users inserted, %d updated and %d events; want none",
+						len(identities.linked), len(users.inserted), len(users.updated), len(events.recorded))
+				}
+				return
+			}
+
+			if user.ID != tt.wantUser {
+				t.Errorf("got user %d; want %d", user.ID, tt.wantUser)
+			}
+			if !user.Activated {
+				t.Error("user isn't activated")
+			}
+			if linked := len(identities.linked) == 1; linked != tt.wantLink {
+				t.Errorf("got %d identities linked; want link %t", len(identities.linked), tt.wantLink)
+			}
+			if tt.wantLink && (identities.linked[0].UserID != tt.wantUser || identities.linked[0].Subject != claims.Subject) {
+				t.Errorf("got identity %+v", identities.linked[0])
+			}
+
+			if strings.Join(events.recorded, ",") != strings.Join(tt.wantEvents, ",") {
+				t.Errorf("got events %v; want %v", events.recorded, tt.wantEvents)
+			}
+
+			revoked := len(tokens.revoked) > 0 || len(apiKeys.revokedFor) > 0
+			if revoked != tt.wantRevoked {
+				t.Errorf("got tokens %v and API keys of %v revoked; want revoked %t", tokens.revoked, apiKeys.revokedFor, tt.wantRevoked)
+			}
+			if tt.wantRevoked {
+				if !containsString(tokens.revoked, data.ScopeAuthentication) {
+					t.Errorf("got tokens %v revoked; want the authentication tokens among them", tokens.revoked)
+				}
+				if matches, _ := user.Password.Matches(alicePassword); matches {
+					t.Error("the password set at sign-up still works")
+				}
+			}
+
+			if tt.wantUser == 100 {
+				if len(users.inserted) != 1 || users.inserted[0].Name != "Carol" || users.inserted[0].Locale != "en" {
+					t.Errorf("got users inserted %+v", users.inserted)
+				}
+				if len(roles.added) != 1 || roles.added[0] != data.DefaultRole {
+					t.Errorf("got roles %v; want %s", roles.added, data.DefaultRole)
+				}
+			}
+		})
+	}
+}
+
+func containsString(list []string, item string) bool {
+	for _, s := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long an invitation to join an organization stays valid.
+const organizationInvitationTTL = 7 * 24 * time.Hour
+
+// Look up the organization named by the ":id" URL parameter, sending a 404 Not Found
+// response if there isn't one.
+func (app *application) readOrganizationParam(w http.ResponseWriter, r *http.Request) (*data.Organization, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	org, err := app.models.Organizations.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return org, true
+}
+
+// organizationRole() returns the role of the user in the request context within the
+// organization, or the empty role if they aren't a member.
+func (app *application) organizationRole(r *http.Request, orgID int64) (data.OrganizationRole, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return "", nil
+	}
+
+	role, err := app.models.Organizations.SelectRole(orgID, user.ID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		return "", err
+	}
+	return role, nil
+}
+
+// requireOrganizationRole() sends a 403 Forbidden response and returns false unless the
+// user in the request context has at least the given role in the organization.
+func (app *application) requireOrganizationRole(w http.ResponseWriter, r *http.Request, orgID int64, min data.OrganizationRole) (data.OrganizationRole, bool) {
+	role, err := app.organizationRole(r, orgID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return "", false
+	}
+
+	if !role.AtLeast(min) {
+		app.notPermittedResponse(w, r)
+		return "", false
+	}
+
+	return role, true
+}
+
+func (app *application) postOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	org := &data.Organization{
+		Name:        input.Name,
+		Description: input.Description,
+	}
+
+	v := validator.New()
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Organizations.Insert(org, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/organizations/%d", org.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"organization": org}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The public profile of an organization.
+func (app *application) getOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"organization": org}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getAllOrganizationsForUserHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := app.models.Organizations.SelectAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organizations": orgs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) patchOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationManager); !ok {
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		org.Name = *input.Name
+	}
+	if input.Description != nil {
+		org.Description = *input.Description
+	}
+
+	v := validator.New()
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Organizations.Update(org)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organization": org}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationOwner); !ok {
+		return
+	}
+
+	err := app.models.Organizations.Delete(org.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "organization successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listings of an organization, with the same search, filtering and paging as
+// GET /v1/listings.
+func (app *application) getOrganizationListingsHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+
+	title, categories, filters := app.readListingFilters(r.URL.Query(), "id", 12, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	listings, metadata, err := app.models.Listings.SelectAllForOrganization(org.ID, title, categories, app.viewerID(r), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	etag := listingsETag(listings, metadata)
+	w.Header().Set("ETag", etag)
+	if app.notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"listings": listings, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Members can see who else is in the organization.
+func (app *application) getOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	if _, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationEditor); !ok {
+		return
+	}
+
+	members, err := app.models.Organizations.SelectMembers(org.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Read the ":user_id" URL parameter of the member routes.
+func (app *application) readMemberParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("user_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid user_id parameter")
+	}
+	return id, nil
+}
+
+// Change a member's role. Managers can hand out the editor and manager roles, but only
+// owners can make somebody else an owner or change another owner's role.
+func (app *application) putOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := app.readMemberParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	role, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationManager)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role data.OrganizationRole `json:"role"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateOrganizationRole(v, input.Role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	current, err := app.models.Organizations.SelectRole(org.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !role.AtLeast(input.Role) || !role.AtLeast(current) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.Organizations.SetMemberRole(org.ID, userID, input.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			v.AddError("role", "the organization must keep at least one owner")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "member role successfully updated"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Remove a member. Anyone can leave an organization themselves; removing somebody else
+// takes a manager, and removing an owner takes an owner.
+func (app *application) deleteOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := app.readMemberParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if userID != app.contextGetUser(r).ID {
+		role, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationManager)
+		if !ok {
+			return
+		}
+
+		current, err := app.models.Organizations.SelectRole(org.ID, userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotFoundRecord):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !role.AtLeast(current) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	err = app.models.Organizations.RemoveMember(org.ID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastOwner):
+			app.errorResponse(w, r, http.StatusConflict, "the organization must keep at least one owner")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "member successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Invite an existing user, by email address, to join the organization. They get an
+// email with a token which they accept with PUT /v1/organizations/:id/invitations/accepted.
+//
+// The response is the same whether or not there is an account with the email address,
+// so that it can't be used to find out who has an account.
+func (app *application) postOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	role, ok := app.requireOrganizationRole(w, r, org.ID, data.OrganizationManager)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Email string                `json:"email"`
+		Role  data.OrganizationRole `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateOrganizationRole(v, input.Role)
+	if v.Valid() && !role.AtLeast(input.Role) {
+		v.AddError("role", "must not be higher than your own role")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if there is an account with this email address, an invitation will be sent to it"}
+
+	invitee, err := app.models.Users.SelectByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	inviter := app.contextGetUser(r)
+
+	// Saying that the inviter and the invitee blocked each other, or that the invitee
+	// is a member already, would give the account away as well, so such an invitation
+	// is dropped quietly.
+	blocked, err := app.blockedWith(r, invitee.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !blocked {
+		token, err := app.models.Organizations.Invite(org.ID, invitee.ID, input.Role, inviter.ID, organizationInvitationTTL)
+		switch {
+		case errors.Is(err, data.ErrAlreadyMember):
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		default:
+			err = app.models.EmailOutbox.Insert(&data.OutboxEmail{
+				Recipient: invitee.Email,
+				Template:  "organization_invitation.tmpl",
+				Locale:    invitee.Locale,
+				Data: map[string]any{
+					"invitationToken":  token.Plaintext,
+					"organizationID":   org.ID,
+					"organizationName": org.Name,
+					"inviterName":      inviter.Name,
+					"role":             input.Role,
+				},
+			})
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) acceptOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	org, ok := app.readOrganizationParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	role, err := app.models.Organizations.AcceptInvitation(org.ID, app.contextGetUser(r).ID, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			v.AddError("token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrAlreadyMember):
+			v.AddError("token", "you are already a member of this organization")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"organization": org, "role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
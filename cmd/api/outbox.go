@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/mailer"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long a claimed email is reserved for the worker which claimed it. If the
+	// worker dies before it reports back, the email is tried again after this.
+	emailOutboxLease = 5 * time.Minute
+	// How long an idle worker waits before looking for due emails again.
+	emailOutboxPollInterval = 2 * time.Second
+	// The wait before the first retry, which doubles with each further attempt up to
+	// emailOutboxMaxBackoff.
+	emailOutboxBaseBackoff = 30 * time.Second
+	emailOutboxMaxBackoff  = 6 * time.Hour
+)
+
+// startEmailOutbox() starts the workers which send the emails queued in the outbox.
+// They stop when the server shuts down, after finishing the email they are sending.
+func (app *application) startEmailOutbox() {
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.wg.Add(1)
+		go app.emailOutboxWorker()
+	}
+}
+
+func (app *application) emailOutboxWorker() {
+	defer app.wg.Done()
+
+	for {
+		email, err := app.models.EmailOutbox.Claim(emailOutboxLease)
+		if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+			app.logger.PrintError(err, nil)
+		}
+
+		// Wait a little when there's nothing to do, or the database is unhappy.
+		if err != nil {
+			select {
+			case <-app.shutdown:
+				return
+			case <-time.After(emailOutboxPollInterval):
+				continue
+			}
+		}
+
+		app.deliverEmail(email)
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+}
+
+// deliverEmail() makes one attempt at sending the email, and records how it went.
+func (app *application) deliverEmail(email *data.OutboxEmail) {
+	// Recover any panic in the templates, treating it like any other failed attempt.
+	defer func() {
+		if err := recover(); err != nil {
+			app.emailFailed(email, errors.New("panic while sending email"))
+		}
+	}()
+
+	err := app.mailer.Send(email.Recipient, email.Template, email.Locale, email.Data)
+	switch {
+	case errors.Is(err, mailer.ErrSuppressed):
+		// Trying again won't help, so the email is dropped like a sent one.
+		app.logger.PrintInfo("email to suppressed address dropped", map[string]string{
+			"email_id": strconv.FormatInt(email.ID, 10),
+			"template": email.Template,
+		})
+	case err != nil:
+		app.emailFailed(email, err)
+		return
+	}
+
+	err = app.models.EmailOutbox.Delete(email.ID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// emailFailed() schedules the next attempt at sending the email, or dead-letters it
+// once it has used up its attempts.
+func (app *application) emailFailed(email *data.OutboxEmail, sendErr error) {
+	properties := map[string]string{
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"template": email.Template,
+		"attempts": strconv.Itoa(email.Attempts),
+	}
+
+	var err error
+	if email.Attempts >= app.config.outbox.maxAttempts {
+		app.logger.PrintError(sendErr, properties)
+		err = app.models.EmailOutbox.DeadLetter(email.ID, sendErr.Error())
+	} else {
+		app.logger.PrintInfo("sending email failed: "+sendErr.Error(), properties)
+		err = app.models.EmailOutbox.Retry(email.ID, sendErr.Error(), time.Now().Add(retryBackoff(email.Attempts, emailOutboxBaseBackoff, emailOutboxMaxBackoff)))
+	}
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// retryBackoff() returns how long to wait before the next attempt, after the given
+// number of failed ones: base, doubling with each attempt up to max. Up to a fifth is
+// added at random, so that things which failed together, say while the SMTP server was
+// down, don't all come back at once.
+func retryBackoff(attempts int, base, max time.Duration) time.Duration {
+	backoff := max
+	if attempts < 20 && base<<(attempts-1) < max {
+		backoff = base << (attempts - 1)
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff/5)+1))
+}
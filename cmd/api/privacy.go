@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// How long users have to change their mind after asking for their account to be
+	// deleted.
+	accountDeletionGracePeriod = 30 * 24 * time.Hour
+	// How long the download link of a data export works.
+	dataExportTTL = 7 * 24 * time.Hour
+	// Users can request one data export per day.
+	dataExportInterval = 24 * time.Hour
+	// How many records are read at a time while building a data export.
+	dataExportPageSize = 100
+)
+
+// Build an archive of everything we store about the user and email them a link to
+// download it. Building it can take a while, so it happens in the background and the
+// client gets a 202 Accepted right away.
+func (app *application) postDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	recent, err := app.models.DataExports.RequestedSince(user.ID, time.Now().Add(-dataExportInterval))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if recent {
+		app.errorResponse(w, r, http.StatusTooManyRequests, "you can only request one data export per day")
+		return
+	}
+
+	app.background(func() {
+		archive, err := app.buildDataExport(user)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		token, err := app.models.DataExports.Insert(user.ID, archive, dataExportTTL)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		err = app.models.EmailOutbox.Insert(&data.OutboxEmail{
+			Recipient: user.Email,
+			Template:  "data_export.tmpl",
+			Locale:    user.Locale,
+			Data: map[string]any{
+				"downloadURL": fmt.Sprintf("%s/v1/exports/%s", app.config.baseURL, token.Plaintext),
+				"expiry":      token.Expiry.UTC().Format(time.RFC1123),
+			},
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = app.models.DataExports.DeleteExpired()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "your data export is being prepared and a download link will be sent to your email address"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// buildDataExport() collects the user's data into a ZIP archive with one JSON file per
+// kind of record. Secrets, such as password and token hashes, TOTP secrets and API key
+// hashes, are left out: they are of no use to the user and the archive travels by
+// email link.
+func (app *application) buildDataExport(user *data.User) ([]byte, error) {
+	roles, err := app.models.Roles.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.models.Permissions.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs, err := app.models.Organizations.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	memberships := []map[string]any{}
+	for _, org := range orgs {
+		role, err := app.models.Organizations.SelectRole(org.ID, user.ID)
+		if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+			return nil, err
+		}
+		memberships = append(memberships, map[string]any{"organization": org, "role": role})
+	}
+
+	apiKeys, err := app.models.APIKeys.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := app.models.Identities.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactor, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		return nil, err
+	}
+
+	tokens, err := app.models.Tokens.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo := []map[string]any{}
+	for _, token := range tokens {
+		tokenInfo = append(tokenInfo, map[string]any{"scope": token.Scope, "expiry": token.Expiry})
+	}
+
+	deletion, err := app.models.AccountDeletions.Select(user.ID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		return nil, err
+	}
+
+	listings, err := app.models.Listings.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	selling := []*data.Listing{}
+	bought := []*data.Listing{}
+	for _, listing := range listings {
+		if listing.SellerID != nil && *listing.SellerID == user.ID {
+			selling = append(selling, listing)
+		} else {
+			bought = append(bought, listing)
+		}
+	}
+
+	reviews, err := app.models.Reviews.SelectAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	written := []*data.Review{}
+	received := []*data.Review{}
+	for _, review := range reviews {
+		if review.ReviewerID == user.ID {
+			written = append(written, review)
+		} else {
+			received = append(received, review)
+		}
+	}
+
+	blocks, err := app.models.Blocks.SelectAllForUser(user.ID, data.BlockKindBlock)
+	if err != nil {
+		return nil, err
+	}
+	mutes, err := app.models.Blocks.SelectAllForUser(user.ID, data.BlockKindMute)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications, err := app.exportNotifications(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	notificationPreferences, err := app.models.Notifications.SelectPreferences(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations, err := app.exportConversations(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"profile.json", envelope{"user": user, "deletion": deletion}},
+		{"roles.json", envelope{"roles": roles, "permissions": permissions}},
+		{"organizations.json", envelope{"organizations": memberships}},
+		{"api_keys.json", envelope{"api_keys": apiKeys}},
+		{"identities.json", envelope{"identities": identities}},
+		{"two_factor.json", envelope{"totp": twoFactor}},
+		{"tokens.json", envelope{"tokens": tokenInfo}},
+		{"listings.json", envelope{"selling": selling, "bought": bought}},
+		{"reviews.json", envelope{"written": written, "received": received}},
+		{"blocks.json", envelope{"blocks": blocks, "mutes": mutes}},
+		{"notifications.json", envelope{"notifications": notifications, "preferences": notificationPreferences}},
+		{"conversations.json", envelope{"conversations": conversations}},
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.content, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.Write(append(js, '\n'))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// exportNotifications() returns all of the user's notifications, newest first.
+func (app *application) exportNotifications(userID int64) ([]*data.Notification, error) {
+	notifications := []*data.Notification{}
+	for page := 1; ; page++ {
+		batch, _, err := app.models.Notifications.SelectAllForUser(userID, false, data.Filters{Page: page, PageSize: dataExportPageSize})
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, batch...)
+		if len(batch) < dataExportPageSize {
+			return notifications, nil
+		}
+	}
+}
+
+// exportConversations() returns the conversations the user takes part in, each with
+// all of its messages, oldest first. The messages of the other participants are
+// included, since the conversation makes no sense without them.
+func (app *application) exportConversations(userID int64) ([]map[string]any, error) {
+	conversations := []map[string]any{}
+	for page := 1; ; page++ {
+		batch, _, err := app.models.Conversations.SelectAllForUser(userID, data.Filters{Page: page, PageSize: dataExportPageSize})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, conv := range batch {
+			var messages []*data.Message
+			var beforeID int64
+			for {
+				older, err := app.models.Conversations.SelectMessages(conv.ID, beforeID, dataExportPageSize)
+				if err != nil {
+					return nil, err
+				}
+				messages = append(messages, older...)
+				if len(older) < dataExportPageSize {
+					break
+				}
+				beforeID = older[len(older)-1].ID
+			}
+
+			// SelectMessages() goes back in time, the archive forward.
+			for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+				messages[i], messages[j] = messages[j], messages[i]
+			}
+			if messages == nil {
+				messages = []*data.Message{}
+			}
+
+			conversations = append(conversations, map[string]any{
+				"id":           conv.ID,
+				"listing_id":   conv.ListingID,
+				"participants": conv.Participants,
+				"created_at":   conv.CreatedAt,
+				"messages":     messages,
+			})
+		}
+
+		if len(batch) < dataExportPageSize {
+			return conversations, nil
+		}
+	}
+}
+
+// Download a data export. The link is sent by email and has to work straight from the
+// mail client, so the token in the URL is all that is checked.
+func (app *application) getDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	tokenPlaintext := httprouter.ParamsFromContext(r.Context()).ByName("token")
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, tokenPlaintext); !v.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	archive, err := app.models.DataExports.SelectArchive(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="diggo-data-export.zip"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// Ask for the account to be deleted. It is deleted for good once the grace period is
+// over; until then the user can still sign in and cancel.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// An organization must not be left with members but without an owner.
+	orgs, err := app.models.Organizations.SelectSoleOwned(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(orgs) > 0 {
+		app.errorResponse(w, r, http.StatusConflict, envelope{
+			"message":       "you are the only owner of organizations which have other members; transfer ownership or remove the members first",
+			"organizations": orgs,
+		})
+		return
+	}
+
+	deletion, err := app.models.AccountDeletions.Schedule(user.ID, accountDeletionGracePeriod)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The deletion is scheduled either way, so failing to queue the email is only
+	// logged.
+	err = app.models.EmailOutbox.Insert(&data.OutboxEmail{
+		Recipient: user.Email,
+		Template:  "account_deletion.tmpl",
+		Locale:    user.Locale,
+		Data: map[string]any{
+			"scheduledFor": deletion.ScheduledFor.UTC().Format(time.RFC1123),
+		},
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"deletion": deletion}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Cancel a pending account deletion.
+func (app *application) deleteAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.AccountDeletions.Cancel(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "account deletion cancelled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeDeletedAccounts() deletes the accounts whose grace period is over, at the given
+// interval, for as long as the process runs. With the authorization cache enabled,
+// Purge() also drops the deleted users from it, on every instance.
+func (app *application) purgeDeletedAccounts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ids, err := app.models.AccountDeletions.Purge()
+		for _, id := range ids {
+			app.logger.PrintInfo("account deleted", map[string]string{
+				"user_id": strconv.FormatInt(id, 10),
+			})
+		}
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
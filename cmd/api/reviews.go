@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"net/http"
+)
+
+// Look up the listing named by the ":id" URL parameter, sending a 404 Not Found
+// response if there isn't one.
+func (app *application) readListingParam(w http.ResponseWriter, r *http.Request) (*data.Listing, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	listing, err := app.models.Listings.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return listing, true
+}
+
+// Read the page and page_size query string parameters for lists which have a fixed
+// order.
+func (app *application) readPageFilters(r *http.Request, v *validator.Validator) data.Filters {
+	qs := r.URL.Query()
+
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "id",
+		SortSafelist: []string{"id"},
+	}
+
+	data.ValidateFilters(v, filters)
+	return filters
+}
+
+// Record that a listing was sold, and to whom. Only the seller, or for an
+// organization's listing one of its editors, can do this. The buyer is asked to confirm
+// the purchase with a PUT /v1/listings/:id/sold/accepted request, and only then is the
+// listing sold, which allows the buyer and the seller to review each other.
+//
+// The response is the same whether or not there is an account with the buyer's email
+// address, so that it can't be used to find out who has an account.
+func (app *application) putListingSoldHandler(w http.ResponseWriter, r *http.Request) {
+	listing, ok := app.readListingParam(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	allowed := listing.SellerID != nil && *listing.SellerID == user.ID
+	if !allowed && listing.OrganizationID != nil {
+		role, err := app.organizationRole(r, *listing.OrganizationID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		allowed = role.AtLeast(data.OrganizationEditor)
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		BuyerEmail string `json:"buyer_email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.BuyerEmail)
+	v.Check(listing.SellerID != nil, "listing", "has no seller on record and can't be marked as sold")
+	v.Check(listing.Status == data.ListingActive, "listing", "has already been sold")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if there is an account with this email address, it has been asked to confirm the purchase"}
+
+	buyer, err := app.models.Users.SelectByEmail(input.BuyerEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Saying that the seller and the buyer blocked each other would give the account
+	// away as well, so such a sale is dropped quietly, like one to the seller.
+	blocked := buyer.ID == *listing.SellerID
+	if !blocked {
+		blocked, err = app.models.Blocks.Blocked(*listing.SellerID, buyer.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !blocked {
+		err = app.models.Transaction(func(tx data.Models) error {
+			err := tx.Listings.OfferSale(listing, buyer.ID)
+			if err != nil {
+				return err
+			}
+			return tx.Events.Record(data.EventListingUpdated, listing)
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.notify(buyer.ID, data.NotificationSaleOffered, map[string]any{
+			"listingID":    listing.ID,
+			"listingTitle": listing.Title,
+			"sellerID":     *listing.SellerID,
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm buying a listing which the seller recorded as sold to the user. This marks
+// the listing as sold.
+func (app *application) putListingSaleAcceptedHandler(w http.ResponseWriter, r *http.Request) {
+	listing, ok := app.readListingParam(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if listing.SellerID == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	blocked, err := app.models.Blocks.Blocked(*listing.SellerID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Listings.AcceptSale(listing, user.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Events.Record(data.EventListingUpdated, listing)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.notify(*listing.SellerID, data.NotificationListingSold, map[string]any{
+		"listingID":    listing.ID,
+		"listingTitle": listing.Title,
+		"buyerID":      user.ID,
+		"buyerName":    user.Name,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"listing": listing}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Review the other side of a deal. The buyer reviews the seller and the seller reviews
+// the buyer, once each.
+func (app *application) postListingReviewHandler(w http.ResponseWriter, r *http.Request) {
+	listing, ok := app.readListingParam(w, r)
+	if !ok {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	review := &data.Review{
+		ListingID:    listing.ID,
+		ReviewerID:   user.ID,
+		ReviewerName: user.Name,
+	}
+
+	switch {
+	case listing.Status != data.ListingSold || listing.SellerID == nil || listing.BuyerID == nil:
+		app.notPermittedResponse(w, r)
+		return
+	case user.ID == *listing.BuyerID:
+		review.ReviewerRole = data.ReviewerBuyer
+		review.RevieweeID = *listing.SellerID
+	case user.ID == *listing.SellerID:
+		review.ReviewerRole = data.ReviewerSeller
+		review.RevieweeID = *listing.BuyerID
+	default:
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	blocked, err := app.blockedWith(r, review.RevieweeID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Rating int    `json:"rating"`
+		Text   string `json:"text"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	review.Rating = input.Rating
+	review.Text = input.Text
+
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Reviews.Insert(review)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateReview):
+			v.AddError("listing", "you have already reviewed this deal")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.notify(review.RevieweeID, data.NotificationReviewReceived, map[string]any{
+		"reviewID":     review.ID,
+		"listingID":    listing.ID,
+		"listingTitle": listing.Title,
+		"reviewerName": review.ReviewerName,
+		"rating":       review.Rating,
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/reviews/%d", review.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"review": review}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getListingReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	listing, ok := app.readListingParam(w, r)
+	if !ok {
+		return
+	}
+
+	reviews, err := app.models.Reviews.SelectAllForListing(listing.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reviews": reviews}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) readReviewParam(w http.ResponseWriter, r *http.Request) (*data.Review, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	review, err := app.models.Reviews.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return review, true
+}
+
+func (app *application) getReviewHandler(w http.ResponseWriter, r *http.Request) {
+	review, ok := app.readReviewParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The seller can answer a review their buyer wrote, once.
+func (app *application) putReviewReplyHandler(w http.ResponseWriter, r *http.Request) {
+	review, ok := app.readReviewParam(w, r)
+	if !ok {
+		return
+	}
+
+	if review.ReviewerRole != data.ReviewerBuyer || review.RevieweeID != app.contextGetUser(r).ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	blocked, err := app.blockedWith(r, review.ReviewerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Text string `json:"text"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateReviewReply(v, input.Text); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Reviews.Reply(review, input.Text)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyReplied):
+			app.errorResponse(w, r, http.StatusConflict, "you have already replied to this review")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.notify(review.ReviewerID, data.NotificationReviewReplied, map[string]any{
+		"reviewID":   review.ID,
+		"listingID":  review.ListingID,
+		"sellerName": app.contextGetUser(r).Name,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Report a review to the moderators.
+func (app *application) postReviewReportHandler(w http.ResponseWriter, r *http.Request) {
+	review, ok := app.readReviewParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	report := &data.ReviewReport{
+		ReviewID:   review.ID,
+		ReporterID: &user.ID,
+		Reason:     input.Reason,
+	}
+
+	v := validator.New()
+	if data.ValidateReviewReport(v, report); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Reviews.InsertReport(report)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateReport):
+			v.AddError("review", "you have already reported this review")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The public profile of a seller, with their rating from buyers.
+func (app *application) getSellerHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	rating, err := app.models.Reviews.SelectRatingForSeller(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only what is safe to show to anyone; in particular not the email address.
+	seller := envelope{
+		"id":         user.ID,
+		"name":       user.Name,
+		"created_at": user.CreatedAt,
+		"rating":     rating,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"seller": seller}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getSellerReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reviews, metadata, err := app.models.Reviews.SelectAllForSeller(id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reviews": reviews, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The moderation queue of reported reviews.
+func (app *application) getAllReviewReportsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, metadata, err := app.models.Reviews.SelectAllReports(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reports": reports, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Take down a review. Reports about it go with it.
+func (app *application) deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Reviews.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "review successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Dismiss a report and keep the review.
+func (app *application) deleteReviewReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Reviews.DeleteReport(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "report successfully dismissed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"expvar"
+	"letsgofurther/internal/data"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -15,16 +16,110 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/listings", app.getAllListings)
-	router.HandlerFunc(http.MethodPost, "/v1/listings", app.requirePermission("listings:write", app.postListing))
-	router.HandlerFunc(http.MethodGet, "/v1/listings/:id", app.requirePermission("listings:read", app.getListingById))
+	router.HandlerFunc(http.MethodPost, "/v1/listings", app.requirePermission("listings:write", app.idempotent(app.postListing)))
+	router.HandlerFunc(http.MethodGet, "/v1/listings/:id", app.withListingExport(app.withListingStream(app.requirePermission("listings:read", app.getListingById))))
 	router.HandlerFunc(http.MethodPatch, "/v1/listings/:id", app.patchListingById)
 	router.HandlerFunc(http.MethodDelete, "/v1/listings/:id", app.deleteListingById)
+	router.HandlerFunc(http.MethodPost, "/v1/listings/:id", app.withListingImport(app.requirePermission("listings:write", app.postListingImportHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/listings/:id/sold", app.requireScope("listings:write", app.putListingSoldHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/listings/:id/sold/accepted", app.requireActivatedUser(app.putListingSaleAcceptedHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/listings/:id/reviews", app.getListingReviewsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/listings/:id/reviews", app.requireActivatedUser(app.postListingReviewHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.postUser)
+	router.HandlerFunc(http.MethodGet, "/v1/imports/:id", app.requirePermission("listings:write", app.getImportHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/feeds/listings.atom", app.getListingsFeedHandler(feedFormatAtom))
+	router.HandlerFunc(http.MethodGet, "/v1/feeds/listings.rss", app.getListingsFeedHandler(feedFormatRSS))
+
+	router.HandlerFunc(http.MethodGet, "/v1/reviews/:id", app.getReviewHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/reviews/:id/reply", app.requireActivatedUser(app.putReviewReplyHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/reviews/:id/reports", app.requireActivatedUser(app.postReviewReportHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/sellers/:id", app.getSellerHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/sellers/:id/reviews", app.getSellerReviewsHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.idempotent(app.postUser))
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/totp", app.requireBearerToken(app.postTwoFactorEnrollmentHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/totp/confirm", app.requireBearerToken(app.postTwoFactorConfirmHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa/totp", app.requireBearerToken(app.deleteTwoFactorHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireBearerToken(app.getAllAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireBearerToken(app.postAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireBearerToken(app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.getCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireBearerToken(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireBearerToken(app.deleteAccountDeletionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/export", app.requireBearerToken(app.postDataExportHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/exports/:token", app.getDataExportHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/blocks", app.requireActivatedUser(app.getAllBlocksHandler(data.BlockKindBlock)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/blocks/:id", app.requireActivatedUser(app.putBlockHandler(data.BlockKindBlock)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/blocks/:id", app.requireActivatedUser(app.deleteBlockHandler(data.BlockKindBlock)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/mutes", app.requireActivatedUser(app.getAllBlocksHandler(data.BlockKindMute)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mutes/:id", app.requireActivatedUser(app.putBlockHandler(data.BlockKindMute)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mutes/:id", app.requireActivatedUser(app.deleteBlockHandler(data.BlockKindMute)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/notifications", app.requireActivatedUser(app.getAllNotificationsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/notifications/read", app.requireActivatedUser(app.putNotificationsReadHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/notification-preferences", app.requireActivatedUser(app.getNotificationPreferencesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/notification-preferences/:type", app.requireActivatedUser(app.putNotificationPreferenceHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/conversations", app.requireActivatedUser(app.getAllConversationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/conversations", app.requireActivatedUser(app.postConversationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/conversations/:id/messages", app.requireActivatedUser(app.getConversationMessagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/conversations/:id/messages", app.requireActivatedUser(app.idempotent(app.postConversationMessageHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/chat", app.withWebSocketToken(app.requireBearerToken(app.chatHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/organizations", app.requireActivatedUser(app.getAllOrganizationsForUserHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/organizations", app.requireActivatedUser(app.postOrganizationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:id", app.getOrganizationHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/organizations/:id", app.requireActivatedUser(app.patchOrganizationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/organizations/:id", app.requireActivatedUser(app.deleteOrganizationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:id/listings", app.getOrganizationListingsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:id/members", app.requireActivatedUser(app.getOrganizationMembersHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/organizations/:id/members/:user_id", app.requireActivatedUser(app.putOrganizationMemberHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/organizations/:id/members/:user_id", app.requireActivatedUser(app.deleteOrganizationMemberHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/organizations/:id/invitations", app.requireActivatedUser(app.postOrganizationInvitationHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/organizations/:id/invitations/accepted", app.requireActivatedUser(app.acceptOrganizationInvitationHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.postActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.postAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/2fa", app.postTwoFactorAuthenticationTokenHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/email-events", app.postEmailEventsHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/:provider/authorize", app.getOIDCAuthorizeHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oidc/:provider/callback", app.postOIDCCallbackHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/lockouts", app.requirePermission("users:admin", app.getAllLockoutsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/lockouts/users/:id", app.requirePermission("users:admin", app.deleteUserLockoutHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/lockouts/ips/:ip", app.requirePermission("users:admin", app.deleteIPLockoutHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/email-suppression", app.requirePermission("users:admin", app.deleteUserEmailSuppressionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("roles:admin", app.getAllPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("roles:admin", app.getAllRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("roles:admin", app.postRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("roles:admin", app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("roles:admin", app.getUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles/:role", app.requirePermission("roles:admin", app.putUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("roles:admin", app.deleteUserRoleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks", app.requirePermission("webhooks:admin", app.getAllWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/webhooks", app.requirePermission("webhooks:admin", app.postWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks/:id", app.requirePermission("webhooks:admin", app.getWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/webhooks/:id", app.requirePermission("webhooks:admin", app.patchWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/webhooks/:id", app.requirePermission("webhooks:admin", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks/:id/deliveries", app.requirePermission("webhooks:admin", app.getWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhook-deliveries/:id", app.requirePermission("webhooks:admin", app.getWebhookDeliveryHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/webhook-deliveries/:id/redeliver", app.requirePermission("webhooks:admin", app.postWebhookRedeliveryHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/review-reports", app.requirePermission("listings:moderate", app.getAllReviewReportsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/review-reports/:id", app.requirePermission("listings:moderate", app.deleteReviewReportHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/reviews/:id", app.requirePermission("listings:moderate", app.deleteReviewHandler))
 
 	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
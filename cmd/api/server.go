@@ -22,6 +22,11 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Shutdown() waits for requests to finish, which streams never do by themselves.
+	// Chat connections are hijacked, so Shutdown() doesn't close them at all.
+	srv.RegisterOnShutdown(app.listingFeed.close)
+	srv.RegisterOnShutdown(app.chat.close)
+
 	shutdownError := make(chan error)
 
 	// Start a background goroutine.
@@ -45,6 +50,9 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		// Tell the workers to stop once they're done with what they're doing.
+		close(app.shutdown)
+
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"letsgofurther/internal/data"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The per-account policy slows a single account down quickly and locks it after ten
+// failures. The per-IP policy is much more lenient, since many users can share an
+// address behind a NAT, but still stops one address from spraying passwords across
+// many accounts.
+var (
+	accountThrottlePolicy = data.ThrottlePolicy{
+		Window:       time.Hour,
+		FreeAttempts: 3,
+		BackoffBase:  time.Second,
+		MaxBackoff:   5 * time.Minute,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+	}
+	ipThrottlePolicy = data.ThrottlePolicy{
+		Window:       time.Hour,
+		FreeAttempts: 20,
+		BackoffBase:  time.Second,
+		MaxBackoff:   5 * time.Minute,
+		LockAfter:    100,
+		LockFor:      time.Hour,
+	}
+)
+
+// A loginAttempt is a login attempt which has been counted against both the account
+// and the client's address, before its credentials are checked.
+type loginAttempt struct {
+	email   string
+	ip      string
+	user    *data.User
+	account *data.LoginThrottle
+}
+
+// beginLoginAttempt() counts an attempt to log in to the given account from the given
+// address. The user is nil when no account exists for the email address. If either is
+// locked, or backing off after earlier failures, the attempt isn't allowed and the
+// returned delay is how long the client has to wait; it must then be rejected without
+// looking at the credentials.
+func (app *application) beginLoginAttempt(email, ip string, user *data.User) (*loginAttempt, time.Duration, error) {
+	// The address goes first, so that an address which is locked out can't add to
+	// the count of the accounts it is trying.
+	t, ok, err := app.models.LoginThrottles.RecordAttempt(data.IPThrottleSubject(ip), nil, ipThrottlePolicy)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, lockDelay(t), nil
+	}
+
+	var userID *int64
+	if user != nil {
+		userID = &user.ID
+	}
+
+	account, ok, err := app.models.LoginThrottles.RecordAttempt(data.EmailThrottleSubject(email), userID, accountThrottlePolicy)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, lockDelay(account), nil
+	}
+
+	return &loginAttempt{email: email, ip: ip, user: user, account: account}, 0, nil
+}
+
+// lockDelay() returns how long a locked throttle has left, rounded up to at least a
+// second for locks which ended a moment ago.
+func lockDelay(t *data.LoginThrottle) time.Duration {
+	if t.LockedUntil == nil || time.Until(*t.LockedUntil) < time.Second {
+		return time.Second
+	}
+	return time.Until(*t.LockedUntil)
+}
+
+// loginSucceeded() takes the attempt back, since its credentials were correct.
+func (app *application) loginSucceeded(a *loginAttempt) error {
+	err := app.models.LoginThrottles.Forgive(data.IPThrottleSubject(a.ip))
+	if err != nil {
+		return err
+	}
+	return app.models.LoginThrottles.Forgive(data.EmailThrottleSubject(a.email))
+}
+
+// loginFailed() is called once the credentials of the attempt have turned out to be
+// wrong. The attempt already counts, but if it was the one which locked an existing
+// account, the owner gets an email about it.
+func (app *application) loginFailed(a *loginAttempt) {
+	if a.user == nil || a.account.LockedUntil == nil || a.account.Failures < accountThrottlePolicy.LockAfter {
+		return
+	}
+
+	app.logger.PrintInfo("account locked", map[string]string{
+		"user_id": strconv.FormatInt(a.user.ID, 10),
+		"ip":      a.ip,
+	})
+
+	err := app.models.EmailOutbox.Insert(&data.OutboxEmail{
+		Recipient: a.user.Email,
+		Template:  "account_locked.tmpl",
+		Locale:    a.user.Locale,
+		Data: map[string]any{
+			"lockedUntil": a.account.LockedUntil.UTC().Format(time.RFC1123),
+			"ip":          a.ip,
+		},
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// passwordTimer keeps a moving average of how long checking a password takes. For
+// login attempts with an unknown email address we skip bcrypt entirely, so that they
+// don't cost us 250ms of CPU each, and instead sleep for about as long as a real check
+// would have taken. Otherwise the response time would tell an attacker which email
+// addresses have an account.
+type passwordTimer struct {
+	avg atomic.Int64
+}
+
+// newPasswordTimer() seeds the average with one real bcrypt comparison at startup.
+func newPasswordTimer() (*passwordTimer, error) {
+	var user data.User
+
+	err := user.Password.Set("calibrating password timer")
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	_, err = user.Password.Matches("wrong password")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &passwordTimer{}
+	t.avg.Store(int64(time.Since(start)))
+	return t, nil
+}
+
+// observe() folds the duration of a real password check, started at start, into the
+// moving average.
+func (t *passwordTimer) observe(start time.Time) {
+	d := int64(time.Since(start))
+	old := t.avg.Load()
+	t.avg.Store(old + (d-old)/8)
+}
+
+// simulate() sleeps for roughly as long as a password check takes, with a little
+// jitter in the same range real checks vary by.
+func (t *passwordTimer) simulate() {
+	avg := t.avg.Load()
+	jitter := rand.Int63n(avg/10+1) - avg/20
+	time.Sleep(time.Duration(avg + jitter))
+}
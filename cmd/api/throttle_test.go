@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/jsonlog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeThrottleModel counts attempts per subject the way RecordAttempt does, locking
+// a subject once it reaches the policy's LockAfter. Subjects in locked refuse attempts.
+type fakeThrottleModel struct {
+	data.LoginThrottleModel
+	mu       sync.Mutex
+	counts   map[string]int
+	locked   map[string]bool
+	forgiven []string
+}
+
+func newFakeThrottleModel() *fakeThrottleModel {
+	return &fakeThrottleModel{counts: make(map[string]int), locked: make(map[string]bool)}
+}
+
+func (m *fakeThrottleModel) RecordAttempt(subject string, userID *int64, p data.ThrottlePolicy) (*data.LoginThrottle, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locked[subject] {
+		lockedUntil := time.Now().Add(30 * time.Second)
+		return &data.LoginThrottle{Subject: subject, Failures: m.counts[subject], LockedUntil: &lockedUntil}, false, nil
+	}
+
+	m.counts[subject]++
+	t := &data.LoginThrottle{Subject: subject, UserID: userID, Failures: m.counts[subject], LastFailedAt: time.Now()}
+	if t.Failures >= p.LockAfter {
+		lockedUntil := time.Now().Add(p.LockFor)
+		t.LockedUntil = &lockedUntil
+		m.locked[subject] = true
+	}
+	return t, true, nil
+}
+
+func (m *fakeThrottleModel) Forgive(subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forgiven = append(m.forgiven, subject)
+	return nil
+}
+
+func (m *fakeThrottleModel) Reset(subject string) (bool, error) {
+	return true, nil
+}
+
+func (m *fakeTokenModel) New(userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	return &data.Token{Plaintext: "ABCDEFGHIJKLMNOPQRSTUVWXYZ", UserID: userID, Expiry: time.Now().Add(ttl), Scope: scope}, nil
+}
+
+// Nobody in these tests has two-factor authentication on.
+type fakeTwoFactorModel struct {
+	data.TwoFactorModel
+}
+
+func (m *fakeTwoFactorModel) SelectForUser(userID int64) (*data.TwoFactor, error) {
+	return nil, data.ErrNotFoundRecord
+}
+
+type fakeOutboxModel struct {
+	data.EmailOutboxModel
+	emails []*data.OutboxEmail
+}
+
+func (m *fakeOutboxModel) Insert(email *data.OutboxEmail) error {
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+const (
+	testPassword = "pa55word-of-alice"
+	testIP       = "192.0.2.1"
+)
+
+func newLoginTestApp(t *testing.T) (*application, *fakeThrottleModel, *fakeOutboxModel) {
+	t.Helper()
+
+	alice := &data.User{ID: 1, Email: "alice@example.com", Activated: true}
+	err := alice.Password.Set(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	throttles := newFakeThrottleModel()
+	outbox := &fakeOutboxModel{}
+	app := &application{
+		logger:        jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		passwordTimer: &passwordTimer{},
+		models: data.Models{
+			Users:          &fakeUserModel{users: map[string]*data.User{"alice@example.com": alice}},
+			Tokens:         &fakeTokenModel{},
+			TwoFactor:      &fakeTwoFactorModel{},
+			LoginThrottles: throttles,
+			EmailOutbox:    outbox,
+		},
+	}
+	return app, throttles, outbox
+}
+
+func postLogin(app *application, email, password string) *httptest.ResponseRecorder {
+	body := `{"email":"` + email + `","password":"` + password + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+	r.RemoteAddr = testIP + ":5123"
+
+	w := httptest.NewRecorder()
+	app.postAuthenticationTokenHandler(w, r)
+	return w
+}
+
+func TestLoginAttemptsAreCounted(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		password     string
+		wantStatus   int
+		wantForgiven bool
+	}{
+		{"correct password", "alice@example.com", testPassword, http.StatusCreated, true},
+		{"wrong password", "alice@example.com", "not-the-password", http.StatusUnauthorized, false},
+		{"unknown email", "bob@example.com", testPassword, http.StatusUnauthorized, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, throttles, _ := newLoginTestApp(t)
+
+			w := postLogin(app, tt.email, tt.password)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", w.Code, tt.wantStatus)
+			}
+
+			// Every attempt is counted before the password is checked...
+			for _, subject := range []string{data.IPThrottleSubject(testIP), data.EmailThrottleSubject(tt.email)} {
+				if throttles.counts[subject] != 1 {
+					t.Errorf("got %d attempts counted for %s; want 1", throttles.counts[subject], subject)
+				}
+			}
+			// ...and a correct one is taken back.
+			if forgiven := len(throttles.forgiven) == 2; forgiven != tt.wantForgiven {
+				t.Errorf("got %v forgiven; want forgiven %t", throttles.forgiven, tt.wantForgiven)
+			}
+		})
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	tests := []struct {
+		name   string
+		locked string
+	}{
+		{"locked account", data.EmailThrottleSubject("alice@example.com")},
+		// An address which is locked out doesn't add to the count of the account.
+		{"locked address", data.IPThrottleSubject(testIP)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, throttles, _ := newLoginTestApp(t)
+			throttles.locked[tt.locked] = true
+
+			// Even the correct password is refused.
+			w := postLogin(app, "alice@example.com", testPassword)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("got status %d; want %d", w.Code, http.StatusTooManyRequests)
+			}
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("got no Retry-After header")
+			}
+			if got := throttles.counts[data.EmailThrottleSubject("alice@example.com")]; got != 0 {
+				t.Errorf("got %d attempts counted for the account; want none", got)
+			}
+			if len(throttles.forgiven) != 0 {
+				t.Errorf("got %v forgiven; want none", throttles.forgiven)
+			}
+		})
+	}
+}
+
+// Guesses made in parallel are each counted before their password is checked, so no
+// more of them get through than the policy allows.
+func TestLoginParallelGuesses(t *testing.T) {
+	app, throttles, outbox := newLoginTestApp(t)
+
+	const guesses = 3 * 10
+	statuses := make(chan int, guesses)
+
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- postLogin(app, "alice@example.com", "not-the-password").Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	checked := 0
+	for status := range statuses {
+		if status == http.StatusUnauthorized {
+			checked++
+		}
+	}
+	if checked != accountThrottlePolicy.LockAfter {
+		t.Errorf("got %d passwords checked; want %d", checked, accountThrottlePolicy.LockAfter)
+	}
+	if got := throttles.counts[data.EmailThrottleSubject("alice@example.com")]; got != accountThrottlePolicy.LockAfter {
+		t.Errorf("got %d attempts counted; want %d", got, accountThrottlePolicy.LockAfter)
+	}
+
+	// The guess which locked the account tells its owner, once.
+	if len(outbox.emails) != 1 || outbox.emails[0].Template != "account_locked.tmpl" || outbox.emails[0].Recipient != "alice@example.com" {
+		t.Errorf("got emails %+v; want one account_locked.tmpl to alice@example.com", outbox.emails)
+	}
+}
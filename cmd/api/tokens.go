@@ -56,20 +56,22 @@ func (app *application) postActivationTokenHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// Email the user with their additional activation token.
-	app.background(func() {
-		data := map[string]any{
+	// Queue an email to the user with their additional activation token. Since email
+	// addresses MAY be case sensitive, notice that we are sending this email using the
+	// address stored in our database for the user --- not to the input.Email address
+	// provided by the client in this request.
+	err = app.models.EmailOutbox.Insert(&data.OutboxEmail{
+		Recipient: user.Email,
+		Template:  "token_activation.tmpl",
+		Locale:    user.Locale,
+		Data: map[string]any{
 			"activationToken": token.Plaintext,
-		}
-
-		// Since email addresses MAY be case sensitive, notice that we are sending this
-		// email using the address stored in our database for the user --- not to the
-		// input.Email address provided by the client in this request.
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+		},
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Send a 202 Accepted response and confirmation message to the client.
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
@@ -107,36 +109,104 @@ func (app *application) postAuthenticationTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	// Lookup the user record based on the email address. If no matching user was
-	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
-	// Unauthorized response to the client (we will create this helper in a moment).
+	// Lookup the user record based on the email address. A missing user is nil here,
+	// and handled below, after the attempt has been counted.
 	user, err := app.models.Users.SelectByEmail(input.Email)
 	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrNotFoundRecord):
-			app.invalidCredentialsResponse(w, r)
-		default:
+		if !errors.Is(err, data.ErrNotFoundRecord) {
 			app.serverErrorResponse(w, r, err)
+			return
 		}
+		user = nil
+	}
+
+	// Count the attempt against the account and the client's address before the
+	// password is checked, and refuse to even look at it while either is backing off
+	// or locked out after too many failures.
+	attempt, delay, err := app.beginLoginAttempt(input.Email, app.clientIP(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if delay > 0 {
+		app.loginThrottledResponse(w, r, delay)
+		return
+	}
+
+	// If no matching user was found, take as long as a real password check would
+	// have, and then call the app.invalidCredentialsResponse() helper to send a 401
+	// Unauthorized response to the client, just like for a wrong password.
+	if user == nil {
+		app.passwordTimer.simulate()
+		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
 	// Check if the provided password matches the actual password for the user.
+	start := time.Now()
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	app.passwordTimer.observe(start)
 
-	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
-	// helper again and return.
+	// If the passwords don't match, then the attempt stays counted, and we call the
+	// app.invalidCredentialsResponse() helper again and return.
 	if !match {
+		app.loginFailed(attempt)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
+	err = app.loginSucceeded(attempt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.authenticationTokenResponse(w, r, user)
+}
+
+// authenticationTokenResponse() finishes a successful first-factor login, whether by
+// password or through an OpenID Connect provider. If the user has two-factor
+// authentication on, that alone isn't enough: instead of an authentication token we
+// hand out a short-lived 2fa-pending token, which the client exchanges together with
+// a TOTP code at POST /v1/tokens/authentication/2fa.
+func (app *application) authenticationTokenResponse(w http.ResponseWriter, r *http.Request, user *data.User) {
+	tf, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if tf.Enabled() {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTwoFactorPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"two_factor_required": true, "two_factor_token": token}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The login is complete, so forget any earlier failures. This deliberately
+	// doesn't happen after a correct password alone, otherwise re-entering the
+	// password would reset the throttling of guesses at the two-factor code.
+	_, err = app.models.LoginThrottles.Reset(data.EmailThrottleSubject(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Otherwise we generate a new token with a 24-hour expiry time and the scope
+	// 'authentication'.
 	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -150,3 +220,105 @@ func (app *application) postAuthenticationTokenHandler(w http.ResponseWriter, r
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The second step of a two-factor login: exchange the 2fa-pending token from
+// postAuthenticationTokenHandler plus a TOTP or recovery code for an authentication
+// token.
+func (app *application) postTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	data.ValidateTwoFactorCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.SelectForToken(data.ScopeTwoFactorPending, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Guessing a 6 digit code is throttled in the same way as guessing a password.
+	attempt, delay, err := app.beginLoginAttempt(user.Email, app.clientIP(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if delay > 0 {
+		app.loginThrottledResponse(w, r, delay)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil {
+		switch {
+		// Two-factor authentication was turned off after the pending token was
+		// issued. Make the client start the login again.
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifyTwoFactorCode(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.loginFailed(attempt)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.loginSucceeded(attempt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.LoginThrottles.Reset(data.EmailThrottleSubject(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The pending token has done its job, so make sure it can't be used again.
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
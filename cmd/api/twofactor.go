@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/totp"
+	"letsgofurther/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The issuer shown next to the account name in authenticator apps.
+const totpIssuer = "Diggo"
+
+// Start (or restart) a TOTP enrollment. The secret is returned both in base-32 for
+// typing in by hand and as an otpauth:// URI for rendering as a QR code. Nothing
+// changes for the user's logins until the enrollment is confirmed.
+func (app *application) postTwoFactorEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if tf.Enabled() {
+		app.twoFactorAlreadyEnabledResponse(w, r)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tf = &data.TwoFactor{
+		UserID: user.ID,
+		Secret: secret,
+	}
+
+	err = app.models.TwoFactor.Upsert(tf)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.Default.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Confirm the enrollment with the first code from the authenticator app. This proves
+// the secret was imported correctly before we start demanding codes at login, and is
+// the only time the recovery codes are shown.
+func (app *application) postTwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTwoFactorCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			v.AddError("code", "two-factor enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Enabled() {
+		app.twoFactorAlreadyEnabledResponse(w, r)
+		return
+	}
+
+	// Guesses at the code are throttled like guesses at the password, against the same
+	// account, so a stolen authentication token can't be used to try them all.
+	attempt, delay, err := app.beginLoginAttempt(user.Email, app.clientIP(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if delay > 0 {
+		app.loginThrottledResponse(w, r, delay)
+		return
+	}
+
+	// Recovery codes don't exist yet at this point, so only a TOTP code will do.
+	ok, err := app.verifyTOTPCode(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.loginFailed(attempt)
+		v.AddError("code", "invalid two-factor code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.loginSucceeded(attempt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.TwoFactor.Confirm(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turn two-factor authentication off. A valid TOTP or recovery code is required so
+// that a stolen authentication token alone can't be used to strip the second factor.
+func (app *application) deleteTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTwoFactorCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	tf, err := app.models.TwoFactor.SelectForUser(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Guesses at the code are throttled like guesses at the password, against the same
+	// account, so a stolen authentication token can't be used to try them all.
+	attempt, delay, err := app.beginLoginAttempt(user.Email, app.clientIP(r), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if delay > 0 {
+		app.loginThrottledResponse(w, r, delay)
+		return
+	}
+
+	ok, err := app.verifyTwoFactorCode(tf, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.loginFailed(attempt)
+		v.AddError("code", "invalid two-factor code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.loginSucceeded(attempt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyTOTPCode checks a TOTP code, allowing one time step of clock drift either way,
+// and marks its time step as used so the same code can't be replayed.
+func (app *application) verifyTOTPCode(tf *data.TwoFactor, code string) (bool, error) {
+	counter, ok := totp.Default.Validate(tf.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	err := app.models.TwoFactor.UseCounter(tf.UserID, int64(counter))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// verifyTwoFactorCode accepts either a TOTP code or one of the user's unused recovery
+// codes. A recovery code is consumed by a successful check.
+func (app *application) verifyTwoFactorCode(tf *data.TwoFactor, code string) (bool, error) {
+	ok, err := app.verifyTOTPCode(tf, code)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	if !tf.Confirmed {
+		return false, nil
+	}
+
+	return app.models.TwoFactor.ConsumeRecoveryCode(tf.UserID, code)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"letsgofurther/internal/data"
 	"letsgofurther/internal/validator"
 	"net/http"
@@ -30,6 +31,7 @@ func (app *application) postUser(w http.ResponseWriter, r *http.Request) {
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    app.readLocale(r),
 	}
 
 	// Use the Password.Set() method to generate and store the hashed and plaintext
@@ -49,8 +51,42 @@ func (app *application) postUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Insert the user into the database in one unit of work, together with their
+	// default "user" role (which grants "listings:read"), their activation token and
+	// the welcome email carrying it. Either all of it happens or none of it does, so no
+	// user is left without a way to activate their account. The email is sent by the
+	// outbox workers once this has committed.
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Roles.AddForUser(user.ID, data.DefaultRole)
+		if err != nil {
+			return err
+		}
+
+		token, err := tx.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		err = tx.EmailOutbox.Insert(&data.OutboxEmail{
+			Recipient: user.Email,
+			Template:  "user_welcome.tmpl",
+			Locale:    user.Locale,
+			Data: map[string]any{
+				"activationToken": token.Plaintext,
+				"userID":          user.ID,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Events.Record(data.EventUserRegistered, user)
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -65,46 +101,42 @@ func (app *application) postUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "listings:read")
+	// Write a JSON response containing the user data along with a 201 Created status
+	// code.
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
 
-	//generate new token after user is inserted into db
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+}
 
-	// Use the background helper to execute an anonymous function that sends the welcome
-	// email.
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our email
-		// templates, we create a map to act as a 'holding structure' for the data. This
-		// contains the plaintext version of the activation token for the user, along
-		// with their ID.
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
+// The current user's account. Problems the user should know about, such as email to
+// their address bouncing, are listed under "warnings".
+func (app *application) getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
 
-		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
+	warnings := []string{}
+
+	suppression, err := app.models.EmailSuppressions.Select(user.Email)
+	switch {
+	case err == nil:
+		reason := "it bounced"
+		if suppression.Reason == data.EmailComplaint {
+			reason = "an email we sent was marked as spam"
 		}
-	})
+		warnings = append(warnings, fmt.Sprintf(
+			"we stopped sending email to %s on %s because %s; please contact support to have email sent to it again",
+			user.Email, suppression.CreatedAt.UTC().Format(time.RFC1123), reason,
+		))
+	case !errors.Is(err, data.ErrNotFoundRecord):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// Write a JSON response containing the user data along with a 201 Created status
-	// code.
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "warnings": warnings}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
 func (app *application) getUserByEmail(w http.ResponseWriter, r *http.Request) {
@@ -154,8 +186,22 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	user.Activated = true
 
 	// Save the updated user record in our database, checking for any edit conflicts in
-	// the same way that we did for our listings records.
-	err = app.models.Users.Update(user)
+	// the same way that we did for our listings records. If everything went
+	// successfully, then we delete all activation tokens for the user. Both happen in
+	// one unit of work, along with recording the event.
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Users.Update(user)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Events.Record(data.EventUserActivated, user)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -166,14 +212,6 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// If everything went successfully, then we delete all activation tokens for the
-	// user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	// Send the updated user details to the client in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/validator"
+	"letsgofurther/internal/webhook"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a claimed delivery is reserved for the worker which claimed it. It
+	// must be longer than webhookTimeout.
+	webhookLease = time.Minute
+	// How long a receiver has to answer.
+	webhookTimeout = 10 * time.Second
+	// How long an idle worker waits before looking for due deliveries again.
+	webhookPollInterval = 2 * time.Second
+	// The wait before the first retry, which doubles with each further attempt up to
+	// webhookMaxBackoff.
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// How much of the receiver's response is kept in the attempt log.
+	webhookMaxResponseBody = 1024
+)
+
+// Receivers are given a fixed time to answer, and redirects aren't followed: a
+// subscription has to point at where the events should go.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// The body of a delivery. ID is the delivery's, so receivers can tell a retry from a
+// new event.
+type webhookEvent struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// startWebhookDeliveries() starts the workers which deliver queued events. Like the
+// email outbox workers, they stop when the server shuts down, after finishing the
+// delivery they are making.
+func (app *application) startWebhookDeliveries() {
+	for i := 0; i < app.config.webhooks.workers; i++ {
+		app.wg.Add(1)
+		go app.webhookWorker()
+	}
+}
+
+func (app *application) webhookWorker() {
+	defer app.wg.Done()
+
+	for {
+		delivery, err := app.models.Webhooks.Claim(webhookLease)
+		if err != nil && !errors.Is(err, data.ErrNotFoundRecord) {
+			app.logger.PrintError(err, nil)
+		}
+
+		if err != nil {
+			select {
+			case <-app.shutdown:
+				return
+			case <-time.After(webhookPollInterval):
+				continue
+			}
+		}
+
+		app.deliverWebhook(delivery)
+
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+	}
+}
+
+// deliverWebhook() makes one attempt at the delivery, and logs how it went. Any 2xx
+// response counts as success; anything else is retried with backoff until the
+// delivery runs out of attempts.
+func (app *application) deliverWebhook(delivery *data.WebhookDelivery) {
+	attempt := &data.WebhookAttempt{DeliveryID: delivery.ID}
+
+	start := time.Now()
+	statusCode, body, err := postWebhook(delivery)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.StatusCode = &statusCode
+		attempt.ResponseBody = body
+		if statusCode < 200 || statusCode > 299 {
+			attempt.Error = fmt.Sprintf("receiver responded with status %d", statusCode)
+		}
+	}
+
+	properties := map[string]string{
+		"delivery_id": strconv.FormatInt(delivery.ID, 10),
+		"webhook_id":  strconv.FormatInt(delivery.WebhookID, 10),
+		"event":       delivery.EventType,
+		"attempts":    strconv.Itoa(delivery.Attempts),
+	}
+
+	status := data.WebhookDeliverySucceeded
+	nextAttemptAt := time.Now()
+	switch {
+	case attempt.Error == "":
+	case delivery.Attempts >= app.config.webhooks.maxAttempts:
+		status = data.WebhookDeliveryFailed
+		app.logger.PrintError(errors.New("webhook delivery failed: "+attempt.Error), properties)
+	default:
+		status = data.WebhookDeliveryPending
+		nextAttemptAt = nextAttemptAt.Add(retryBackoff(delivery.Attempts, webhookBaseBackoff, webhookMaxBackoff))
+		app.logger.PrintInfo("webhook delivery attempt failed: "+attempt.Error, properties)
+	}
+
+	err = app.models.Webhooks.RecordAttempt(attempt, status, nextAttemptAt)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// postWebhook() sends the signed delivery to the subscriber, returning the status code
+// and the start of the response body.
+func postWebhook(delivery *data.WebhookDelivery) (int, string, error) {
+	body, err := json.Marshal(webhookEvent{
+		ID:        delivery.ID,
+		Event:     delivery.EventType,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "letsgofurther-webhooks/"+version)
+	req.Header.Set(webhook.HeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhook.HeaderEvent, delivery.EventType)
+	// Receivers can drop an event they have seen already by its ID.
+	if delivery.EventID != nil {
+		req.Header.Set(webhook.HeaderEventID, strconv.FormatInt(*delivery.EventID, 10))
+	}
+	webhook.Sign(req.Header, delivery.Secret, time.Now(), body)
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	// Read the rest of the body too, within reason, so the connection can be reused.
+	responseBody, _ := io.ReadAll(io.LimitReader(res.Body, webhookMaxResponseBody))
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	// The log is stored as text, which must be valid UTF-8 without NUL bytes.
+	text := strings.ReplaceAll(strings.ToValidUTF8(string(responseBody), "�"), "\x00", "")
+
+	return res.StatusCode, text, nil
+}
+
+// readWebhookParam() loads the subscription named by the ":id" URL parameter, sending
+// a 404 Not Found response itself if there is none.
+func (app *application) readWebhookParam(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	wh, err := app.models.Webhooks.Select(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return wh, true
+}
+
+func (app *application) getAllWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.SelectAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Subscribe a URL to events. The secret deliveries are signed with is generated here
+// and only ever shown in this response.
+func (app *application) postWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"event_types"`
+		Active     *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	wh := &data.Webhook{
+		URL:        input.URL,
+		EventTypes: input.EventTypes,
+		Active:     true,
+		CreatedBy:  &app.contextGetUser(r).ID,
+	}
+	if input.Active != nil {
+		wh.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, wh); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	wh.Secret, err = webhook.NewSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(wh)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/webhooks/%d", wh.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": wh}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhookParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": wh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Change the URL or event types of a subscription, or pause and resume it. Deliveries
+// queued while a subscription is paused are sent once it is active again.
+func (app *application) patchWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhookParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		URL        *string  `json:"url"`
+		EventTypes []string `json:"event_types"`
+		Active     *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		wh.URL = *input.URL
+	}
+	if input.EventTypes != nil {
+		wh.EventTypes = input.EventTypes
+	}
+	if input.Active != nil {
+		wh.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, wh); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(wh)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": wh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Unsubscribe, dropping any deliveries which are still queued.
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deliveries to a subscription, newest first.
+func (app *application) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhookParam(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	filters := app.readPageFilters(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.SelectDeliveries(wh.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// A delivery with the log of its attempts.
+func (app *application) getWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	delivery, err := app.models.Webhooks.SelectDelivery(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Queue a delivery again, for instance after the receiver was fixed. The original
+// payload is sent, signed afresh, under the same delivery ID.
+func (app *application) postWebhookRedeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Redeliver(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotFoundRecord):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	delivery, err := app.models.Webhooks.SelectDelivery(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"letsgofurther/internal/data"
+	"letsgofurther/internal/jsonlog"
+	"letsgofurther/internal/webhook"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A recordingWebhookModel keeps the attempts deliverWebhook() records. The other
+// methods aren't used by the tests.
+type recordingWebhookModel struct {
+	data.WebhookModel
+	attempts []recordedAttempt
+}
+
+type recordedAttempt struct {
+	attempt       *data.WebhookAttempt
+	status        string
+	nextAttemptAt time.Time
+}
+
+func (m *recordingWebhookModel) RecordAttempt(attempt *data.WebhookAttempt, status string, nextAttemptAt time.Time) error {
+	m.attempts = append(m.attempts, recordedAttempt{attempt, status, nextAttemptAt})
+	return nil
+}
+
+func newWebhookTestApp(maxAttempts int) (*application, *recordingWebhookModel) {
+	model := &recordingWebhookModel{}
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models: data.Models{Webhooks: model},
+	}
+	app.config.webhooks.maxAttempts = maxAttempts
+	return app, model
+}
+
+func TestDeliverWebhookRequest(t *testing.T) {
+	var header http.Header
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	app, model := newWebhookTestApp(3)
+
+	eventID := int64(99)
+	delivery := &data.WebhookDelivery{
+		ID:        12,
+		WebhookID: 3,
+		EventID:   &eventID,
+		EventType: data.EventListingCreated,
+		Payload:   json.RawMessage(`{"id":42}`),
+		Attempts:  1,
+		CreatedAt: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC),
+		URL:       receiver.URL,
+		Secret:    "whsec_test",
+	}
+	app.deliverWebhook(delivery)
+
+	for name, want := range map[string]string{
+		"Content-Type":        "application/json",
+		webhook.HeaderID:      "12",
+		webhook.HeaderEventID: "99",
+		webhook.HeaderEvent:   data.EventListingCreated,
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("got %s %q; want %q", name, got, want)
+		}
+	}
+
+	err := webhook.Verify(header, "whsec_test", body, time.Minute, time.Now())
+	if err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+
+	var event webhookEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != 12 || event.Event != data.EventListingCreated || string(event.Data) != `{"id":42}` {
+		t.Errorf("got body %s", body)
+	}
+
+	if len(model.attempts) != 1 {
+		t.Fatalf("got %d attempts recorded; want 1", len(model.attempts))
+	}
+	got := model.attempts[0]
+	if got.status != data.WebhookDeliverySucceeded || got.attempt.StatusCode == nil || *got.attempt.StatusCode != http.StatusNoContent || got.attempt.Error != "" {
+		t.Errorf("got status %s, attempt %+v; want a successful attempt with status 204", got.status, got.attempt)
+	}
+}
+
+func TestDeliverWebhookStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		want     string
+		// The least and most the next attempt may be delayed by.
+		minDelay, maxDelay time.Duration
+	}{
+		{"success", http.StatusOK, 1, data.WebhookDeliverySucceeded, 0, time.Second},
+		{"first failure", http.StatusInternalServerError, 1, data.WebhookDeliveryPending, webhookBaseBackoff, webhookBaseBackoff * 6 / 5},
+		{"second failure", http.StatusServiceUnavailable, 2, data.WebhookDeliveryPending, 2 * webhookBaseBackoff, 2 * webhookBaseBackoff * 6 / 5},
+		{"client error", http.StatusGone, 3, data.WebhookDeliveryPending, 4 * webhookBaseBackoff, 4 * webhookBaseBackoff * 6 / 5},
+		{"last attempt", http.StatusInternalServerError, 5, data.WebhookDeliveryFailed, 0, time.Second},
+		{"success on last attempt", http.StatusAccepted, 5, data.WebhookDeliverySucceeded, 0, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, "receiver says hi")
+			}))
+			defer receiver.Close()
+
+			app, model := newWebhookTestApp(5)
+
+			start := time.Now()
+			app.deliverWebhook(&data.WebhookDelivery{ID: 1, Attempts: tt.attempts, Payload: json.RawMessage(`{}`), URL: receiver.URL})
+
+			if len(model.attempts) != 1 {
+				t.Fatalf("got %d attempts recorded; want 1", len(model.attempts))
+			}
+			got := model.attempts[0]
+
+			if got.status != tt.want {
+				t.Errorf("got status %s; want %s", got.status, tt.want)
+			}
+			if got.attempt.StatusCode == nil || *got.attempt.StatusCode != tt.status {
+				t.Errorf("got status code %v; want %d", got.attempt.StatusCode, tt.status)
+			}
+			if got.attempt.ResponseBody != "receiver says hi" {
+				t.Errorf("got response body %q", got.attempt.ResponseBody)
+			}
+			if failed := got.attempt.Error != ""; failed != (tt.status > 299) {
+				t.Errorf("got error %q for status %d", got.attempt.Error, tt.status)
+			}
+
+			delay := got.nextAttemptAt.Sub(start)
+			if delay < tt.minDelay || delay > tt.maxDelay+time.Second {
+				t.Errorf("got next attempt in %s; want between %s and %s", delay, tt.minDelay, tt.maxDelay)
+			}
+		})
+	}
+}
+
+func TestDeliverWebhookUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	app, model := newWebhookTestApp(5)
+	app.deliverWebhook(&data.WebhookDelivery{ID: 1, Attempts: 1, Payload: json.RawMessage(`{}`), URL: url})
+
+	if len(model.attempts) != 1 {
+		t.Fatalf("got %d attempts recorded; want 1", len(model.attempts))
+	}
+	got := model.attempts[0]
+	if got.status != data.WebhookDeliveryPending || got.attempt.StatusCode != nil || got.attempt.Error == "" {
+		t.Errorf("got status %s, attempt %+v; want a pending delivery with an error and no status code", got.status, got.attempt)
+	}
+}
+
+func TestDeliverWebhookRedirect(t *testing.T) {
+	followed := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed = true
+	}))
+	defer target.Close()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer receiver.Close()
+
+	app, model := newWebhookTestApp(5)
+	app.deliverWebhook(&data.WebhookDelivery{ID: 1, Attempts: 1, Payload: json.RawMessage(`{}`), URL: receiver.URL})
+
+	if followed {
+		t.Error("the redirect was followed")
+	}
+
+	got := model.attempts[0]
+	if got.attempt.StatusCode == nil || *got.attempt.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("got status code %v; want %d", got.attempt.StatusCode, http.StatusTemporaryRedirect)
+	}
+	if got.status != data.WebhookDeliveryPending || !strings.Contains(got.attempt.Error, "307") {
+		t.Errorf("got status %s, error %q; want a pending delivery which failed with status 307", got.status, got.attempt.Error)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	base, max := 30*time.Second, 6*time.Hour
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, base},
+		{2, 2 * base},
+		{5, 16 * base},
+		{10, 512 * base},
+		{11, max},
+		{64, max},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := retryBackoff(tt.attempts, base, max)
+			// Up to a fifth of jitter is added.
+			if got < tt.want || got > tt.want+tt.want/5 {
+				t.Fatalf("retryBackoff(%d) = %s; want between %s and %s", tt.attempts, got, tt.want, tt.want+tt.want/5)
+			}
+		}
+	}
+}
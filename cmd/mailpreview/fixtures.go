@@ -0,0 +1,62 @@
+package main
+
+// The data each template is rendered with in the preview. It mirrors what the API
+// queues with the emails, so keep it in sync when a template gains a new field.
+// Templates without fixtures are rendered with no data, which shows up as "<no value>"
+// wherever they use a field.
+var fixtures = map[string]map[string]any{
+	"account_deletion.tmpl": {
+		"scheduledFor": "Wed, 18 Nov 2026 09:30:00 UTC",
+	},
+	"account_locked.tmpl": {
+		"lockedUntil": "Mon, 19 Oct 2026 10:15:00 UTC",
+		"ip":          "203.0.113.42",
+	},
+	"data_export.tmpl": {
+		"downloadURL": "http://localhost:4000/v1/exports/Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"expiry":      "Mon, 26 Oct 2026 09:30:00 UTC",
+	},
+	"notification_listing_sold.tmpl": {
+		"listingID":    42,
+		"listingTitle": "Vintage road bike",
+		"buyerID":      8,
+		"buyerName":    "Bob Jones",
+	},
+	"notification_new_message.tmpl": {
+		"conversationID": 12,
+		"messageID":      305,
+		"senderName":     "Bob Jones",
+		"body":           "Hi! Is the bike still available? I could pick it up on Saturday.",
+	},
+	"notification_review_received.tmpl": {
+		"reviewID":     9,
+		"listingID":    42,
+		"listingTitle": "Vintage road bike",
+		"reviewerName": "Bob Jones",
+		"rating":       5,
+	},
+	"notification_review_replied.tmpl": {
+		"reviewID":   9,
+		"listingID":  42,
+		"sellerName": "Alice Smith",
+	},
+	"notification_sale_offered.tmpl": {
+		"listingID":    42,
+		"listingTitle": "Vintage road bike",
+		"sellerID":     7,
+	},
+	"organization_invitation.tmpl": {
+		"invitationToken":  "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"organizationID":   7,
+		"organizationName": "Flohmarkt Kreuzberg",
+		"inviterName":      "Alice Smith",
+		"role":             "editor",
+	},
+	"token_activation.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	},
+	"user_welcome.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          123,
+	},
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/fs"
+	"letsgofurther/internal/mailer"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const previewFrom = "Diggo <info@diggo.com>"
+const previewRecipient = "alice@example.com"
+
+// The page layout. Every page polls /version and reloads itself when the answer
+// changes, which is what makes edits to the templates show up straight away.
+const layout = `
+{{define "layout"}}
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>{{template "title" .}} - Mail preview</title>
+    <style>
+        body { font-family: sans-serif; margin: 1.5em; }
+        a { color: #0645ad; }
+        .error { color: #b00; white-space: pre-wrap; }
+        .columns { display: flex; gap: 1.5em; }
+        .columns > div { flex: 1; min-width: 0; }
+        pre { background: #f6f6f6; padding: 1em; white-space: pre-wrap; }
+        iframe { width: 100%; height: 70vh; border: 1px solid #ccc; }
+        td { padding: 0.2em 1em 0.2em 0; }
+    </style>
+</head>
+<body>
+    <p><a href="/">All templates and messages</a></p>
+    {{template "body" .}}
+    <script>
+        var version = {{.Version}};
+        setInterval(function () {
+            fetch("/version").then(function (response) {
+                return response.text();
+            }).then(function (text) {
+                if (text !== version) {
+                    location.reload();
+                }
+            });
+        }, 1000);
+    </script>
+</body>
+</html>
+{{end}}
+
+{{define "message"}}
+<h2>{{.Subject}}</h2>
+<p>From {{.From}} to {{.To}}</p>
+<div class="columns">
+    <div>
+        <h3>Plain text</h3>
+        <pre>{{.PlainBody}}</pre>
+    </div>
+    <div>
+        <h3>HTML</h3>
+        <iframe sandbox srcdoc="{{.HTMLBody}}"></iframe>
+    </div>
+</div>
+{{end}}
+`
+
+var pages = map[string]*template.Template{
+	"index": template.Must(template.Must(template.New("").Parse(layout)).Parse(`
+{{define "title"}}Index{{end}}
+{{define "body"}}
+<h1>Templates</h1>
+{{if .Error}}
+<p class="error">{{.Error}}</p>
+{{else}}
+<table>
+    {{range .Templates}}
+    <tr>
+        <td>{{.}}</td>
+        {{$name := .}}
+        {{range $.Locales}}<td><a href="/templates/{{$name}}?locale={{.}}">{{.}}</a></td>{{end}}
+    </tr>
+    {{end}}
+</table>
+{{end}}
+
+<h1>Sent messages</h1>
+{{if .SpoolError}}
+<p class="error">{{.SpoolError}}</p>
+{{else if not .Spool}}
+<p>None yet. Run the API with -mailer=file to have the emails it sends show up here.</p>
+{{else}}
+<table>
+    {{range .Spool}}
+    <tr>
+        <td>{{.Date.Format "2006-01-02 15:04:05"}}</td>
+        <td>{{.To}}</td>
+        <td><a href="/spool/{{.Name}}">{{.Subject}}</a></td>
+    </tr>
+    {{end}}
+</table>
+{{end}}
+{{end}}
+`)),
+	"message": template.Must(template.Must(template.New("").Parse(layout)).Parse(`
+{{define "title"}}{{.Title}}{{end}}
+{{define "body"}}
+<h1>{{.Title}}</h1>
+{{if .Error}}
+<p class="error">{{.Error}}</p>
+{{else}}
+{{template "message" .Message}}
+{{end}}
+{{end}}
+`)),
+}
+
+type pageData struct {
+	Version    string
+	Title      string
+	Error      error
+	Templates  []string
+	Locales    []string
+	Spool      []*mailer.SpooledMessage
+	SpoolError error
+	Message    *mailer.Message
+}
+
+func (app *application) indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := &pageData{Version: app.version()}
+
+	m, err := app.loadTemplates()
+	if err != nil {
+		data.Error = err
+	} else {
+		data.Templates = m.Templates()
+		data.Locales = m.Locales()
+	}
+
+	data.Spool, data.SpoolError = mailer.ReadSpool(app.spoolDir)
+
+	app.render(w, "index", data)
+}
+
+// templateHandler renders the template named in the URL, such as
+// /templates/user_welcome.tmpl?locale=de, with its fixture data.
+func (app *application) templateHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/templates/")
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = mailer.DefaultLocale
+	}
+
+	data := &pageData{
+		Version: app.version(),
+		Title:   fmt.Sprintf("%s (%s)", name, locale),
+	}
+
+	m, err := app.loadTemplates()
+	if err == nil {
+		data.Message, err = m.Render(previewRecipient, name, locale, fixtures[name])
+	}
+	data.Error = err
+
+	app.render(w, "message", data)
+}
+
+// spoolHandler shows a message from the maildir.
+func (app *application) spoolHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/spool/")
+
+	msg, err := mailer.ReadSpooledMessage(app.spoolDir, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.render(w, "message", &pageData{
+		Version: app.version(),
+		Title:   name,
+		Message: &msg.Message,
+	})
+}
+
+// versionHandler answers with a string which changes whenever a template is edited,
+// added or removed, or a message is added to the maildir.
+func (app *application) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(app.version()))
+}
+
+// loadTemplates parses the templates from disk, which is cheap enough to do on every
+// request and means the preview always shows the current version.
+func (app *application) loadTemplates() (mailer.Mailer, error) {
+	return mailer.NewFromFS(nil, previewFrom, os.DirFS(app.templatesDir))
+}
+
+func (app *application) version() string {
+	h := fnv.New64a()
+
+	for _, dir := range []string{
+		app.templatesDir,
+		filepath.Join(app.spoolDir, "new"),
+		filepath.Join(app.spoolDir, "cur"),
+	} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(h, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func (app *application) render(w http.ResponseWriter, page string, data *pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := pages[page].ExecuteTemplate(w, "layout", data)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,43 @@
+// Command mailpreview serves a preview of the email templates, for working on them
+// without signing up over and over. Each template is rendered with the fixture data in
+// fixtures.go, in every locale there is a translation for, with the subject, the plain
+// text and the HTML side by side. The templates are read from disk on every request,
+// and open pages reload by themselves when a template changes.
+//
+// It also lists the emails the API wrote to its maildir when it runs with -mailer=file.
+//
+// Run it from the root of the repository:
+//
+//	go run ./cmd/mailpreview
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+type application struct {
+	templatesDir string
+	spoolDir     string
+}
+
+func main() {
+	app := &application{}
+
+	addr := flag.String("addr", "localhost:4001", "Server address (local only by default, since it shows the emails sent)")
+	flag.StringVar(&app.templatesDir, "templates-dir", "./internal/mailer/templates", "Directory of the email templates")
+	flag.StringVar(&app.spoolDir, "mailer-dir", "./tmp/mail", "Maildir written by the file mailer backend")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.indexHandler)
+	mux.HandleFunc("/templates/", app.templateHandler)
+	mux.HandleFunc("/spool/", app.spoolHandler)
+	mux.HandleFunc("/version", app.versionHandler)
+
+	log.Printf("starting mail preview server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, mux)
+	log.Fatal(err)
+}
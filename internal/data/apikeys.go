@@ -0,0 +1,326 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"letsgofurther/internal/validator"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API keys look like "dg_k3x9f2qa_<32 characters of secret>". The first part up to
+// the second underscore is the prefix: it is stored in the clear so that owners can
+// tell their keys apart and so that we can look a key up by it. Only a SHA-256 hash
+// of the whole key is stored.
+const apiKeyTag = "dg_"
+
+var APIKeyRX = regexp.MustCompile(`^dg_[a-z2-7]{8}_[a-z2-7]{32}$`)
+
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	AllowedIPs  []string    `json:"allowed_ips"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	LastUsedIP  string      `json:"last_used_ip,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+func generateAPIKey(userID int64) (*APIKey, error) {
+	randomBytes := make([]byte, 25)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// 25 random bytes encode to exactly 40 base-32 characters: 8 for the prefix
+	// and 32 for the secret part.
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	key := &APIKey{
+		UserID: userID,
+		Prefix: apiKeyTag + encoded[:8],
+	}
+	key.Plaintext = key.Prefix + "_" + encoded[8:]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+// APIKeyPrefix extracts the prefix from a plaintext key. The plaintext must already
+// have passed ValidateAPIKeyPlaintext.
+func APIKeyPrefix(plaintext string) string {
+	return plaintext[:len(apiKeyTag)+8]
+}
+
+// Matches compares the hash of the plaintext with the stored one in constant time.
+func (k *APIKey) Matches(plaintext string) bool {
+	hash := sha256.Sum256([]byte(plaintext))
+	return subtle.ConstantTimeCompare(hash[:], k.Hash) == 1
+}
+
+// Expired reports whether the key has an expiry which has passed.
+func (k *APIKey) Expired() bool {
+	return k.Expiry != nil && time.Now().After(*k.Expiry)
+}
+
+// AllowsIP reports whether requests from the given address may use the key. An empty
+// allowlist allows every address.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, allowed := range k.AllowedIPs {
+		prefix, err := parseIPOrPrefix(allowed)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowlist entries can be single addresses ("203.0.113.7") or CIDR ranges
+// ("203.0.113.0/24").
+func parseIPOrPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(validator.Matches(plaintext, APIKeyRX), "key", "must be a valid API key")
+}
+
+// ValidateAPIKey checks a new key. A key can only carry permissions which its owner
+// currently has.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, ownerPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(ownerPermissions.Include(code), "permissions", "must only contain permissions you have")
+	}
+
+	v.Check(len(key.AllowedIPs) <= 20, "allowed_ips", "must not contain more than 20 entries")
+	for _, ip := range key.AllowedIPs {
+		_, err := parseIPOrPrefix(ip)
+		v.Check(err == nil, "allowed_ips", "must only contain IP addresses or CIDR ranges")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+/* MODEL */
+
+type APIKeyModel struct {
+	DB DBTX
+}
+
+// New generates a key for the user, copying over the caller-supplied fields, and
+// inserts it. The returned key is the only place the plaintext is ever available.
+func (m APIKeyModel) New(userID int64, input *APIKey) (*APIKey, error) {
+	key, err := generateAPIKey(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Name = input.Name
+	key.Permissions = input.Permissions
+	key.AllowedIPs = input.AllowedIPs
+	key.Expiry = input.Expiry
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	err = m.Insert(key)
+	return key, err
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, allowed_ips, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	args := []any{
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.Hash,
+		pq.Array([]string(key.Permissions)),
+		pq.Array(key.AllowedIPs),
+		key.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// SelectByPrefix looks up a key by its visible prefix. The caller still has to check
+// the secret with Matches().
+func (m APIKeyModel) SelectByPrefix(prefix string) (*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, hash, permissions, allowed_ips, expiry, last_used_at, COALESCE(last_used_ip, ''), created_at
+		FROM api_keys
+		WHERE prefix = $1`
+
+	var key APIKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, prefix).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		pq.Array((*[]string)(&key.Permissions)),
+		pq.Array(&key.AllowedIPs),
+		&key.Expiry,
+		&key.LastUsedAt,
+		&key.LastUsedIP,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+func (m APIKeyModel) SelectAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, name, prefix, permissions, allowed_ips, expiry, last_used_at, COALESCE(last_used_ip, ''), created_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array((*[]string)(&key.Permissions)),
+			pq.Array(&key.AllowedIPs),
+			&key.Expiry,
+			&key.LastUsedAt,
+			&key.LastUsedIP,
+			&key.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Touch records the last use of a key. To avoid a write on every single request, the
+// row is only updated when the previous use is more than a minute old or came from a
+// different address.
+func (m APIKeyModel) Touch(id int64, ip string) error {
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW(), last_used_ip = $2
+		WHERE id = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute' OR last_used_ip IS DISTINCT FROM $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ip)
+	return err
+}
+
+// Delete revokes a key. The user ID is part of the WHERE clause so that users can only
+// revoke their own keys; anything else is reported as not found.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// DeleteAllForUser revokes all of the user's keys.
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1`, userID)
+	return err
+}
@@ -0,0 +1,428 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"letsgofurther/internal/pubsub"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AuthCacheChannel is the Postgres NOTIFY channel used to tell every API instance to
+// drop cached authorization data. The payload is a user ID, or "*" for everything.
+const AuthCacheChannel = "auth_cache"
+
+// AuthCache keeps the result of the two lookups every protected request needs, the
+// user behind an authentication token and that user's effective permissions, in
+// memory for a short TTL. Entries are dropped as soon as anything they depend on
+// changes, both on this instance and, via AuthCacheChannel, on all others; the TTL
+// only bounds the damage if a notification is ever lost.
+type AuthCache struct {
+	db         *sql.DB
+	ttl        time.Duration
+	maxEntries int
+
+	// ErrorLog, if set, is called when an invalidation couldn't be published to the
+	// other instances. The write that triggered it has already succeeded by then, so
+	// failing the request would be wrong.
+	ErrorLog func(error)
+
+	mu sync.Mutex
+	// generation is bumped by every invalidation. A lookup only stores its result
+	// if no invalidation happened while it was querying the database, otherwise it
+	// could put back data that was just invalidated.
+	generation   uint64
+	permissions  map[int64]permissionsEntry
+	tokens       map[string]tokenEntry
+	tokensByUser map[int64]map[string]struct{}
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type permissionsEntry struct {
+	permissions Permissions
+	expires     time.Time
+}
+
+type tokenEntry struct {
+	user    User
+	expires time.Time
+}
+
+func NewAuthCache(db *sql.DB, ttl time.Duration, maxEntries int) *AuthCache {
+	return &AuthCache{
+		db:           db,
+		ttl:          ttl,
+		maxEntries:   maxEntries,
+		permissions:  make(map[int64]permissionsEntry),
+		tokens:       make(map[string]tokenEntry),
+		tokensByUser: make(map[int64]map[string]struct{}),
+	}
+}
+
+// Stats returns the counters published in expvar.
+func (c *AuthCache) Stats() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]int64{
+		"hits":        c.hits.Load(),
+		"misses":      c.misses.Load(),
+		"tokens":      int64(len(c.tokens)),
+		"permissions": int64(len(c.permissions)),
+	}
+}
+
+// InvalidateUser drops everything cached for the user, here and on every other
+// instance.
+func (c *AuthCache) InvalidateUser(userID int64) {
+	c.dropUser(userID)
+	c.publish(strconv.FormatInt(userID, 10))
+}
+
+// InvalidateAll empties the cache, here and on every other instance. It is used for
+// changes that can affect many users at once, such as deleting a role.
+func (c *AuthCache) InvalidateAll() {
+	c.Flush()
+	c.publish("*")
+}
+
+// HandleNotification applies an invalidation received on AuthCacheChannel.
+func (c *AuthCache) HandleNotification(payload string) {
+	if payload == "*" {
+		c.Flush()
+		return
+	}
+
+	userID, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		// Don't guess at what a malformed message meant to invalidate.
+		c.Flush()
+		return
+	}
+	c.dropUser(userID)
+}
+
+// Flush empties the local cache only.
+func (c *AuthCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.permissions = make(map[int64]permissionsEntry)
+	c.tokens = make(map[string]tokenEntry)
+	c.tokensByUser = make(map[int64]map[string]struct{})
+}
+
+func (c *AuthCache) dropUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	delete(c.permissions, userID)
+	for key := range c.tokensByUser[userID] {
+		delete(c.tokens, key)
+	}
+	delete(c.tokensByUser, userID)
+}
+
+func (c *AuthCache) publish(payload string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := pubsub.Notify(ctx, c.db, AuthCacheChannel, payload)
+	if err != nil && c.ErrorLog != nil {
+		c.ErrorLog(err)
+	}
+}
+
+// makeRoom keeps the cache bounded. Expired entries go first; if that isn't enough
+// the whole cache is dropped, which is crude but cheap and only costs a round of
+// misses. The caller must hold the lock.
+func (c *AuthCache) makeRoom() {
+	if len(c.tokens)+len(c.permissions) < c.maxEntries {
+		return
+	}
+
+	now := time.Now()
+	for key, e := range c.tokens {
+		if now.After(e.expires) {
+			delete(c.tokens, key)
+			delete(c.tokensByUser[e.user.ID], key)
+		}
+	}
+	for id, e := range c.permissions {
+		if now.After(e.expires) {
+			delete(c.permissions, id)
+		}
+	}
+
+	if len(c.tokens)+len(c.permissions) >= c.maxEntries {
+		c.permissions = make(map[int64]permissionsEntry)
+		c.tokens = make(map[string]tokenEntry)
+		c.tokensByUser = make(map[int64]map[string]struct{})
+	}
+}
+
+func (c *AuthCache) getPermissions(userID int64, load func() (Permissions, error)) (Permissions, error) {
+	c.mu.Lock()
+	e, ok := c.permissions[userID]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		return e.permissions, nil
+	}
+	c.misses.Add(1)
+
+	permissions, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.storePermissions(generation, userID, permissions)
+	return permissions, nil
+}
+
+func (c *AuthCache) storePermissions(generation uint64, userID int64, permissions Permissions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.makeRoom()
+	c.permissions[userID] = permissionsEntry{permissions: permissions, expires: time.Now().Add(c.ttl)}
+}
+
+// getUserForToken looks up the user for an authentication token. On a miss, the user
+// and their permissions are loaded together in a single query, so that a cold request
+// costs one round trip instead of two and a warm one costs none.
+func (c *AuthCache) getUserForToken(tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	key := hex.EncodeToString(tokenHash[:])
+
+	c.mu.Lock()
+	e, ok := c.tokens[key]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		c.hits.Add(1)
+		// Hand out a copy, since handlers are free to modify the user they get.
+		user := e.user
+		return &user, nil
+	}
+	c.misses.Add(1)
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version,
+			tokens.expiry,
+			ARRAY(
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+				WHERE users_permissions.user_id = users.id
+				UNION
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+				INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+				WHERE users_roles.user_id = users.id
+			)
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	var user User
+	var expiry time.Time
+	permissions := Permissions{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := c.db.QueryRowContext(ctx, query, tokenHash[:], ScopeAuthentication, time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+		&expiry,
+		pq.Array((*[]string)(&permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if expiry.Before(expires) {
+		expires = expiry
+	}
+
+	c.mu.Lock()
+	if generation == c.generation {
+		c.makeRoom()
+		c.tokens[key] = tokenEntry{user: user, expires: expires}
+		if c.tokensByUser[user.ID] == nil {
+			c.tokensByUser[user.ID] = make(map[string]struct{})
+		}
+		c.tokensByUser[user.ID][key] = struct{}{}
+		c.permissions[user.ID] = permissionsEntry{permissions: permissions, expires: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+
+	return &user, nil
+}
+
+/* CACHED MODELS */
+
+// NewCachedModels returns the same models as NewModels, except that token and
+// permission lookups go through the cache, and every write which can change them
+// invalidates it.
+func NewCachedModels(db *sql.DB, cache *AuthCache) Models {
+	m := withCache(NewModels(db), db, cache, nil)
+	m.cache = cache
+	return m
+}
+
+// withCache puts the cached models in place of the plain ones. Inside a unit of work,
+// lookups bypass the cache, which can't see the unit's uncommitted writes, and
+// invalidations wait until the unit has committed: done any earlier, a concurrent
+// lookup could put the old data straight back.
+func withCache(m Models, db DBTX, cache *AuthCache, unit *unitOfWork) Models {
+	m.Users = cachedUserModel{UserModel: UserModel{DB: db}, cache: cache, unit: unit}
+	m.Tokens = cachedTokenModel{TokenModel: TokenModel{DB: db}, cache: cache, unit: unit}
+	m.Permissions = cachedPermissionModel{PermissionModel: PermissionModel{DB: db}, cache: cache, unit: unit}
+	m.Roles = cachedRoleModel{RoleModel: RoleModel{DB: db}, cache: cache, unit: unit}
+	m.AccountDeletions = cachedAccountDeletionModel{AccountDeletionModel: AccountDeletionModel{DB: db}, cache: cache, unit: unit}
+	return m
+}
+
+type cachedUserModel struct {
+	UserModel
+	cache *AuthCache
+	unit  *unitOfWork
+}
+
+// Only authentication tokens are cached. Activation and other one-off tokens are
+// looked up once and then deleted, so caching them would achieve nothing.
+func (m cachedUserModel) SelectForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	if tokenScope != ScopeAuthentication || m.unit != nil {
+		return m.UserModel.SelectForToken(tokenScope, tokenPlaintext)
+	}
+	return m.cache.getUserForToken(tokenPlaintext)
+}
+
+func (m cachedUserModel) Update(user *User) error {
+	err := m.UserModel.Update(user)
+	if err == nil {
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(user.ID) })
+	}
+	return err
+}
+
+type cachedTokenModel struct {
+	TokenModel
+	cache *AuthCache
+	unit  *unitOfWork
+}
+
+func (m cachedTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	err := m.TokenModel.DeleteAllForUser(scope, userID)
+	if err == nil {
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(userID) })
+	}
+	return err
+}
+
+type cachedPermissionModel struct {
+	PermissionModel
+	cache *AuthCache
+	unit  *unitOfWork
+}
+
+func (m cachedPermissionModel) SelectAllForUser(userID int64) (Permissions, error) {
+	if m.unit != nil {
+		return m.PermissionModel.SelectAllForUser(userID)
+	}
+	return m.cache.getPermissions(userID, func() (Permissions, error) {
+		return m.PermissionModel.SelectAllForUser(userID)
+	})
+}
+
+func (m cachedPermissionModel) AddForUser(userID int64, permissions ...string) error {
+	err := m.PermissionModel.AddForUser(userID, permissions...)
+	if err == nil {
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(userID) })
+	}
+	return err
+}
+
+type cachedRoleModel struct {
+	RoleModel
+	cache *AuthCache
+	unit  *unitOfWork
+}
+
+func (m cachedRoleModel) AddForUser(userID int64, names ...string) error {
+	err := m.RoleModel.AddForUser(userID, names...)
+	if err == nil {
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(userID) })
+	}
+	return err
+}
+
+func (m cachedRoleModel) RemoveForUser(userID int64, name string) error {
+	err := m.RoleModel.RemoveForUser(userID, name)
+	if err == nil {
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(userID) })
+	}
+	return err
+}
+
+// Deleting a role changes the permissions of everybody who had it.
+func (m cachedRoleModel) Delete(id int64) error {
+	err := m.RoleModel.Delete(id)
+	if err == nil {
+		m.unit.deferUntilCommit(m.cache.InvalidateAll)
+	}
+	return err
+}
+
+type cachedAccountDeletionModel struct {
+	AccountDeletionModel
+	cache *AuthCache
+	unit  *unitOfWork
+}
+
+// A purged user's tokens must stop working at once, not when their cache entries
+// expire. The users deleted before an error are gone too, so they are invalidated
+// either way.
+func (m cachedAccountDeletionModel) Purge() ([]int64, error) {
+	deleted, err := m.AccountDeletionModel.Purge()
+	for _, userID := range deleted {
+		userID := userID
+		m.unit.deferUntilCommit(func() { m.cache.InvalidateUser(userID) })
+	}
+	return deleted, err
+}
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// The two kinds of block. A block stops the two users from interacting at all, in both
+// directions: no reviews, deals or invitations between them, and neither sees the
+// other's listings. A mute is one-sided and only hides the muted user's listings.
+const (
+	BlockKindBlock = "block"
+	BlockKindMute  = "mute"
+)
+
+type Block struct {
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// listingsVisibleTo returns a condition on listings which hides listings from users
+// the viewer has blocked or muted, and from users who blocked the viewer. param is the
+// query placeholder holding the viewer's user ID, which is 0 for anonymous requests.
+func listingsVisibleTo(param string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM users_blocks
+		WHERE (users_blocks.blocker_id = ` + param + ` AND users_blocks.blocked_id = listings.user_id)
+		OR (users_blocks.blocker_id = listings.user_id AND users_blocks.blocked_id = ` + param + ` AND users_blocks.kind = 'block')
+	)`
+}
+
+/* MODEL */
+
+type BlockModel struct {
+	DB DBTX
+}
+
+// Upsert blocks or mutes a user. Blocking a user who is muted turns the mute into a
+// block, but muting a user who is blocked leaves the block as it is; the returned
+// Block says which one is in force.
+func (m BlockModel) Upsert(blockerID, blockedID int64, kind string) (*Block, error) {
+	query := `
+		INSERT INTO users_blocks (blocker_id, blocked_id, kind)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (blocker_id, blocked_id) DO UPDATE
+		SET kind = CASE WHEN users_blocks.kind = 'block' THEN 'block' ELSE EXCLUDED.kind END,
+			created_at = CASE
+				WHEN users_blocks.kind = 'block' OR users_blocks.kind = EXCLUDED.kind THEN users_blocks.created_at
+				ELSE NOW()
+			END
+		RETURNING blocked_id, kind, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var block Block
+	err := m.DB.QueryRowContext(ctx, query, blockerID, blockedID, kind).Scan(&block.UserID, &block.Kind, &block.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+// Delete lifts a block or a mute of the given kind. ErrNotFoundRecord is returned if
+// there is none.
+func (m BlockModel) Delete(blockerID, blockedID int64, kind string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(
+		ctx,
+		`DELETE FROM users_blocks WHERE blocker_id = $1 AND blocked_id = $2 AND kind = $3`,
+		blockerID, blockedID, kind,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// SelectAllForUser returns the users the given user has blocked or muted.
+func (m BlockModel) SelectAllForUser(blockerID int64, kind string) ([]*Block, error) {
+	query := `
+		SELECT users_blocks.blocked_id, users.name, users_blocks.kind, users_blocks.created_at
+		FROM users_blocks
+		INNER JOIN users ON users.id = users_blocks.blocked_id
+		WHERE users_blocks.blocker_id = $1 AND users_blocks.kind = $2
+		ORDER BY users_blocks.created_at DESC, users_blocks.blocked_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, blockerID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*Block{}
+	for rows.Next() {
+		var block Block
+		err := rows.Scan(&block.UserID, &block.Name, &block.Kind, &block.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &block)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// Blocked reports whether either of the two users has blocked the other. Mutes don't
+// count, since they don't stop any interaction.
+func (m BlockModel) Blocked(userID, otherID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM users_blocks
+			WHERE kind = 'block'
+			AND ((blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocked bool
+	err := m.DB.QueryRowContext(ctx, query, userID, otherID).Scan(&blocked)
+	return blocked, err
+}
@@ -0,0 +1,368 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"letsgofurther/internal/pubsub"
+	"letsgofurther/internal/validator"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// ChatChannel is the Postgres NOTIFY channel which carries chat activity to every
+// instance, so that users connected to different instances can talk to each other. The
+// payload is a JSON encoded ChatNotification.
+const ChatChannel = "chat"
+
+// The types of ChatNotification.
+const (
+	// A message was sent. Only its ID is passed along, since a message can be longer
+	// than a notification payload may be.
+	ChatMessage = "message"
+	// A participant is typing in a conversation.
+	ChatTyping = "typing"
+	// Users connected to or disconnected from an instance. Instances also announce all
+	// of their users now and then, so that the users of an instance which went away
+	// without saying goodbye are eventually taken offline.
+	ChatPresence = "presence"
+)
+
+// The longest message, in characters.
+const MaxMessageLength = 4000
+
+type Conversation struct {
+	ID           int64     `json:"id"`
+	ListingID    *int64    `json:"listing_id"`
+	Participants []int64   `json:"participants"`
+	LastMessage  *Message  `json:"last_message,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// HasParticipant reports whether the user takes part in the conversation.
+func (c *Conversation) HasParticipant(userID int64) bool {
+	for _, id := range c.Participants {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+type Message struct {
+	ID             int64     `json:"id"`
+	ConversationID int64     `json:"conversation_id"`
+	SenderID       *int64    `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func ValidateMessage(v *validator.Validator, msg *Message) {
+	v.Check(msg.Body != "", "body", "must be provided")
+	v.Check(utf8.RuneCountInString(msg.Body) <= MaxMessageLength, "body", "must not be more than 4000 characters long")
+}
+
+type ChatNotification struct {
+	Type           string `json:"type"`
+	ConversationID int64  `json:"conversation_id,omitempty"`
+	MessageID      int64  `json:"message_id,omitempty"`
+	UserID         int64  `json:"user_id,omitempty"`
+	// For presence notifications, the instance which sent it and the users who are
+	// online or went offline there.
+	Instance string  `json:"instance,omitempty"`
+	Online   []int64 `json:"online,omitempty"`
+	Offline  []int64 `json:"offline,omitempty"`
+}
+
+/* MODEL */
+
+type ConversationModel struct {
+	DB DBTX
+}
+
+// Start returns the conversation between the participants about the listing, if there
+// is one, and starts it otherwise. The returned bool says whether it was started.
+func (m ConversationModel) Start(conv *Conversation) (bool, error) {
+	participants := append([]int64(nil), conv.Participants...)
+	sort.Slice(participants, func(i, j int) bool { return participants[i] < participants[j] })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Two users starting the same conversation at the same moment must end up in the
+	// same one, so starting conversations between the same users is serialized.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('conversations'), hashtext($1))`, pq.Array(participants))
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		SELECT id, created_at
+		FROM conversations
+		WHERE listing_id IS NOT DISTINCT FROM $1
+		AND ARRAY(
+			SELECT user_id FROM conversations_participants
+			WHERE conversation_id = conversations.id
+			ORDER BY user_id
+		) = $2
+		ORDER BY id
+		LIMIT 1`
+
+	err = tx.QueryRowContext(ctx, query, conv.ListingID, pq.Array(participants)).Scan(&conv.ID, &conv.CreatedAt)
+	switch {
+	case err == nil:
+		conv.Participants = participants
+		return false, tx.Commit()
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, err
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO conversations (listing_id) VALUES ($1) RETURNING id, created_at`,
+		conv.ListingID,
+	).Scan(&conv.ID, &conv.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO conversations_participants (conversation_id, user_id) SELECT $1, unnest($2::bigint[])`,
+		conv.ID, pq.Array(participants),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	conv.Participants = participants
+	return true, tx.Commit()
+}
+
+func (m ConversationModel) Select(id int64) (*Conversation, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	query := `
+		SELECT id, listing_id, created_at, ARRAY(
+			SELECT user_id FROM conversations_participants
+			WHERE conversation_id = conversations.id
+			ORDER BY user_id
+		)
+		FROM conversations
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var conv Conversation
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&conv.ID,
+		&conv.ListingID,
+		&conv.CreatedAt,
+		pq.Array(&conv.Participants),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &conv, nil
+}
+
+// SelectAllForUser returns the conversations the user takes part in, with their latest
+// message, the most recently active first.
+func (m ConversationModel) SelectAllForUser(userID int64, filters Filters) ([]*Conversation, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), conversations.id, conversations.listing_id, conversations.created_at,
+			ARRAY(
+				SELECT user_id FROM conversations_participants
+				WHERE conversation_id = conversations.id
+				ORDER BY user_id
+			),
+			last.id, last.sender_id, last.body, last.created_at
+		FROM conversations
+		INNER JOIN conversations_participants ON conversations_participants.conversation_id = conversations.id
+		LEFT JOIN LATERAL (
+			SELECT id, sender_id, body, created_at FROM messages
+			WHERE conversation_id = conversations.id
+			ORDER BY id DESC
+			LIMIT 1
+		) AS last ON true
+		WHERE conversations_participants.user_id = $1
+		ORDER BY COALESCE(last.created_at, conversations.created_at) DESC, conversations.id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	conversations := []*Conversation{}
+	for rows.Next() {
+		var conv Conversation
+		var lastID sql.NullInt64
+		var lastSenderID *int64
+		var lastBody sql.NullString
+		var lastCreatedAt sql.NullTime
+
+		err := rows.Scan(
+			&totalRecords,
+			&conv.ID,
+			&conv.ListingID,
+			&conv.CreatedAt,
+			pq.Array(&conv.Participants),
+			&lastID,
+			&lastSenderID,
+			&lastBody,
+			&lastCreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		if lastID.Valid {
+			conv.LastMessage = &Message{
+				ID:             lastID.Int64,
+				ConversationID: conv.ID,
+				SenderID:       lastSenderID,
+				Body:           lastBody.String,
+				CreatedAt:      lastCreatedAt.Time,
+			}
+		}
+
+		conversations = append(conversations, &conv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return conversations, metadata, nil
+}
+
+// InsertMessage stores the message and tells every instance about it on ChatChannel.
+func (m ConversationModel) InsertMessage(msg *Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO messages (conversation_id, sender_id, body) VALUES ($1, $2, $3) RETURNING id, created_at`,
+		msg.ConversationID, msg.SenderID, msg.Body,
+	).Scan(&msg.ID, &msg.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = notifyChat(ctx, tx, &ChatNotification{Type: ChatMessage, ConversationID: msg.ConversationID, MessageID: msg.ID})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m ConversationModel) SelectMessage(id int64) (*Message, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var msg Message
+	err := m.DB.QueryRowContext(
+		ctx,
+		`SELECT id, conversation_id, sender_id, body, created_at FROM messages WHERE id = $1`,
+		id,
+	).Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.Body, &msg.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &msg, nil
+}
+
+// SelectMessages returns up to limit messages of the conversation, the newest first. If
+// beforeID isn't 0, only messages older than that one are returned, which is how
+// clients page back through the history.
+func (m ConversationModel) SelectMessages(conversationID, beforeID int64, limit int) ([]*Message, error) {
+	query := `
+		SELECT id, conversation_id, sender_id, body, created_at
+		FROM messages
+		WHERE conversation_id = $1 AND (id < $2 OR $2 = 0)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, conversationID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		var msg Message
+		err := rows.Scan(&msg.ID, &msg.ConversationID, &msg.SenderID, &msg.Body, &msg.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Notify sends a typing or presence notification to every instance.
+func (m ConversationModel) Notify(n *ChatNotification) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return notifyChat(ctx, m.DB, n)
+}
+
+func notifyChat(ctx context.Context, db DBTX, n *ChatNotification) error {
+	js, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return pubsub.Notify(ctx, db, ChatChannel, string(js))
+}
@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// An AccountDeletion is a user's request to have their account deleted. Nothing is
+// removed until ScheduledFor, so that a user who changes their mind, or whose account
+// was hijacked, can still cancel.
+type AccountDeletion struct {
+	UserID       int64     `json:"-"`
+	RequestedAt  time.Time `json:"requested_at"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
+
+/* MODEL */
+
+type AccountDeletionModel struct {
+	DB DBTX
+}
+
+// Schedule records the deletion request. Asking again doesn't push back a deletion
+// which is already scheduled.
+func (m AccountDeletionModel) Schedule(userID int64, gracePeriod time.Duration) (*AccountDeletion, error) {
+	query := `
+		INSERT INTO users_deletions (user_id, scheduled_for)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING user_id, requested_at, scheduled_for`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var d AccountDeletion
+	err := m.DB.QueryRowContext(ctx, query, userID, time.Now().Add(gracePeriod)).Scan(
+		&d.UserID,
+		&d.RequestedAt,
+		&d.ScheduledFor,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// Select returns the pending deletion for the user, or ErrNotFoundRecord if there is
+// none.
+func (m AccountDeletionModel) Select(userID int64) (*AccountDeletion, error) {
+	query := `
+		SELECT user_id, requested_at, scheduled_for
+		FROM users_deletions
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var d AccountDeletion
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&d.UserID, &d.RequestedAt, &d.ScheduledFor)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &d, nil
+}
+
+func (m AccountDeletionModel) Cancel(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM users_deletions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// Purge deletes the accounts whose grace period is over, one transaction each, and
+// returns the IDs of the users it deleted. Everything that references the users row
+// goes with it through ON DELETE CASCADE. On top of that purgeUser() removes what only
+// refers to the user indirectly, or outlives the users row: see personalDataQueries.
+func (m AccountDeletionModel) Purge() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT user_id FROM users_deletions WHERE scheduled_for <= NOW() LIMIT 100`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		due = append(due, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deleted := []int64{}
+	for _, id := range due {
+		err := m.purgeUser(id)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+
+	return deleted, nil
+}
+
+// personalDataQueries delete the personal data of user $1 which doesn't go away with
+// the users row by itself. They run before the users row is deleted:
+//
+//   - login throttles, emails waiting to be sent, and bounces and complaints, which are
+//     keyed by the email address. Suppressions stay, so that an address which asked not
+//     to get our email doesn't get it again when somebody signs up with it.
+//   - responses stored for the user's idempotency keys, which have no foreign key
+//     because anonymous requests share the user ID 0.
+//   - the user's messages, which would otherwise stay with a NULL sender, and the
+//     notifications and emails which quote them to the other participants.
+//   - domain events and webhook deliveries with the user, their listings or their
+//     messages in them.
+//   - organizations in which the user was the last member.
+var personalDataQueries = []string{
+	`DELETE FROM login_throttles
+	WHERE subject = (SELECT 'email:' || lower(email) FROM users WHERE id = $1)`,
+	`DELETE FROM email_outbox WHERE recipient = (SELECT email FROM users WHERE id = $1)`,
+	`DELETE FROM email_events WHERE email = (SELECT email FROM users WHERE id = $1)`,
+	`DELETE FROM idempotency_keys WHERE user_id = $1`,
+	`DELETE FROM notifications
+	WHERE type = 'new_message'
+	AND data->>'messageID' IN (SELECT id::text FROM messages WHERE sender_id = $1)`,
+	`DELETE FROM email_outbox
+	WHERE data->>'messageID' IN (SELECT id::text FROM messages WHERE sender_id = $1)`,
+	`DELETE FROM messages WHERE sender_id = $1`,
+	`DELETE FROM domain_events WHERE ` + eventDataOfUser("type", "data"),
+	`DELETE FROM webhooks_deliveries WHERE ` + eventDataOfUser("event_type", "payload"),
+	`DELETE FROM organizations
+	WHERE id IN (SELECT organization_id FROM organizations_members WHERE user_id = $1)
+	AND NOT EXISTS (
+		SELECT 1 FROM organizations_members
+		WHERE organizations_members.organization_id = organizations.id
+		AND organizations_members.user_id <> $1
+	)`,
+}
+
+// eventDataOfUser() returns the condition under which the data of an event, with the
+// type and data in the given columns, is about user $1 or their listings or messages.
+func eventDataOfUser(typeColumn, dataColumn string) string {
+	return fmt.Sprintf(`(
+		(%[1]s IN ('%[3]s', '%[4]s') AND %[2]s->>'id' = $1::text)
+		OR (%[1]s IN ('%[5]s', '%[6]s') AND %[2]s->>'seller_id' = $1::text)
+		OR (%[1]s = '%[7]s' AND %[2]s->>'sender_id' = $1::text)
+	)`, typeColumn, dataColumn,
+		EventUserRegistered, EventUserActivated,
+		EventListingCreated, EventListingUpdated,
+		EventMessageSent)
+}
+
+func (m AccountDeletionModel) purgeUser(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range personalDataQueries {
+		_, err = tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The user's listings go too, except those of organizations which are still
+	// around, and downstream systems are told so that they drop their copies.
+	rows, err := tx.QueryContext(
+		ctx,
+		`DELETE FROM listings WHERE user_id = $1 AND organization_id IS NULL RETURNING id`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	var listings []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		listings = append(listings, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	events := EventModel{DB: tx}
+	for _, id := range listings {
+		err = events.Record(EventListingDeleted, map[string]int64{"id": id})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,280 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"letsgofurther/internal/pubsub"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// EventsChannel is the Postgres NOTIFY channel on which every instance hears about
+// recorded events, which wakes the dispatchers up. The payload is the event's ID and
+// type, separated by a space. Being sent from the recording transaction, the
+// notification only goes out if the transaction commits.
+const EventsChannel = "domain_events"
+
+// The domain events. The data of the listing, user and message events is the listing,
+// user or message as the API returns it, except for listing.deleted, whose data only
+// holds the ID.
+const (
+	EventUserRegistered = "user.registered"
+	EventUserActivated  = "user.activated"
+	EventListingCreated = "listing.created"
+	EventListingUpdated = "listing.updated"
+	EventListingDeleted = "listing.deleted"
+	EventMessageSent    = "message.sent"
+)
+
+// An Event is something that happened, recorded in the transaction which made it
+// happen.
+type Event struct {
+	ID        int64
+	Type      string
+	Data      json.RawMessage
+	Attempts  int
+	CreatedAt time.Time
+}
+
+/* MODEL */
+
+type EventModel struct {
+	DB DBTX
+}
+
+// Record writes the event to the outbox. It is meant to be called on the models of a
+// unit of work, see Models.Transaction, so that the event is recorded together with the
+// change it describes.
+func (m EventModel) Record(eventType string, data any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+	err = m.DB.QueryRowContext(ctx, `INSERT INTO domain_events (type, data) VALUES ($1, $2) RETURNING id`, eventType, js).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	return pubsub.Notify(ctx, m.DB, EventsChannel, formatEventNotification(id, eventType))
+}
+
+// formatEventNotification returns the payload of the notification on EventsChannel
+// for an event: its ID and type, separated by a space.
+func formatEventNotification(id int64, eventType string) string {
+	return strconv.FormatInt(id, 10) + " " + eventType
+}
+
+// ParseEventNotification returns the event ID and type from the payload of a
+// notification on EventsChannel.
+func ParseEventNotification(payload string) (int64, string, bool) {
+	idStr, eventType, ok := strings.Cut(payload, " ")
+	if !ok || eventType == "" {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id < 1 {
+		return 0, "", false
+	}
+	return id, eventType, true
+}
+
+// Select returns the event, whether dispatched or not.
+func (m EventModel) Select(id int64) (*Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var event Event
+	err := m.DB.QueryRowContext(
+		ctx,
+		`SELECT id, type, data, attempts, created_at FROM domain_events WHERE id = $1`,
+		id,
+	).Scan(&event.ID, &event.Type, &event.Data, &event.Attempts, &event.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &event, nil
+}
+
+// SelectSince returns up to limit events of the given types recorded after the event
+// with the given ID, oldest first.
+func (m EventModel) SelectSince(afterID int64, types []string, limit int) ([]*Event, error) {
+	query := `
+		SELECT id, type, data, attempts, created_at
+		FROM domain_events
+		WHERE id > $1 AND type = ANY($2)
+		ORDER BY id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, afterID, pq.Array(types), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		var event Event
+		err := rows.Scan(&event.ID, &event.Type, &event.Data, &event.Attempts, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Claim takes the oldest event which is due for dispatching, if any, and returns
+// ErrNotFoundRecord if none is. It works like EmailOutboxModel.Claim.
+func (m EventModel) Claim(lease time.Duration) (*Event, error) {
+	query := `
+		UPDATE domain_events
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * interval '1 millisecond'
+		WHERE id = (
+			SELECT id FROM domain_events
+			WHERE dispatched_at IS NULL AND dead_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, type, data, attempts, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var event Event
+	err := m.DB.QueryRowContext(ctx, query, lease.Milliseconds()).Scan(
+		&event.ID,
+		&event.Type,
+		&event.Data,
+		&event.Attempts,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &event, nil
+}
+
+// MarkDispatched records that every subscriber has handled the event. Dispatched
+// events are kept, as a log of what happened.
+func (m EventModel) MarkDispatched(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE domain_events SET dispatched_at = NOW(), last_error = '' WHERE id = $1`, id)
+	return err
+}
+
+// Retry records a failed dispatch and when to try again.
+func (m EventModel) Retry(id int64, lastError string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE domain_events SET last_error = $2, next_attempt_at = $3 WHERE id = $1`,
+		id, lastError, at,
+	)
+	return err
+}
+
+// DeadLetter records the last failed dispatch and gives up on the event.
+func (m EventModel) DeadLetter(id int64, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE domain_events SET last_error = $2, dead_at = NOW() WHERE id = $1`,
+		id, lastError,
+	)
+	return err
+}
+
+/* BUS */
+
+// An EventHandler reacts to an event. Events are delivered at least once: when any
+// handler fails, all of them get the event again later, so handlers have to cope with
+// seeing an event twice.
+type EventHandler func(event *Event) error
+
+// EventBus fans events out to the in-process handlers subscribed to their type.
+type EventBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]EventHandler
+	wake     chan struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		handlers: make(map[string][]EventHandler),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (b *EventBus) Subscribe(eventType string, fn EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[eventType] = append(b.handlers[eventType], fn)
+}
+
+// Publish hands the event to every handler subscribed to its type, and returns their
+// errors joined together. Events nobody subscribed to are simply dropped.
+func (b *EventBus) Publish(event *Event) error {
+	b.mu.RLock()
+	handlers := b.handlers[event.Type]
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, fn := range handlers {
+		err := fn(event)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Wake tells a waiting dispatcher that there are new events. It never blocks.
+func (b *EventBus) Wake() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Woken returns the channel Wake sends on.
+func (b *EventBus) Woken() <-chan struct{} {
+	return b.wake
+}
@@ -0,0 +1,41 @@
+package data
+
+import "testing"
+
+func TestParseEventNotification(t *testing.T) {
+	tests := []struct {
+		payload   string
+		wantID    int64
+		wantType  string
+		wantValid bool
+	}{
+		{"42 listing.created", 42, EventListingCreated, true},
+		{"1 user.registered", 1, EventUserRegistered, true},
+		{"42", 0, "", false},
+		{"42 ", 0, "", false},
+		{" listing.created", 0, "", false},
+		{"x listing.created", 0, "", false},
+		{"0 listing.created", 0, "", false},
+		{"-3 listing.created", 0, "", false},
+		{"99999999999999999999 listing.created", 0, "", false},
+		{"", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		id, eventType, ok := ParseEventNotification(tt.payload)
+		if id != tt.wantID || eventType != tt.wantType || ok != tt.wantValid {
+			t.Errorf("ParseEventNotification(%q) = %d, %q, %t; want %d, %q, %t",
+				tt.payload, id, eventType, ok, tt.wantID, tt.wantType, tt.wantValid)
+		}
+	}
+}
+
+// What Record() sends is what the listeners parse.
+func TestEventNotificationRoundTrip(t *testing.T) {
+	for _, eventType := range []string{EventListingCreated, EventListingDeleted, EventMessageSent} {
+		id, got, ok := ParseEventNotification(formatEventNotification(1234, eventType))
+		if !ok || id != 1234 || got != eventType {
+			t.Errorf("got %d, %q, %t; want 1234, %q, true", id, got, ok, eventType)
+		}
+	}
+}
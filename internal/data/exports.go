@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/* MODEL */
+
+// DataExportModel stores the ZIP archives built for users exercising their right of
+// access. An archive can be downloaded with its ScopeDataExport token until the token
+// expires.
+type DataExportModel struct {
+	DB DBTX
+}
+
+// Insert stores the archive and returns the token for its download link.
+func (m DataExportModel) Insert(userID int64, archive []byte, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeDataExport)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`,
+		token.Hash, token.UserID, token.Expiry, token.Scope,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO data_exports (token_hash, user_id, archive) VALUES ($1, $2, $3)`,
+		token.Hash, userID, archive,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+// SelectArchive returns the archive for a download token, or ErrNotFoundRecord if the
+// token is unknown or has expired.
+func (m DataExportModel) SelectArchive(tokenPlaintext string) ([]byte, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT data_exports.archive
+		FROM data_exports
+		INNER JOIN tokens ON tokens.hash = data_exports.token_hash
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var archive []byte
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeDataExport, time.Now()).Scan(&archive)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return archive, nil
+}
+
+// RequestedSince reports whether the user has had an export built after the given
+// time. It is used to stop users from requesting one export after another.
+func (m DataExportModel) RequestedSince(userID int64, since time.Time) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM data_exports WHERE user_id = $1 AND created_at > $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, userID, since).Scan(&exists)
+	return exists, err
+}
+
+// DeleteExpired removes archives whose download link has expired, along with their
+// tokens.
+func (m DataExportModel) DeleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND expiry <= NOW()`, ScopeDataExport)
+	return err
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// An IdempotentResponse is the response to the first request made with an idempotency
+// key, and a hash of that request, so that a retry can be told from a different
+// request reusing the key. Its Status is 0 while the first request is still running.
+type IdempotentResponse struct {
+	RequestHash []byte
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+}
+
+/* MODEL */
+
+type IdempotencyModel struct {
+	DB DBTX
+}
+
+// Claim reserves the user's idempotency key for the request with the given hash, for
+// the ttl. It returns nil if the request should run, and otherwise what is stored for
+// the key, which may belong to a different request. A key whose request is still
+// running after the lease is taken to belong to a request which died, and is given to
+// the new request.
+func (m IdempotencyModel) Claim(userID int64, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotentResponse, error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4 * interval '1 second')
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, header = '{}', body = '',
+			created_at = NOW(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= NOW()
+		OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at <= NOW() - $5 * interval '1 second')
+		RETURNING true`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var claimed bool
+	err := m.DB.QueryRowContext(ctx, query, userID, key, requestHash, ttl.Seconds(), lease.Seconds()).Scan(&claimed)
+	switch {
+	case err == nil:
+		return nil, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	query = `
+		SELECT request_hash, COALESCE(status, 0), header, body
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	var resp IdempotentResponse
+	var header []byte
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(&resp.RequestHash, &resp.Status, &header, &resp.Body)
+	if err != nil {
+		switch {
+		// The key was released between the two queries. The client can try again.
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(header, &resp.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// Complete stores the response to the request which claimed the key.
+func (m IdempotencyModel) Complete(userID int64, key string, resp *IdempotentResponse) error {
+	header, err := json.Marshal(resp.Header)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(
+		ctx,
+		`UPDATE idempotency_keys SET status = $3, header = $4, body = $5 WHERE user_id = $1 AND key = $2`,
+		userID, key, resp.Status, string(header), resp.Body,
+	)
+	return err
+}
+
+// Release gives up the claim on a key whose request didn't get a response worth
+// keeping, so that it can be retried.
+func (m IdempotencyModel) Release(userID int64, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status IS NULL`,
+		userID, key,
+	)
+	return err
+}
+
+func (m IdempotencyModel) DeleteExpired() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	return err
+}
@@ -0,0 +1,179 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// An Identity links a user to an account at an external OpenID Connect provider. The
+// provider's subject identifier is stable, unlike the email address, so it is what
+// returning users are matched on.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"-"`
+	UserID    int64     `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// An OIDCAuthRequest holds the secrets generated when a social login starts, until
+// the provider redirects back to us. The state is only stored as a hash since it
+// travels through the user's browser.
+type OIDCAuthRequest struct {
+	Provider     string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+/* MODEL */
+
+type IdentityModel struct {
+	DB DBTX
+}
+
+func (m IdentityModel) InsertAuthRequest(ar *OIDCAuthRequest) error {
+	stateHash := sha256.Sum256([]byte(ar.State))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`INSERT INTO oidc_auth_requests (state_hash, provider, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4, $5)`,
+		stateHash[:], ar.Provider, ar.Nonce, ar.CodeVerifier, ar.Expiry,
+	)
+	return err
+}
+
+// ConsumeAuthRequest deletes and returns the pending request for the given state, so
+// that every state value can only be used once. Unknown, expired states and states
+// that were issued for a different provider return ErrNotFoundRecord.
+func (m IdentityModel) ConsumeAuthRequest(provider, state string) (*OIDCAuthRequest, error) {
+	stateHash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ar := OIDCAuthRequest{State: state}
+
+	err := m.DB.QueryRowContext(
+		ctx,
+		`DELETE FROM oidc_auth_requests
+		WHERE state_hash = $1
+		RETURNING provider, nonce, code_verifier, expiry`,
+		stateHash[:],
+	).Scan(&ar.Provider, &ar.Nonce, &ar.CodeVerifier, &ar.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	if ar.Provider != provider || time.Now().After(ar.Expiry) {
+		return nil, ErrNotFoundRecord
+	}
+
+	return &ar, nil
+}
+
+// DeleteExpiredAuthRequests removes abandoned logins.
+func (m IdentityModel) DeleteExpiredAuthRequests() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_auth_requests WHERE expiry < NOW()`)
+	return err
+}
+
+// SelectUser returns the user linked to the given provider account.
+func (m IdentityModel) SelectUser(provider, subject string) (*User, error) {
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(
+		ctx,
+		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version
+		FROM users
+		INNER JOIN users_identities
+		ON users.id = users_identities.user_id
+		WHERE users_identities.provider = $1
+		AND users_identities.subject = $2`,
+		provider, subject,
+	).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m IdentityModel) Insert(identity *Identity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO users_identities (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email,
+	).Scan(&identity.CreatedAt)
+}
+
+// SelectAllForUser returns the provider accounts linked to the user.
+func (m IdentityModel) SelectAllForUser(userID int64) ([]*Identity, error) {
+	query := `
+		SELECT provider, subject, user_id, email, created_at
+		FROM users_identities
+		WHERE user_id = $1
+		ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The states of an import. An import is processing while its rows are being imported,
+// and failed if the upload couldn't be read to the end; the batches read until then are
+// imported nonetheless.
+const (
+	ImportProcessing = "processing"
+	ImportCompleted  = "completed"
+	ImportFailed     = "failed"
+)
+
+// The formats listings can be imported from.
+const (
+	ImportFormatCSV    = "csv"
+	ImportFormatNDJSON = "ndjson"
+)
+
+type Import struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"-"`
+	Format string `json:"format"`
+	Status string `json:"status"`
+	// How many rows were read so far, and what became of them.
+	Rows      int    `json:"rows"`
+	Inserted  int    `json:"inserted"`
+	Updated   int    `json:"updated"`
+	Unchanged int    `json:"unchanged"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+	// The rejected rows, a page at a time.
+	RowErrors  []*ImportRowError `json:"errors,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+}
+
+// An ImportRowError says why a row was rejected. Rows are numbered from 1, not counting
+// the header line of a CSV file.
+type ImportRowError struct {
+	Row         int               `json:"row"`
+	ExternalRef string            `json:"external_ref,omitempty"`
+	Errors      map[string]string `json:"errors"`
+}
+
+/* MODEL */
+
+type ImportModel struct {
+	DB DBTX
+}
+
+func (m ImportModel) Insert(imp *Import) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO imports (user_id, format) VALUES ($1, $2) RETURNING id, status, created_at`,
+		imp.UserID, imp.Format,
+	).Scan(&imp.ID, &imp.Status, &imp.CreatedAt)
+}
+
+// Select returns the user's import, without its row errors.
+func (m ImportModel) Select(id, userID int64) (*Import, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	query := `
+		SELECT id, user_id, format, status, rows_read, inserted, updated, unchanged, failed, error,
+			created_at, finished_at
+		FROM imports
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var imp Import
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&imp.ID,
+		&imp.UserID,
+		&imp.Format,
+		&imp.Status,
+		&imp.Rows,
+		&imp.Inserted,
+		&imp.Updated,
+		&imp.Unchanged,
+		&imp.Failed,
+		&imp.Error,
+		&imp.CreatedAt,
+		&imp.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &imp, nil
+}
+
+// UpdateProgress stores the import's counters and status, and when it finished if it
+// did.
+func (m ImportModel) UpdateProgress(imp *Import) error {
+	query := `
+		UPDATE imports
+		SET status = $2, rows_read = $3, inserted = $4, updated = $5, unchanged = $6, failed = $7, error = $8,
+			finished_at = CASE WHEN $2 = 'processing' THEN NULL ELSE NOW() END
+		WHERE id = $1
+		RETURNING finished_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(
+		ctx,
+		query,
+		imp.ID, imp.Status, imp.Rows, imp.Inserted, imp.Updated, imp.Unchanged, imp.Failed, imp.Error,
+	).Scan(&imp.FinishedAt)
+}
+
+// InsertErrors records rejected rows of the import.
+func (m ImportModel) InsertErrors(importID int64, rowErrors []*ImportRowError) error {
+	if len(rowErrors) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("imports_errors", "import_id", "row_number", "external_ref", "errors"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rowError := range rowErrors {
+		js, err := json.Marshal(rowError.Errors)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, importID, rowError.Row, rowError.ExternalRef, string(js))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SelectErrors returns the rejected rows of the import, in the order of the upload.
+func (m ImportModel) SelectErrors(importID int64, filters Filters) ([]*ImportRowError, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), row_number, external_ref, errors
+		FROM imports_errors
+		WHERE import_id = $1
+		ORDER BY row_number
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, importID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	rowErrors := []*ImportRowError{}
+	for rows.Next() {
+		var rowError ImportRowError
+		var js []byte
+
+		err := rows.Scan(&totalRecords, &rowError.Row, &rowError.ExternalRef, &js)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(js, &rowError.Errors)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		rowErrors = append(rowErrors, &rowError)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return rowErrors, metadata, nil
+}
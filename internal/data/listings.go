@@ -12,16 +12,31 @@ import (
 )
 
 type Listing struct {
-	ID          int64     `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Categories  []string  `json:"categories"`
-	Price       int64     `json:"price"`
+	ID          int64    `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Categories  []string `json:"categories"`
+	Price       int64    `json:"price"`
+	// Set when the listing belongs to an organization rather than an individual.
+	OrganizationID *int64 `json:"organization_id,omitempty"`
+	// The user who created the listing. Listings from before sellers were recorded
+	// don't have one.
+	SellerID     *int64  `json:"seller_id,omitempty"`
+	SellerRating *Rating `json:"seller_rating,omitempty"`
+	// The seller's own reference for a listing imported from their inventory system.
+	ExternalRef *string   `json:"external_ref,omitempty"`
+	Status      string    `json:"status"`
+	BuyerID     *int64    `json:"-"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	Version     int32     `json:"version"`
 }
 
+const (
+	ListingActive = "active"
+	ListingSold   = "sold"
+)
+
 func ValidateListing(v *validator.Validator, listing *Listing) {
 	v.Check(listing.Title != "", "title", "must be provided")
 	v.Check(len(listing.Title) <= 500, "title", "must not be more than 500 bytes long")
@@ -38,11 +53,17 @@ func ValidateListing(v *validator.Validator, listing *Listing) {
 	v.Check(validator.Unique(listing.Categories), "categories", "must not contain duplicate values")
 }
 
+// ValidateExternalRef checks the reference an imported listing must carry.
+func ValidateExternalRef(v *validator.Validator, ref string) {
+	v.Check(ref != "", "external_ref", "must be provided")
+	v.Check(len(ref) <= 100, "external_ref", "must not be more than 100 bytes long")
+}
+
 /* MODEL */
 
 // Define a Listings Model struct type which wraps a sql.DB connection pool.
 type ListingModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 /* INSERT ONE */
@@ -51,17 +72,21 @@ func (lm ListingModel) Insert(listing *Listing) error {
 	defer cancel()
 	rows := lm.DB.QueryRowContext(
 		ctx,
-		`INSERT INTO listings (title, description, price, categories) VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`,
+		`INSERT INTO listings (title, description, price, categories, organization_id, user_id) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, status, created_at, updated_at, version`,
 		listing.Title,
 		listing.Description,
 		listing.Price,
 		pq.Array(listing.Categories),
+		listing.OrganizationID,
+		listing.SellerID,
 	)
 
 	err := rows.Scan(
 		&listing.ID,
+		&listing.Status,
 		&listing.CreatedAt,
+		&listing.UpdatedAt,
 		&listing.Version,
 	)
 	if err != nil {
@@ -81,10 +106,13 @@ func (lm ListingModel) Select(id int64) (*Listing, error) {
 	defer cancel()
 
 	var lis Listing
+	var rating Rating
 	rows := lm.DB.QueryRowContext(
 		ctx,
-		`SELECT id, title, description, price, categories, created_at, updated_at, version
+		`SELECT id, title, description, price, categories, organization_id, user_id, external_ref, status, buyer_id,
+			seller_rating.average, seller_rating.count, created_at, updated_at, version
 		FROM listings
+		`+sellerRatingJoin+`
 		WHERE id = $1;`,
 		id,
 	)
@@ -95,6 +123,13 @@ func (lm ListingModel) Select(id int64) (*Listing, error) {
 		&lis.Description,
 		&lis.Price,
 		pq.Array(&lis.Categories),
+		&lis.OrganizationID,
+		&lis.SellerID,
+		&lis.ExternalRef,
+		&lis.Status,
+		&lis.BuyerID,
+		&rating.Average,
+		&rating.Count,
 		&lis.CreatedAt,
 		&lis.UpdatedAt,
 		&lis.Version,
@@ -109,6 +144,10 @@ func (lm ListingModel) Select(id int64) (*Listing, error) {
 		}
 	}
 
+	if lis.SellerID != nil {
+		lis.SellerRating = &rating
+	}
+
 	return &lis, nil
 }
 
@@ -120,9 +159,9 @@ func (lm ListingModel) Update(listing *Listing) error {
 	rows := lm.DB.QueryRowContext(
 		ctx,
 		`UPDATE listings 
-		SET title = $1, description = $2, price = $3, categories = $4, version = version + 1
+		SET title = $1, description = $2, price = $3, categories = $4, updated_at = NOW(), version = version + 1
 		WHERE id = $5 AND version = $6
-		RETURNING version;`,
+		RETURNING updated_at, version;`,
 		listing.Title,
 		listing.Description,
 		listing.Price,
@@ -132,6 +171,7 @@ func (lm ListingModel) Update(listing *Listing) error {
 	)
 
 	err := rows.Scan(
+		&listing.UpdatedAt,
 		&listing.Version,
 	)
 	if err != nil {
@@ -145,8 +185,71 @@ func (lm ListingModel) Update(listing *Listing) error {
 	return nil
 }
 
+// OfferSale records that the seller sold the listing to the buyer, which the buyer has
+// to confirm with AcceptSale before the listing counts as sold. A later offer replaces
+// an earlier one. Only active listings can be sold; ErrEditConflict is returned if it
+// was sold already or changed in the meantime.
+func (lm ListingModel) OfferSale(listing *Listing, buyerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := lm.DB.QueryRowContext(
+		ctx,
+		`UPDATE listings
+		SET pending_buyer_id = $1, sale_offered_at = NOW(), updated_at = NOW(), version = version + 1
+		WHERE id = $2 AND version = $3 AND status = $4
+		RETURNING updated_at, version`,
+		buyerID,
+		listing.ID,
+		listing.Version,
+		ListingActive,
+	).Scan(&listing.UpdatedAt, &listing.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AcceptSale marks the listing as sold to the buyer, if the seller offered it to them.
+// ErrNotFoundRecord is returned if there is no such offer for an active listing.
+func (lm ListingModel) AcceptSale(listing *Listing, buyerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := lm.DB.QueryRowContext(
+		ctx,
+		`UPDATE listings
+		SET status = $1, buyer_id = pending_buyer_id, sold_at = NOW(), updated_at = NOW(), version = version + 1,
+			pending_buyer_id = NULL, sale_offered_at = NULL
+		WHERE id = $2 AND pending_buyer_id = $3 AND status = $4
+		RETURNING status, buyer_id, updated_at, version`,
+		ListingSold,
+		listing.ID,
+		buyerID,
+		ListingActive,
+	).Scan(&listing.Status, &listing.BuyerID, &listing.UpdatedAt, &listing.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotFoundRecord
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
 /* DELETE ONE */
-func (lm ListingModel) Delete(id int64) error {
+// Delete deletes the listing if it is still at the given version, like Update() only
+// changes it then, and returns ErrEditConflict otherwise.
+func (lm ListingModel) Delete(id int64, version int32) error {
 	if id < 1 {
 		return ErrNotFoundRecord
 	}
@@ -157,8 +260,9 @@ func (lm ListingModel) Delete(id int64) error {
 	res, err := lm.DB.ExecContext(
 		ctx,
 		`DELETE FROM listings 
-		WHERE id = $1;`,
+		WHERE id = $1 AND version = $2;`,
 		id,
+		version,
 	)
 	if err != nil {
 		return err
@@ -169,23 +273,40 @@ func (lm ListingModel) Delete(id int64) error {
 		return err
 	}
 	if rowsnum < 1 {
-		return ErrNotFoundRecord
+		return ErrEditConflict
 	}
 	return nil
 }
 
 /* SELECT ALL */
-func (ml ListingModel) SelectAll(title string, categories []string, filters Filters) ([]*Listing, Metadata, error) {
+// Listings from users the viewer has blocked or muted, or who blocked the viewer, are
+// left out. The viewer ID is 0 for anonymous requests.
+func (ml ListingModel) SelectAll(title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error) {
+	return ml.selectAll(title, categories, 0, viewerID, filters)
+}
+
+// SelectAllForOrganization() works like SelectAll(), but only returns the listings
+// which belong to the given organization.
+func (ml ListingModel) SelectAllForOrganization(orgID int64, title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error) {
+	return ml.selectAll(title, categories, orgID, viewerID, filters)
+}
+
+// An orgID of 0 means listings of any owner.
+func (ml ListingModel) selectAll(title string, categories []string, orgID, viewerID int64, filters Filters) ([]*Listing, Metadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	rows, err := ml.DB.QueryContext(
 		ctx,
 		fmt.Sprintf(
-			`SELECT count(*) OVER(), id, title, description, price, categories, created_at, version
+			`SELECT count(*) OVER(), id, title, description, price, categories, organization_id, user_id, external_ref, status,
+				seller_rating.average, seller_rating.count, created_at, updated_at, version
 			FROM listings
+			`+sellerRatingJoin+`
 			WHERE (to_tsvector('german', title) @@ plainto_tsquery('german', $1) OR $1 = '')
 			AND (categories @> $2 OR $2 = '{}')
+			AND (organization_id = $5 OR $5 = 0)
+			AND `+listingsVisibleTo("$6")+`
 			ORDER BY %s %s, id DESC
 			LIMIT $3 OFFSET $4;`, filters.sortColumn(), filters.sortDirection(),
 		),
@@ -193,6 +314,8 @@ func (ml ListingModel) SelectAll(title string, categories []string, filters Filt
 		pq.Array(categories),
 		filters.limit(),
 		filters.offset(),
+		orgID,
+		viewerID,
 	)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -203,6 +326,7 @@ func (ml ListingModel) SelectAll(title string, categories []string, filters Filt
 	listings := []*Listing{} // equals to empty slice; if we do var listings []*Listing then we'll get nil
 	for rows.Next() {
 		var listing Listing
+		var rating Rating
 		err := rows.Scan(
 			&totalRecords,
 			&listing.ID,
@@ -210,12 +334,22 @@ func (ml ListingModel) SelectAll(title string, categories []string, filters Filt
 			&listing.Description,
 			&listing.Price,
 			pq.Array(&listing.Categories),
+			&listing.OrganizationID,
+			&listing.SellerID,
+			&listing.ExternalRef,
+			&listing.Status,
+			&rating.Average,
+			&rating.Count,
 			&listing.CreatedAt,
+			&listing.UpdatedAt,
 			&listing.Version,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		if listing.SellerID != nil {
+			listing.SellerRating = &rating
+		}
 		listings = append(listings, &listing)
 	}
 
@@ -227,6 +361,385 @@ func (ml ListingModel) SelectAll(title string, categories []string, filters Filt
 	return listings, metadata, nil
 }
 
+/* SELECT ALL FOR USER */
+// SelectAllForUser returns the listings the user sells or bought, whatever their
+// status, the newest first. Unlike the other queries it includes the buyer, since it is
+// meant for the user's own data export.
+func (ml ListingModel) SelectAllForUser(userID int64) ([]*Listing, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := ml.DB.QueryContext(
+		ctx,
+		`SELECT id, title, description, price, categories, organization_id, user_id, external_ref, status, buyer_id,
+			seller_rating.average, seller_rating.count, created_at, updated_at, version
+		FROM listings
+		`+sellerRatingJoin+`
+		WHERE user_id = $1 OR buyer_id = $1
+		ORDER BY id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	listings := []*Listing{}
+	for rows.Next() {
+		var listing Listing
+		var rating Rating
+		err := rows.Scan(
+			&listing.ID,
+			&listing.Title,
+			&listing.Description,
+			&listing.Price,
+			pq.Array(&listing.Categories),
+			&listing.OrganizationID,
+			&listing.SellerID,
+			&listing.ExternalRef,
+			&listing.Status,
+			&listing.BuyerID,
+			&rating.Average,
+			&rating.Count,
+			&listing.CreatedAt,
+			&listing.UpdatedAt,
+			&listing.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if listing.SellerID != nil {
+			listing.SellerRating = &rating
+		}
+		listings = append(listings, &listing)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return listings, nil
+}
+
+/* EXPORT */
+// Export calls fn with every listing SelectAll() would return on any page, in the same
+// order, and stops at the first error fn returns. There can be any number of listings,
+// so rather than loading them all they are read through a server-side cursor, a batch
+// at a time. The cursor needs a transaction, which holds on to a connection of the pool
+// until the export is done; fn should thus not take long.
+func (ml ListingModel) Export(title string, categories []string, viewerID int64, filters Filters, fn func(listing *Listing) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	tx, err := beginTx(ctx, ml.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			`DECLARE listings_export NO SCROLL CURSOR FOR
+			SELECT id, title, description, price, categories, organization_id, user_id, external_ref, status,
+				seller_rating.average, seller_rating.count, created_at, updated_at, version
+			FROM listings
+			`+sellerRatingJoin+`
+			WHERE (to_tsvector('german', title) @@ plainto_tsquery('german', $1) OR $1 = '')
+			AND (categories @> $2 OR $2 = '{}')
+			AND `+listingsVisibleTo("$3")+`
+			ORDER BY %s %s, id DESC`, filters.sortColumn(), filters.sortDirection(),
+		),
+		title,
+		pq.Array(categories),
+		viewerID,
+	)
+	if err != nil {
+		return err
+	}
+
+	for {
+		batch, err := fetchListings(ctx, tx, 500)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		// The batch is read to the end before fn sees it, since the connection can't
+		// be used for anything else while rows are being read.
+		for _, listing := range batch {
+			err = fn(listing)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `CLOSE listings_export`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// fetchListings() reads up to n listings from the export cursor.
+func fetchListings(ctx context.Context, tx *modelTx, n int) ([]*Listing, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`FETCH FORWARD %d FROM listings_export`, n))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	listings := []*Listing{}
+	for rows.Next() {
+		var listing Listing
+		var rating Rating
+		err := rows.Scan(
+			&listing.ID,
+			&listing.Title,
+			&listing.Description,
+			&listing.Price,
+			pq.Array(&listing.Categories),
+			&listing.OrganizationID,
+			&listing.SellerID,
+			&listing.ExternalRef,
+			&listing.Status,
+			&rating.Average,
+			&rating.Count,
+			&listing.CreatedAt,
+			&listing.UpdatedAt,
+			&listing.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if listing.SellerID != nil {
+			listing.SellerRating = &rating
+		}
+		listings = append(listings, &listing)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return listings, nil
+}
+
+/* IMPORT */
+// Import creates the seller's listings, or updates those with the same external
+// reference, and returns the listings it created and those it updated, and the
+// external references of the listings it left alone because they are sold. Listings
+// which are unchanged are left alone too, so that importing the same data twice
+// changes nothing. Every listing must have an external reference, which must not
+// appear twice.
+//
+// The listings are copied into a temporary table with COPY, which is much faster than
+// inserting them one by one, and merged into the listings from there.
+func (lm ListingModel) Import(sellerID int64, listings []*Listing) ([]*Listing, []*Listing, []string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, lm.DB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TEMPORARY TABLE IF NOT EXISTS listings_import (
+			external_ref text NOT NULL,
+			title text NOT NULL,
+			description text NOT NULL,
+			price bigint NOT NULL,
+			categories text[] NOT NULL
+		) ON COMMIT DROP`)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = tx.ExecContext(ctx, `TRUNCATE listings_import`)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("listings_import", "external_ref", "title", "description", "price", "categories"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, listing := range listings {
+		_, err = stmt.ExecContext(ctx, listing.ExternalRef, listing.Title, listing.Description, listing.Price, pq.Array(listing.Categories))
+		if err != nil {
+			stmt.Close()
+			return nil, nil, nil, err
+		}
+	}
+	// Executing the statement without arguments flushes the copied rows.
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		stmt.Close()
+		return nil, nil, nil, err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// A sold listing belongs to the deal, which the seller can't change any more. The
+	// sold listings are locked, so that they can't be sold between this query and the
+	// next.
+	rows, err := tx.QueryContext(ctx, `
+		SELECT external_ref FROM listings
+		WHERE user_id = $1 AND status = 'sold'
+		AND external_ref IN (SELECT external_ref FROM listings_import)
+		FOR UPDATE`,
+		sellerID,
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sold := []string{}
+	for rows.Next() {
+		var ref string
+		err := rows.Scan(&ref)
+		if err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		sold = append(sold, ref)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return nil, nil, nil, err
+	}
+	rows.Close()
+
+	// xmax is 0 for a freshly inserted row, which tells the created listings apart
+	// from the updated ones.
+	rows, err = tx.QueryContext(ctx, `
+		INSERT INTO listings (title, description, price, categories, user_id, external_ref)
+		SELECT title, description, price, categories, $1, external_ref FROM listings_import
+		ON CONFLICT (user_id, external_ref) DO UPDATE
+		SET title = EXCLUDED.title, description = EXCLUDED.description, price = EXCLUDED.price,
+			categories = EXCLUDED.categories, updated_at = NOW(), version = listings.version + 1
+		WHERE listings.status <> 'sold'
+		AND (listings.title, listings.description, listings.price, listings.categories)
+			IS DISTINCT FROM (EXCLUDED.title, EXCLUDED.description, EXCLUDED.price, EXCLUDED.categories)
+		RETURNING id, title, description, price, categories, organization_id, user_id, external_ref, status,
+			created_at, updated_at, version, xmax = 0`,
+		sellerID,
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	created := []*Listing{}
+	updated := []*Listing{}
+	for rows.Next() {
+		var listing Listing
+		var inserted bool
+		err := rows.Scan(
+			&listing.ID,
+			&listing.Title,
+			&listing.Description,
+			&listing.Price,
+			pq.Array(&listing.Categories),
+			&listing.OrganizationID,
+			&listing.SellerID,
+			&listing.ExternalRef,
+			&listing.Status,
+			&listing.CreatedAt,
+			&listing.UpdatedAt,
+			&listing.Version,
+			&inserted,
+		)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if inserted {
+			created = append(created, &listing)
+		} else {
+			updated = append(updated, &listing)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	rows.Close()
+
+	return created, updated, sold, tx.Commit()
+}
+
+// MatchTitle reports which of the title queries match the title, in the same way as
+// the title filter of SelectAll. It lets the listing stream filter events with one
+// query for all of its clients.
+func (ml ListingModel) MatchTitle(title string, queries []string) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := ml.DB.QueryContext(
+		ctx,
+		`SELECT q FROM unnest($2::text[]) AS q
+		WHERE to_tsvector('german', $1) @@ plainto_tsquery('german', q) OR q = ''`,
+		title, pq.Array(queries),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make(map[string]bool)
+	for rows.Next() {
+		var q string
+		err := rows.Scan(&q)
+		if err != nil {
+			return nil, err
+		}
+		matches[q] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// VisibleTo reports which of the viewers may see listings of the seller, under the
+// same block and mute rules as SelectAll.
+func (ml ListingModel) VisibleTo(sellerID int64, viewerIDs []int64) (map[int64]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The subquery stands in for the listing, which is all listingsVisibleTo() looks
+	// at.
+	rows, err := ml.DB.QueryContext(
+		ctx,
+		`SELECT viewer_id FROM unnest($2::bigint[]) AS viewer_id, (SELECT $1::bigint AS user_id) AS listings
+		WHERE `+listingsVisibleTo("viewer_id"),
+		sellerID, pq.Array(viewerIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visible := make(map[int64]bool)
+	for rows.Next() {
+		var viewerID int64
+		err := rows.Scan(&viewerID)
+		if err != nil {
+			return nil, err
+		}
+		visible[viewerID] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return visible, nil
+}
+
 /* MOCK MODEL */
 
 type MockListingModel struct{}
@@ -237,12 +750,36 @@ func (lm MockListingModel) Insert(listing *Listing) error { // Mock the action..
 func (lm MockListingModel) Select(id int64) (*Listing, error) { // Mock the action...
 	return &Listing{}, nil
 }
-func (lm MockListingModel) SelectAll(title string, categories []string, filters Filters) ([]*Listing, Metadata, error) { // Mock the action...
+func (lm MockListingModel) SelectAll(title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error) { // Mock the action...
+	return []*Listing{}, Metadata{}, nil
+}
+func (lm MockListingModel) SelectAllForOrganization(orgID int64, title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error) { // Mock the action...
 	return []*Listing{}, Metadata{}, nil
 }
 func (lm MockListingModel) Update(listing *Listing) error { // Mock the action...
 	return nil
 }
-func (lm MockListingModel) Delete(id int64) error { // Mock the action...
+func (lm MockListingModel) OfferSale(listing *Listing, buyerID int64) error { // Mock the action...
+	return nil
+}
+func (lm MockListingModel) AcceptSale(listing *Listing, buyerID int64) error { // Mock the action...
 	return nil
 }
+func (lm MockListingModel) Delete(id int64, version int32) error { // Mock the action...
+	return nil
+}
+func (lm MockListingModel) SelectAllForUser(userID int64) ([]*Listing, error) { // Mock the action...
+	return []*Listing{}, nil
+}
+func (lm MockListingModel) Import(sellerID int64, listings []*Listing) ([]*Listing, []*Listing, []string, error) { // Mock the action...
+	return nil, nil, nil, nil
+}
+func (lm MockListingModel) Export(title string, categories []string, viewerID int64, filters Filters, fn func(listing *Listing) error) error { // Mock the action...
+	return nil
+}
+func (lm MockListingModel) MatchTitle(title string, queries []string) (map[string]bool, error) { // Mock the action...
+	return map[string]bool{}, nil
+}
+func (lm MockListingModel) VisibleTo(sellerID int64, viewerIDs []int64) (map[int64]bool, error) { // Mock the action...
+	return map[int64]bool{}, nil
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -19,12 +20,21 @@ type Models struct {
 	Listings interface {
 		Insert(listing *Listing) error
 		Select(id int64) (*Listing, error)
-		SelectAll(title string, categories []string, filters Filters) ([]*Listing, Metadata, error)
+		SelectAll(title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error)
+		SelectAllForOrganization(orgID int64, title string, categories []string, viewerID int64, filters Filters) ([]*Listing, Metadata, error)
 		Update(listing *Listing) error
-		Delete(id int64) error
+		OfferSale(listing *Listing, buyerID int64) error
+		AcceptSale(listing *Listing, buyerID int64) error
+		Delete(id int64, version int32) error
+		SelectAllForUser(userID int64) ([]*Listing, error)
+		Import(sellerID int64, listings []*Listing) ([]*Listing, []*Listing, []string, error)
+		Export(title string, categories []string, viewerID int64, filters Filters, fn func(listing *Listing) error) error
+		MatchTitle(title string, queries []string) (map[string]bool, error)
+		VisibleTo(sellerID int64, viewerIDs []int64) (map[int64]bool, error)
 	}
 	Users interface {
 		Update(user *User) error
+		Select(id int64) (*User, error)
 		SelectByEmail(email string) (*User, error)
 		Insert(user *User) error
 		SelectForToken(tokenScope, tokenPlaintext string) (*User, error)
@@ -33,21 +43,333 @@ type Models struct {
 		New(userID int64, ttl time.Duration, scope string) (*Token, error)
 		Insert(tkn *Token) error
 		DeleteAllForUser(scope string, userID int64) error
+		SelectAllForUser(userID int64) ([]*Token, error)
 	}
 	Permissions interface {
 		SelectAllForUser(userID int64) (Permissions, error)
 		AddForUser(userId int64, permissions ...string) error
+		SelectAll() (Permissions, error)
+	}
+	Roles interface {
+		Insert(role *Role) error
+		SelectAll() ([]*Role, error)
+		Delete(id int64) error
+		SelectAllForUser(userID int64) ([]string, error)
+		AddForUser(userID int64, names ...string) error
+		RemoveForUser(userID int64, name string) error
+	}
+	TwoFactor interface {
+		SelectForUser(userID int64) (*TwoFactor, error)
+		Upsert(tf *TwoFactor) error
+		UseCounter(userID int64, counter int64) error
+		Confirm(userID int64) ([]string, error)
+		ConsumeRecoveryCode(userID int64, code string) (bool, error)
+		Delete(userID int64) error
+	}
+	APIKeys interface {
+		New(userID int64, input *APIKey) (*APIKey, error)
+		Insert(key *APIKey) error
+		SelectByPrefix(prefix string) (*APIKey, error)
+		SelectAllForUser(userID int64) ([]*APIKey, error)
+		Touch(id int64, ip string) error
+		Delete(id, userID int64) error
+		DeleteAllForUser(userID int64) error
+	}
+	Identities interface {
+		InsertAuthRequest(ar *OIDCAuthRequest) error
+		ConsumeAuthRequest(provider, state string) (*OIDCAuthRequest, error)
+		DeleteExpiredAuthRequests() error
+		SelectUser(provider, subject string) (*User, error)
+		Insert(identity *Identity) error
+		SelectAllForUser(userID int64) ([]*Identity, error)
+	}
+	Organizations interface {
+		Insert(org *Organization, ownerID int64) error
+		Select(id int64) (*Organization, error)
+		SelectAllForUser(userID int64) ([]*Organization, error)
+		SelectSoleOwned(userID int64) ([]*Organization, error)
+		Update(org *Organization) error
+		Delete(id int64) error
+		SelectRole(orgID, userID int64) (OrganizationRole, error)
+		SelectMembers(orgID int64) ([]*OrganizationMember, error)
+		SetMemberRole(orgID, userID int64, role OrganizationRole) error
+		RemoveMember(orgID, userID int64) error
+		Invite(orgID, inviteeID int64, role OrganizationRole, invitedBy int64, ttl time.Duration) (*Token, error)
+		AcceptInvitation(orgID, userID int64, tokenPlaintext string) (OrganizationRole, error)
+	}
+	Blocks interface {
+		Upsert(blockerID, blockedID int64, kind string) (*Block, error)
+		Delete(blockerID, blockedID int64, kind string) error
+		SelectAllForUser(blockerID int64, kind string) ([]*Block, error)
+		Blocked(userID, otherID int64) (bool, error)
+	}
+	Reviews interface {
+		Insert(review *Review) error
+		Select(id int64) (*Review, error)
+		SelectAllForListing(listingID int64) ([]*Review, error)
+		SelectAllForSeller(sellerID int64, filters Filters) ([]*Review, Metadata, error)
+		SelectAllForUser(userID int64) ([]*Review, error)
+		SelectRatingForSeller(sellerID int64) (*Rating, error)
+		Reply(review *Review, reply string) error
+		Delete(id int64) error
+		InsertReport(report *ReviewReport) error
+		SelectAllReports(filters Filters) ([]*ReviewReport, Metadata, error)
+		DeleteReport(id int64) error
+	}
+	Notifications interface {
+		Dispatch(userID int64, notificationType string, data map[string]any) (*Notification, error)
+		DispatchForEvent(eventID, userID int64, notificationType string, data map[string]any) (*Notification, error)
+		SelectAllForUser(userID int64, unreadOnly bool, filters Filters) ([]*Notification, Metadata, error)
+		CountUnread(userID int64) (int, error)
+		MarkRead(userID int64, ids []int64) (int64, error)
+		SelectPreferences(userID int64) ([]*NotificationPreference, error)
+		UpsertPreference(userID int64, preference *NotificationPreference) error
+	}
+	AccountDeletions interface {
+		Schedule(userID int64, gracePeriod time.Duration) (*AccountDeletion, error)
+		Select(userID int64) (*AccountDeletion, error)
+		Cancel(userID int64) error
+		Purge() ([]int64, error)
+	}
+	DataExports interface {
+		Insert(userID int64, archive []byte, ttl time.Duration) (*Token, error)
+		SelectArchive(tokenPlaintext string) ([]byte, error)
+		RequestedSince(userID int64, since time.Time) (bool, error)
+		DeleteExpired() error
+	}
+	EmailOutbox interface {
+		Insert(email *OutboxEmail) error
+		Claim(lease time.Duration) (*OutboxEmail, error)
+		Delete(id int64) error
+		Retry(id int64, lastError string, at time.Time) error
+		DeadLetter(id int64, lastError string) error
+		Depth() (*OutboxDepth, error)
 	}
+	EmailSuppressions interface {
+		RecordEvent(event *EmailEvent) (bool, error)
+		Select(email string) (*EmailSuppression, error)
+		Suppressed(email string) (bool, error)
+		Delete(email string) error
+	}
+	Webhooks interface {
+		Insert(webhook *Webhook) error
+		Select(id int64) (*Webhook, error)
+		SelectAll() ([]*Webhook, error)
+		Update(webhook *Webhook) error
+		Delete(id int64) error
+		Enqueue(eventID int64, eventType string, payload any) (int64, error)
+		Claim(lease time.Duration) (*WebhookDelivery, error)
+		RecordAttempt(attempt *WebhookAttempt, status string, nextAttemptAt time.Time) error
+		SelectDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error)
+		SelectDelivery(id int64) (*WebhookDelivery, error)
+		Redeliver(id int64) error
+	}
+	LoginThrottles interface {
+		Select(subjects ...string) ([]*LoginThrottle, error)
+		SelectActive(window time.Duration) ([]*LoginThrottle, error)
+		RecordAttempt(subject string, userID *int64, p ThrottlePolicy) (*LoginThrottle, bool, error)
+		Forgive(subject string) error
+		Reset(subject string) (bool, error)
+	}
+	Events interface {
+		Record(eventType string, data any) error
+		Select(id int64) (*Event, error)
+		SelectSince(afterID int64, types []string, limit int) ([]*Event, error)
+		Claim(lease time.Duration) (*Event, error)
+		MarkDispatched(id int64) error
+		Retry(id int64, lastError string, at time.Time) error
+		DeadLetter(id int64, lastError string) error
+	}
+	Conversations interface {
+		Start(conv *Conversation) (bool, error)
+		Select(id int64) (*Conversation, error)
+		SelectAllForUser(userID int64, filters Filters) ([]*Conversation, Metadata, error)
+		InsertMessage(msg *Message) error
+		SelectMessage(id int64) (*Message, error)
+		SelectMessages(conversationID, beforeID int64, limit int) ([]*Message, error)
+		Notify(n *ChatNotification) error
+	}
+	Imports interface {
+		Insert(imp *Import) error
+		Select(id, userID int64) (*Import, error)
+		UpdateProgress(imp *Import) error
+		InsertErrors(importID int64, rowErrors []*ImportRowError) error
+		SelectErrors(importID int64, filters Filters) ([]*ImportRowError, Metadata, error)
+	}
+	Idempotency interface {
+		Claim(userID int64, key string, requestHash []byte, ttl, lease time.Duration) (*IdempotentResponse, error)
+		Complete(userID int64, key string, resp *IdempotentResponse) error
+		Release(userID int64, key string) error
+		DeleteExpired() error
+	}
+
+	// The connection pool, and the cache if the models are cached, for Transaction().
+	// Both are nil for the models of a unit of work.
+	db    *sql.DB
+	cache *AuthCache
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing // the initialized ListingModel.
 func NewModels(db *sql.DB) Models {
+	m := newModels(db)
+	m.db = db
+	return m
+}
+
+func newModels(db DBTX) Models {
 	return Models{
-		Listings:    ListingModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Listings:          ListingModel{DB: db},
+		Users:             UserModel{DB: db},
+		Tokens:            TokenModel{DB: db},
+		Permissions:       PermissionModel{DB: db},
+		Roles:             RoleModel{DB: db},
+		TwoFactor:         TwoFactorModel{DB: db},
+		APIKeys:           APIKeyModel{DB: db},
+		Identities:        IdentityModel{DB: db},
+		Organizations:     OrganizationModel{DB: db},
+		Blocks:            BlockModel{DB: db},
+		Reviews:           ReviewModel{DB: db},
+		Notifications:     NotificationModel{DB: db},
+		AccountDeletions:  AccountDeletionModel{DB: db},
+		DataExports:       DataExportModel{DB: db},
+		EmailOutbox:       EmailOutboxModel{DB: db},
+		EmailSuppressions: EmailSuppressionModel{DB: db},
+		Webhooks:          WebhookModel{DB: db},
+		LoginThrottles:    LoginThrottleModel{DB: db},
+		Events:            EventModel{DB: db},
+		Conversations:     ConversationModel{DB: db},
+		Imports:           ImportModel{DB: db},
+		Idempotency:       IdempotencyModel{DB: db},
+	}
+}
+
+/* UNIT OF WORK */
+
+// How long a unit of work may take in total, from BEGIN to COMMIT.
+const transactionTimeout = 15 * time.Second
+
+// DBTX is what the models run their queries against: the connection pool, or the
+// transaction of a unit of work.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// A unitOfWork collects what has to wait until its transaction has committed, such as
+// dropping cache entries which the transaction made stale.
+type unitOfWork struct {
+	afterCommit []func()
+}
+
+// deferUntilCommit runs fn once the unit of work has committed, or straight away
+// outside of one.
+func (u *unitOfWork) deferUntilCommit(fn func()) {
+	if u == nil {
+		fn()
+		return
+	}
+	u.afterCommit = append(u.afterCommit, fn)
+}
+
+// Transaction runs fn as a unit of work: every query made through the Models which fn
+// is given goes through one transaction, which is committed if fn returns nil and
+// rolled back if it returns an error. Events recorded with tx.Events are written in the
+// same transaction, so they exist if and only if the changes they describe do.
+//
+// Calling Transaction on the models of a unit of work simply runs fn as part of it.
+func (m Models) Transaction(fn func(tx Models) error) error {
+	// The models of a unit of work, like the mock models, have no pool to begin a
+	// transaction on.
+	if m.db == nil {
+		return fn(m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transactionTimeout)
+	defer cancel()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	unit := &unitOfWork{}
+	txModels := newModels(tx)
+	if m.cache != nil {
+		txModels = withCache(txModels, tx, m.cache, unit)
+	}
+
+	err = fn(txModels)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range unit.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+// modelTx is the transaction of a model method which makes several writes. Inside a
+// unit of work the method doesn't get a transaction of its own but a savepoint in the
+// unit's, so that a failure rolls back the method's writes without aborting the unit,
+// while committing is left to the unit.
+type modelTx struct {
+	*sql.Tx
+	ctx       context.Context
+	savepoint bool
+	done      bool
+}
+
+func beginTx(ctx context.Context, db DBTX) (*modelTx, error) {
+	switch db := db.(type) {
+	case *sql.DB:
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &modelTx{Tx: tx, ctx: ctx}, nil
+	case *sql.Tx:
+		_, err := db.ExecContext(ctx, `SAVEPOINT model_tx`)
+		if err != nil {
+			return nil, err
+		}
+		return &modelTx{Tx: db, ctx: ctx, savepoint: true}, nil
+	default:
+		return nil, errors.New("data: cannot begin a transaction")
+	}
+}
+
+func (t *modelTx) Commit() error {
+	if !t.savepoint {
+		return t.Tx.Commit()
+	}
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	_, err := t.Tx.ExecContext(t.ctx, `RELEASE SAVEPOINT model_tx`)
+	return err
+}
+
+// Rollback is deferred right after beginTx, so like sql.Tx.Rollback it does nothing
+// once the transaction was committed.
+func (t *modelTx) Rollback() error {
+	if !t.savepoint {
+		return t.Tx.Rollback()
+	}
+	if t.done {
+		return sql.ErrTxDone
 	}
+	t.done = true
+	_, err := t.Tx.ExecContext(t.ctx, `ROLLBACK TO SAVEPOINT model_tx`)
+	return err
 }
 
 // You can then call NewMockModels() whenever you need it in your unit tests in place of the ‘real’ NewModels() function
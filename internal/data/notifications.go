@@ -0,0 +1,335 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"letsgofurther/internal/validator"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The types of notification, each with the channels it goes out on unless the user
+// chose otherwise. Every type needs an email template named after it, see
+// NotificationTemplate.
+const (
+	// To the buyer, when the seller records them as the buyer of a listing, asking them
+	// to confirm the purchase.
+	NotificationSaleOffered = "sale_offered"
+	// To the seller, when the buyer confirmed the purchase.
+	NotificationListingSold = "listing_sold"
+	// To the user a review is about.
+	NotificationReviewReceived = "review_received"
+	// To the buyer, when the seller replies to their review.
+	NotificationReviewReplied = "review_replied"
+	// To the other participants of a conversation, when someone sends a message.
+	NotificationNewMessage = "new_message"
+)
+
+var NotificationTypes = map[string]NotificationChannels{
+	NotificationSaleOffered:    {Email: true, InApp: true},
+	NotificationListingSold:    {Email: true, InApp: true},
+	NotificationReviewReceived: {Email: true, InApp: true},
+	NotificationReviewReplied:  {Email: false, InApp: true},
+	NotificationNewMessage:     {Email: true, InApp: true},
+}
+
+// NotificationTemplate returns the name of the email template for the notification type.
+func NotificationTemplate(notificationType string) string {
+	return "notification_" + notificationType + ".tmpl"
+}
+
+type NotificationChannels struct {
+	Email bool `json:"email"`
+	InApp bool `json:"in_app"`
+}
+
+type NotificationPreference struct {
+	Type string `json:"type"`
+	NotificationChannels
+}
+
+type Notification struct {
+	ID        int64          `json:"id"`
+	UserID    int64          `json:"-"`
+	Type      string         `json:"type"`
+	Data      map[string]any `json:"data"`
+	ReadAt    *time.Time     `json:"read_at"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+func ValidateNotificationType(v *validator.Validator, notificationType string) {
+	_, ok := NotificationTypes[notificationType]
+	v.Check(ok, "type", "must be a known notification type")
+}
+
+/* MODEL */
+
+type NotificationModel struct {
+	DB DBTX
+}
+
+// Dispatch sends the user a notification on the channels they chose for its type: it
+// goes into their inbox, or into the email outbox, or both, in one transaction. The
+// data is stored with the notification and is also what the email template gets. The
+// inbox entry is returned, or nil if the user doesn't want this type in the app.
+func (m NotificationModel) Dispatch(userID int64, notificationType string, data map[string]any) (*Notification, error) {
+	return m.dispatch(nil, userID, notificationType, data)
+}
+
+// DispatchForEvent is Dispatch for a notification about a domain event, which the user
+// only gets once however often the event is dispatched. It returns nil without sending
+// anything if the user already got the notification.
+func (m NotificationModel) DispatchForEvent(eventID, userID int64, notificationType string, data map[string]any) (*Notification, error) {
+	return m.dispatch(&eventID, userID, notificationType, data)
+}
+
+func (m NotificationModel) dispatch(eventID *int64, userID int64, notificationType string, data map[string]any) (*Notification, error) {
+	channels, ok := NotificationTypes[notificationType]
+	if !ok {
+		return nil, fmt.Errorf("unknown notification type %q", notificationType)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT users.email, users.locale, notifications_preferences.email, notifications_preferences.in_app
+		FROM users
+		LEFT JOIN notifications_preferences
+		ON notifications_preferences.user_id = users.id AND notifications_preferences.type = $2
+		WHERE users.id = $1`
+
+	var email, locale string
+	var wantsEmail, wantsInApp sql.NullBool
+
+	err = tx.QueryRowContext(ctx, query, userID, notificationType).Scan(&email, &locale, &wantsEmail, &wantsInApp)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	if wantsEmail.Valid {
+		channels.Email = wantsEmail.Bool
+	}
+	if wantsInApp.Valid {
+		channels.InApp = wantsInApp.Bool
+	}
+
+	// Only the first dispatch of an event gets to record the user as notified. One
+	// running at the same time waits here for the first to commit, and then sends
+	// nothing.
+	if eventID != nil {
+		res, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO notifications_events (event_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			*eventID, userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		rowsnum, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsnum < 1 {
+			return nil, nil
+		}
+	}
+
+	var notification *Notification
+
+	if channels.InApp {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+
+		notification = &Notification{UserID: userID, Type: notificationType, Data: data}
+
+		err = tx.QueryRowContext(
+			ctx,
+			`INSERT INTO notifications (user_id, type, data) VALUES ($1, $2, $3) RETURNING id, created_at`,
+			userID, notificationType, js,
+		).Scan(&notification.ID, &notification.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if channels.Email {
+		err = insertEmail(ctx, tx, &OutboxEmail{
+			Recipient: email,
+			Template:  NotificationTemplate(notificationType),
+			Locale:    locale,
+			Data:      data,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return notification, tx.Commit()
+}
+
+// SelectAllForUser returns a page of the user's inbox, newest first, optionally only
+// the unread notifications.
+func (m NotificationModel) SelectAllForUser(userID int64, unreadOnly bool, filters Filters) ([]*Notification, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, type, data, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND (read_at IS NULL OR NOT $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, unreadOnly, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	notifications := []*Notification{}
+	for rows.Next() {
+		notification := Notification{UserID: userID}
+		var js []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&notification.ID,
+			&notification.Type,
+			&js,
+			&notification.ReadAt,
+			&notification.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.UseNumber()
+		err = dec.Decode(&notification.Data)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		notifications = append(notifications, &notification)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return notifications, metadata, nil
+}
+
+// CountUnread returns how many notifications in the user's inbox are unread.
+func (m NotificationModel) CountUnread(userID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(
+		ctx,
+		`SELECT count(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// MarkRead marks the user's notifications with the given IDs as read, or all of them
+// if ids is empty, and returns how many were unread.
+func (m NotificationModel) MarkRead(userID int64, ids []int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE notifications SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND (id = ANY($2) OR cardinality($2::bigint[]) = 0)`,
+		userID, pq.Array(ids),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SelectPreferences returns the user's channels for every notification type, with
+// the defaults for the types they haven't chosen for, ordered by type.
+func (m NotificationModel) SelectPreferences(userID int64) ([]*NotificationPreference, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(
+		ctx,
+		`SELECT type, email, in_app FROM notifications_preferences WHERE user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chosen := make(map[string]NotificationChannels)
+	for rows.Next() {
+		var notificationType string
+		var channels NotificationChannels
+		err := rows.Scan(&notificationType, &channels.Email, &channels.InApp)
+		if err != nil {
+			return nil, err
+		}
+		chosen[notificationType] = channels
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	preferences := []*NotificationPreference{}
+	for notificationType, channels := range NotificationTypes {
+		if c, ok := chosen[notificationType]; ok {
+			channels = c
+		}
+		preferences = append(preferences, &NotificationPreference{Type: notificationType, NotificationChannels: channels})
+	}
+	sort.Slice(preferences, func(i, j int) bool {
+		return preferences[i].Type < preferences[j].Type
+	})
+
+	return preferences, nil
+}
+
+// UpsertPreference sets the user's channels for a notification type.
+func (m NotificationModel) UpsertPreference(userID int64, preference *NotificationPreference) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`INSERT INTO notifications_preferences (user_id, type, email, in_app)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, type) DO UPDATE
+		SET email = EXCLUDED.email, in_app = EXCLUDED.in_app`,
+		userID, preference.Type, preference.Email, preference.InApp,
+	)
+	return err
+}
@@ -0,0 +1,509 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"letsgofurther/internal/validator"
+	"time"
+)
+
+var (
+	ErrAlreadyMember = errors.New("already a member")
+	ErrLastOwner     = errors.New("last owner")
+)
+
+// An OrganizationRole is what a member may do within an organization. Roles are ranked,
+// and each one includes everything the roles below it may do.
+type OrganizationRole string
+
+const (
+	OrganizationOwner   OrganizationRole = "owner"
+	OrganizationManager OrganizationRole = "manager"
+	OrganizationEditor  OrganizationRole = "editor"
+)
+
+var organizationRoleRanks = map[OrganizationRole]int{
+	OrganizationOwner:   3,
+	OrganizationManager: 2,
+	OrganizationEditor:  1,
+}
+
+// AtLeast reports whether the role ranks as high as min or higher. The empty role,
+// which stands for "not a member", ranks below every other.
+func (r OrganizationRole) AtLeast(min OrganizationRole) bool {
+	return organizationRoleRanks[r] >= organizationRoleRanks[min]
+}
+
+func ValidateOrganizationRole(v *validator.Validator, role OrganizationRole) {
+	_, ok := organizationRoleRanks[role]
+	v.Check(ok, "role", "must be one of owner, manager or editor")
+}
+
+// An Organization is a team account, such as a dealer or a shop, whose members share
+// its listings.
+type Organization struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	Version     int32     `json:"version"`
+}
+
+type OrganizationMember struct {
+	UserID    int64            `json:"user_id"`
+	Name      string           `json:"name"`
+	Email     string           `json:"email"`
+	Role      OrganizationRole `json:"role"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	v.Check(len(org.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+}
+
+/* MODEL */
+
+type OrganizationModel struct {
+	DB DBTX
+}
+
+// Insert creates the organization with the given user as its first owner.
+func (m OrganizationModel) Insert(org *Organization, ownerID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO organizations (name, description) VALUES ($1, $2)
+		RETURNING id, created_at, version`,
+		org.Name, org.Description,
+	).Scan(&org.ID, &org.CreatedAt, &org.Version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO organizations_members (organization_id, user_id, role) VALUES ($1, $2, $3)`,
+		org.ID, ownerID, OrganizationOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m OrganizationModel) Select(id int64) (*Organization, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	query := `
+		SELECT id, name, description, created_at, version
+		FROM organizations
+		WHERE id = $1`
+
+	var org Organization
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&org.ID,
+		&org.Name,
+		&org.Description,
+		&org.CreatedAt,
+		&org.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &org, nil
+}
+
+// SelectAllForUser returns the organizations the user is a member of.
+func (m OrganizationModel) SelectAllForUser(userID int64) ([]*Organization, error) {
+	query := `
+		SELECT organizations.id, organizations.name, organizations.description, organizations.created_at, organizations.version
+		FROM organizations
+		INNER JOIN organizations_members ON organizations_members.organization_id = organizations.id
+		WHERE organizations_members.user_id = $1
+		ORDER BY organizations.name, organizations.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+	for rows.Next() {
+		var org Organization
+		err := rows.Scan(&org.ID, &org.Name, &org.Description, &org.CreatedAt, &org.Version)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+// SelectSoleOwned returns the organizations in which the user is the only owner
+// while other people are still members. Such an organization would be left without
+// anybody able to manage it if the user went away.
+func (m OrganizationModel) SelectSoleOwned(userID int64) ([]*Organization, error) {
+	query := `
+		SELECT organizations.id, organizations.name, organizations.description, organizations.created_at, organizations.version
+		FROM organizations
+		INNER JOIN organizations_members ON organizations_members.organization_id = organizations.id
+		WHERE organizations_members.user_id = $1
+		AND organizations_members.role = 'owner'
+		AND NOT EXISTS (
+			SELECT 1 FROM organizations_members others
+			WHERE others.organization_id = organizations.id
+			AND others.user_id <> $1
+			AND others.role = 'owner'
+		)
+		AND EXISTS (
+			SELECT 1 FROM organizations_members others
+			WHERE others.organization_id = organizations.id
+			AND others.user_id <> $1
+		)
+		ORDER BY organizations.name, organizations.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+	for rows.Next() {
+		var org Organization
+		err := rows.Scan(&org.ID, &org.Name, &org.Description, &org.CreatedAt, &org.Version)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+func (m OrganizationModel) Update(org *Organization) error {
+	query := `
+		UPDATE organizations
+		SET name = $1, description = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, org.Name, org.Description, org.ID, org.Version).Scan(&org.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the organization and its memberships. Its listings are kept but no
+// longer belong to any organization.
+func (m OrganizationModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM organizations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// SelectRole returns the user's role in the organization, or ErrNotFoundRecord if the
+// user isn't a member.
+func (m OrganizationModel) SelectRole(orgID, userID int64) (OrganizationRole, error) {
+	query := `
+		SELECT role
+		FROM organizations_members
+		WHERE organization_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var role OrganizationRole
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrNotFoundRecord
+		default:
+			return "", err
+		}
+	}
+
+	return role, nil
+}
+
+func (m OrganizationModel) SelectMembers(orgID int64) ([]*OrganizationMember, error) {
+	query := `
+		SELECT users.id, users.name, users.email, organizations_members.role, organizations_members.created_at
+		FROM organizations_members
+		INNER JOIN users ON users.id = organizations_members.user_id
+		WHERE organizations_members.organization_id = $1
+		ORDER BY organizations_members.created_at, users.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*OrganizationMember{}
+	for rows.Next() {
+		var member OrganizationMember
+		err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &member)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetMemberRole changes the role of an existing member. ErrLastOwner is returned
+// if that would leave the organization without an owner.
+func (m OrganizationModel) SetMemberRole(orgID, userID int64, role OrganizationRole) error {
+	return m.changeMember(orgID, userID, func(ctx context.Context, tx DBTX) (sql.Result, error) {
+		return tx.ExecContext(
+			ctx,
+			`UPDATE organizations_members SET role = $3 WHERE organization_id = $1 AND user_id = $2`,
+			orgID, userID, role,
+		)
+	}, role == OrganizationOwner)
+}
+
+// RemoveMember takes the user out of the organization. ErrLastOwner is returned if
+// the user is its only owner.
+func (m OrganizationModel) RemoveMember(orgID, userID int64) error {
+	return m.changeMember(orgID, userID, func(ctx context.Context, tx DBTX) (sql.Result, error) {
+		return tx.ExecContext(
+			ctx,
+			`DELETE FROM organizations_members WHERE organization_id = $1 AND user_id = $2`,
+			orgID, userID,
+		)
+	}, false)
+}
+
+// changeMember runs a change to one membership and then makes sure the organization
+// still has an owner. The organization row is locked first, so that two owners
+// demoting each other at the same time can't both succeed.
+func (m OrganizationModel) changeMember(orgID, userID int64, change func(context.Context, DBTX) (sql.Result, error), staysOwner bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT 1 FROM organizations WHERE id = $1 FOR UPDATE`, orgID)
+	if err != nil {
+		return err
+	}
+
+	res, err := change(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+
+	if !staysOwner {
+		var owners int
+		err = tx.QueryRowContext(
+			ctx,
+			`SELECT count(*) FROM organizations_members WHERE organization_id = $1 AND role = $2`,
+			orgID, OrganizationOwner,
+		).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return ErrLastOwner
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Invite creates an invitation token for an existing user to join the organization
+// with the given role. The token is an ordinary ScopeInvitation token belonging to the
+// invitee, so it is validated and expires like every other token.
+func (m OrganizationModel) Invite(orgID, inviteeID int64, role OrganizationRole, invitedBy int64, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(inviteeID, ttl, ScopeInvitation)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM organizations_members WHERE organization_id = $1 AND user_id = $2)`,
+		orgID, inviteeID,
+	).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrAlreadyMember
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`,
+		token.Hash, token.UserID, token.Expiry, token.Scope,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO organizations_invitations (token_hash, organization_id, role, invited_by) VALUES ($1, $2, $3, $4)`,
+		token.Hash, orgID, role, invitedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, tx.Commit()
+}
+
+// AcceptInvitation makes the user a member of the organization with the role they
+// were invited with, and uses up the token. ErrNotFoundRecord is returned if the token
+// doesn't exist, has expired, or wasn't issued to this user for this organization.
+func (m OrganizationModel) AcceptInvitation(orgID, userID int64, tokenPlaintext string) (OrganizationRole, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Deleting the token up front both consumes it and, through the RETURNING clause,
+	// checks it, so two requests racing with the same token can't both get through.
+	var role OrganizationRole
+	err = tx.QueryRowContext(
+		ctx,
+		`DELETE FROM tokens
+		USING organizations_invitations
+		WHERE tokens.hash = organizations_invitations.token_hash
+		AND tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.user_id = $3
+		AND tokens.expiry > $4
+		AND organizations_invitations.organization_id = $5
+		RETURNING organizations_invitations.role`,
+		tokenHash[:], ScopeInvitation, userID, time.Now(), orgID,
+	).Scan(&role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrNotFoundRecord
+		default:
+			return "", err
+		}
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO organizations_members (organization_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		orgID, userID, role,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rowsnum < 1 {
+		return "", ErrAlreadyMember
+	}
+
+	return role, tx.Commit()
+}
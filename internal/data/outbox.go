@@ -0,0 +1,180 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// An OutboxEmail is an email waiting in the outbox. Data holds the dynamic data for
+// the template, so it must survive a round trip through JSON: use strings and numbers,
+// and format times before queueing them.
+type OutboxEmail struct {
+	ID        int64
+	Recipient string
+	Template  string
+	// The locale of the template to use, if there is a version of it in that language.
+	Locale    string
+	Data      map[string]any
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// OutboxDepth is how many emails are in the outbox, for monitoring.
+type OutboxDepth struct {
+	Pending int `json:"pending"`
+	Dead    int `json:"dead"`
+}
+
+/* MODEL */
+
+type EmailOutboxModel struct {
+	DB DBTX
+}
+
+// insertEmail queues the email as part of the given transaction, so that it is only
+// sent if the transaction commits.
+func insertEmail(ctx context.Context, tx DBTX, email *OutboxEmail) error {
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_outbox (recipient, template, locale, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	return tx.QueryRowContext(ctx, query, email.Recipient, email.Template, email.Locale, js).Scan(&email.ID, &email.CreatedAt)
+}
+
+// Insert queues an email on its own, for emails which don't go with any other write.
+func (m EmailOutboxModel) Insert(email *OutboxEmail) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertEmail(ctx, tx, email)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Claim takes the email which has been waiting longest, if any is due, and returns
+// ErrNotFoundRecord if none is. Claiming counts as an attempt and moves the next
+// attempt lease into the future, so if the worker dies while sending, another one picks
+// the email up again once the lease is over. SKIP LOCKED lets any number of workers, in
+// any number of processes, claim emails at the same time without getting in each
+// other's way.
+func (m EmailOutboxModel) Claim(lease time.Duration) (*OutboxEmail, error) {
+	query := `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $1 * interval '1 millisecond'
+		WHERE id = (
+			SELECT id FROM email_outbox
+			WHERE dead_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, template, locale, data, attempts, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var email OutboxEmail
+	var js []byte
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Milliseconds()).Scan(
+		&email.ID,
+		&email.Recipient,
+		&email.Template,
+		&email.Locale,
+		&js,
+		&email.Attempts,
+		&email.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	// Decode numbers as json.Number rather than float64, so that IDs print the same
+	// way in the templates as they did before they were queued.
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+// Delete removes an email from the outbox once it has been sent. Sent emails aren't
+// kept, since the data often contains one-off tokens.
+func (m EmailOutboxModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM email_outbox WHERE id = $1`, id)
+	return err
+}
+
+// Retry records a failed attempt and when to try again.
+func (m EmailOutboxModel) Retry(id int64, lastError string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE email_outbox SET last_error = $2, next_attempt_at = $3 WHERE id = $1`,
+		id, lastError, at,
+	)
+	return err
+}
+
+// DeadLetter records the last failed attempt and gives up on the email.
+func (m EmailOutboxModel) DeadLetter(id int64, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE email_outbox SET last_error = $2, dead_at = NOW() WHERE id = $1`,
+		id, lastError,
+	)
+	return err
+}
+
+// Depth counts the emails waiting to be sent and the dead-lettered ones.
+func (m EmailOutboxModel) Depth() (*OutboxDepth, error) {
+	query := `
+		SELECT count(*) FILTER (WHERE dead_at IS NULL), count(*) FILTER (WHERE dead_at IS NOT NULL)
+		FROM email_outbox`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var depth OutboxDepth
+	err := m.DB.QueryRowContext(ctx, query).Scan(&depth.Pending, &depth.Dead)
+	if err != nil {
+		return nil, err
+	}
+
+	return &depth, nil
+}
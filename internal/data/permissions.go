@@ -2,8 +2,8 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"letsgofurther/internal/constants"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -14,32 +14,49 @@ import (
 type Permissions []string
 
 // Add a helper method to check whether the Permissions slice contains a specific
-// permission code.
+// permission code. Wildcard codes are honoured: "listings:*" includes every code
+// starting with "listings:", and "*" includes everything.
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if permissionMatches(p[i], code) {
 			return true
 		}
 	}
 	return false
 }
 
+func permissionMatches(granted, code string) bool {
+	switch {
+	case granted == "*":
+		return true
+	case strings.HasSuffix(granted, ":*"):
+		return strings.HasPrefix(code, strings.TrimSuffix(granted, "*"))
+	default:
+		return granted == code
+	}
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
-// The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
+// The SelectAllForUser() method returns the effective permission codes for a specific
+// user in a Permissions slice: those granted directly in users_permissions plus
+// those bundled in any of the user's roles.
 func (m PermissionModel) SelectAllForUser(userID int64) (Permissions, error) {
 	query := `
 	SELECT permissions.code
 	FROM permissions
-	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id 
-	INNER JOIN users ON users_permissions.user_id = users.id
-	WHERE users.id = $1;`
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+	WHERE users_roles.user_id = $1
+	ORDER BY code;`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 
 	defer cancel()
@@ -50,7 +67,7 @@ func (m PermissionModel) SelectAllForUser(userID int64) (Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -79,3 +96,30 @@ func (pm PermissionModel) AddForUser(userId int64, permissions ...string) error
 	)
 	return err
 }
+
+// SelectAll returns every permission code which can be granted.
+func (pm PermissionModel) SelectAll() (Permissions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.TIMEOUT_DURATION)
+	defer cancel()
+
+	rows, err := pm.DB.QueryContext(ctx, `SELECT code FROM permissions ORDER BY code;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,52 @@
+package data
+
+import "testing"
+
+func TestPermissionMatches(t *testing.T) {
+	tests := []struct {
+		granted string
+		code    string
+		want    bool
+	}{
+		{"listings:read", "listings:read", true},
+		{"listings:read", "listings:write", false},
+		{"listings:*", "listings:read", true},
+		{"listings:*", "listings:write", true},
+		{"listings:*", "reviews:read", false},
+		// The wildcard stands for whole segments, not for a prefix of the resource.
+		{"listings:*", "listingsx:read", false},
+		{"list:*", "listings:read", false},
+		{"*", "listings:read", true},
+		{"*", "admin:roles", true},
+		// Wildcards are only special when granted, not in the code asked for.
+		{"listings:read", "listings:*", false},
+		{"listings:read", "*", false},
+		{"listings*", "listings:read", false},
+		{"", "listings:read", false},
+	}
+
+	for _, tt := range tests {
+		if got := permissionMatches(tt.granted, tt.code); got != tt.want {
+			t.Errorf("permissionMatches(%q, %q) = %t; want %t", tt.granted, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionsInclude(t *testing.T) {
+	p := Permissions{"listings:read", "reviews:*"}
+
+	for code, want := range map[string]bool{
+		"listings:read":  true,
+		"listings:write": false,
+		"reviews:write":  true,
+		"admin:roles":    false,
+	} {
+		if got := p.Include(code); got != want {
+			t.Errorf("Include(%q) = %t; want %t", code, got, want)
+		}
+	}
+
+	if (Permissions{}).Include("listings:read") {
+		t.Error("empty permissions include listings:read")
+	}
+}
@@ -0,0 +1,428 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"letsgofurther/internal/validator"
+	"time"
+)
+
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+	ErrAlreadyReplied  = errors.New("already replied")
+	ErrDuplicateReport = errors.New("duplicate report")
+)
+
+// The two sides of a deal.
+const (
+	ReviewerBuyer  = "buyer"
+	ReviewerSeller = "seller"
+)
+
+// A Review is one side's opinion of the other after a listing was sold. The seller
+// can answer a review written by the buyer once.
+type Review struct {
+	ID           int64      `json:"id"`
+	ListingID    int64      `json:"listing_id"`
+	ReviewerID   int64      `json:"reviewer_id"`
+	ReviewerName string     `json:"reviewer_name"`
+	RevieweeID   int64      `json:"reviewee_id"`
+	ReviewerRole string     `json:"reviewer_role"`
+	Rating       int        `json:"rating"`
+	Text         string     `json:"text"`
+	Reply        *string    `json:"reply"`
+	RepliedAt    *time.Time `json:"replied_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// A Rating sums up the reviews a seller got from their buyers. Average is nil while
+// there are no reviews yet.
+type Rating struct {
+	Average *float64 `json:"average"`
+	Count   int      `json:"count"`
+}
+
+// A ReviewReport flags a review for moderators to look at.
+type ReviewReport struct {
+	ID         int64     `json:"id"`
+	ReviewID   int64     `json:"review_id"`
+	ReporterID *int64    `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+	Review     *Review   `json:"review,omitempty"`
+}
+
+// sellerRatingJoin adds the seller_rating.average and seller_rating.count columns to
+// a query on listings.
+const sellerRatingJoin = `
+	LEFT JOIN LATERAL (
+		SELECT round(avg(reviews.rating), 2)::float8 AS average, count(*) AS count
+		FROM reviews
+		WHERE reviews.reviewee_id = listings.user_id AND reviews.reviewer_role = 'buyer'
+	) seller_rating ON true`
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+
+	v.Check(review.Text != "", "text", "must be provided")
+	v.Check(len(review.Text) <= 1000, "text", "must not be more than 1000 bytes long")
+}
+
+func ValidateReviewReply(v *validator.Validator, reply string) {
+	v.Check(reply != "", "text", "must be provided")
+	v.Check(len(reply) <= 1000, "text", "must not be more than 1000 bytes long")
+}
+
+func ValidateReviewReport(v *validator.Validator, report *ReviewReport) {
+	v.Check(report.Reason != "", "reason", "must be provided")
+	v.Check(len(report.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+}
+
+/* MODEL */
+
+type ReviewModel struct {
+	DB DBTX
+}
+
+const reviewColumns = `
+	reviews.id, reviews.listing_id, reviews.reviewer_id, users.name, reviews.reviewee_id,
+	reviews.reviewer_role, reviews.rating, reviews.text, reviews.reply, reviews.replied_at,
+	reviews.created_at`
+
+func scanReview(row interface{ Scan(...any) error }, review *Review) error {
+	return row.Scan(
+		&review.ID,
+		&review.ListingID,
+		&review.ReviewerID,
+		&review.ReviewerName,
+		&review.RevieweeID,
+		&review.ReviewerRole,
+		&review.Rating,
+		&review.Text,
+		&review.Reply,
+		&review.RepliedAt,
+		&review.CreatedAt,
+	)
+}
+
+// Insert saves a review. ErrDuplicateReview is returned if the reviewer has already
+// reviewed this deal.
+func (m ReviewModel) Insert(review *Review) error {
+	query := `
+		INSERT INTO reviews (listing_id, reviewer_id, reviewee_id, reviewer_role, rating, text)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []any{
+		review.ListingID,
+		review.ReviewerID,
+		review.RevieweeID,
+		review.ReviewerRole,
+		review.Rating,
+		review.Text,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_listing_id_reviewer_id_key"`:
+			return ErrDuplicateReview
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ReviewModel) Select(id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	query := `
+		SELECT ` + reviewColumns + `
+		FROM reviews
+		INNER JOIN users ON users.id = reviews.reviewer_id
+		WHERE reviews.id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var review Review
+	err := scanReview(m.DB.QueryRowContext(ctx, query, id), &review)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// SelectAllForListing returns both sides' reviews of a deal.
+func (m ReviewModel) SelectAllForListing(listingID int64) ([]*Review, error) {
+	query := `
+		SELECT ` + reviewColumns + `
+		FROM reviews
+		INNER JOIN users ON users.id = reviews.reviewer_id
+		WHERE reviews.listing_id = $1
+		ORDER BY reviews.created_at, reviews.id`
+
+	return m.selectAll(query, listingID)
+}
+
+// SelectAllForSeller returns the reviews buyers wrote about the seller, newest first.
+func (m ReviewModel) SelectAllForSeller(sellerID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), ` + reviewColumns + `
+		FROM reviews
+		INNER JOIN users ON users.id = reviews.reviewer_id
+		WHERE reviews.reviewee_id = $1 AND reviews.reviewer_role = 'buyer'
+		ORDER BY reviews.created_at DESC, reviews.id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, sellerID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.ListingID,
+			&review.ReviewerID,
+			&review.ReviewerName,
+			&review.RevieweeID,
+			&review.ReviewerRole,
+			&review.Rating,
+			&review.Text,
+			&review.Reply,
+			&review.RepliedAt,
+			&review.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reviews, metadata, nil
+}
+
+// SelectAllForUser returns the reviews the user wrote or got, oldest first.
+func (m ReviewModel) SelectAllForUser(userID int64) ([]*Review, error) {
+	query := `
+		SELECT ` + reviewColumns + `
+		FROM reviews
+		INNER JOIN users ON users.id = reviews.reviewer_id
+		WHERE reviews.reviewer_id = $1 OR reviews.reviewee_id = $1
+		ORDER BY reviews.created_at, reviews.id`
+
+	return m.selectAll(query, userID)
+}
+
+func (m ReviewModel) selectAll(query string, args ...any) ([]*Review, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		if err := scanReview(rows, &review); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+// SelectRatingForSeller sums up the reviews buyers wrote about the seller.
+func (m ReviewModel) SelectRatingForSeller(sellerID int64) (*Rating, error) {
+	query := `
+		SELECT round(avg(rating), 2)::float8, count(*)
+		FROM reviews
+		WHERE reviewee_id = $1 AND reviewer_role = 'buyer'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rating Rating
+	err := m.DB.QueryRowContext(ctx, query, sellerID).Scan(&rating.Average, &rating.Count)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rating, nil
+}
+
+// Reply stores the reviewee's answer to a review. There is only one reply per review,
+// and it can't be changed afterwards; ErrAlreadyReplied is returned on a second try.
+func (m ReviewModel) Reply(review *Review, reply string) error {
+	query := `
+		UPDATE reviews
+		SET reply = $1, replied_at = NOW()
+		WHERE id = $2 AND reply IS NULL
+		RETURNING reply, replied_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, reply, review.ID).Scan(&review.Reply, &review.RepliedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrAlreadyReplied
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a review, along with any reports about it. It is used by moderators.
+func (m ReviewModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM reviews WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// InsertReport flags a review for moderation. Every user can report a review once.
+func (m ReviewModel) InsertReport(report *ReviewReport) error {
+	query := `
+		INSERT INTO reviews_reports (review_id, reporter_id, reason)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, report.ReviewID, report.ReporterID, report.Reason).Scan(&report.ID, &report.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_reports_review_id_reporter_id_key"`:
+			return ErrDuplicateReport
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectAllReports returns the open reports together with the reviews they are about,
+// oldest first, for moderators to work through.
+func (m ReviewModel) SelectAllReports(filters Filters) ([]*ReviewReport, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), reviews_reports.id, reviews_reports.review_id, reviews_reports.reporter_id,
+			reviews_reports.reason, reviews_reports.created_at, ` + reviewColumns + `
+		FROM reviews_reports
+		INNER JOIN reviews ON reviews.id = reviews_reports.review_id
+		INNER JOIN users ON users.id = reviews.reviewer_id
+		ORDER BY reviews_reports.created_at, reviews_reports.id
+		LIMIT $1 OFFSET $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reports := []*ReviewReport{}
+	for rows.Next() {
+		report := ReviewReport{Review: &Review{}}
+		err := rows.Scan(
+			&totalRecords,
+			&report.ID,
+			&report.ReviewID,
+			&report.ReporterID,
+			&report.Reason,
+			&report.CreatedAt,
+			&report.Review.ID,
+			&report.Review.ListingID,
+			&report.Review.ReviewerID,
+			&report.Review.ReviewerName,
+			&report.Review.RevieweeID,
+			&report.Review.ReviewerRole,
+			&report.Review.Rating,
+			&report.Review.Text,
+			&report.Review.Reply,
+			&report.Review.RepliedAt,
+			&report.Review.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reports = append(reports, &report)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reports, metadata, nil
+}
+
+// DeleteReport dismisses a report without touching the review.
+func (m ReviewModel) DeleteReport(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM reviews_reports WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
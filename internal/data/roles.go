@@ -0,0 +1,252 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"letsgofurther/internal/validator"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRole     = errors.New("duplicate role")
+	ErrUnknownPermission = errors.New("unknown permission")
+)
+
+var RoleNameRX = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,49}$`)
+
+// The role every new user is given on signup.
+const DefaultRole = "user"
+
+// A Role bundles a set of permission codes under a name, such as "seller" or
+// "moderator", so that they can be granted to users together.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+func ValidateRoleName(v *validator.Validator, name string) {
+	v.Check(name != "", "name", "must be provided")
+	v.Check(validator.Matches(name, RoleNameRX), "name", "must be 2-50 lowercase letters, digits, dashes or underscores")
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	ValidateRoleName(v, role.Name)
+
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(len(role.Permissions) <= 50, "permissions", "must not contain more than 50 permissions")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+/* MODEL */
+
+type RoleModel struct {
+	DB DBTX
+}
+
+// Insert creates the role along with its permission grants. Every permission code has
+// to exist already, otherwise ErrUnknownPermission is returned and nothing is saved.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO roles (name, description) VALUES ($1, $2)
+		RETURNING id, created_at`,
+		role.Name, role.Description,
+	).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2);`,
+		role.ID, pq.Array([]string(role.Permissions)),
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if int(rowsnum) != len(role.Permissions) {
+		return ErrUnknownPermission
+	}
+
+	return tx.Commit()
+}
+
+// SelectAll returns every role together with its permission codes.
+func (m RoleModel) SelectAll() ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.name, roles.description, roles.created_at,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(
+			&role.ID,
+			&role.Name,
+			&role.Description,
+			&role.CreatedAt,
+			pq.Array((*[]string)(&role.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Delete removes a role. Users who had it lose its permissions straight away.
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrNotFoundRecord
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM roles WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// SelectAllForUser returns the names of the roles the user has.
+func (m RoleModel) SelectAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// AddForUser gives the user the named roles. Roles the user already has are left
+// alone. If any of the names doesn't exist, ErrNotFoundRecord is returned.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var found int
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM roles WHERE name = ANY($1)`, pq.Array(names)).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(names) {
+		return ErrNotFoundRecord
+	}
+
+	_, err = m.DB.ExecContext(
+		ctx,
+		`INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING;`,
+		userID, pq.Array(names),
+	)
+	return err
+}
+
+// RemoveForUser takes the named role away from the user, returning ErrNotFoundRecord
+// if the user didn't have it.
+func (m RoleModel) RemoveForUser(userID int64, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(
+		ctx,
+		`DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id AND users_roles.user_id = $1 AND roles.name = $2`,
+		userID, name,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
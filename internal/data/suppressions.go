@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"letsgofurther/internal/validator"
+	"time"
+)
+
+// The kinds of notification the mail provider sends about an address. Hard bounces and
+// complaints suppress the address; soft bounces, such as a full mailbox, are only
+// recorded.
+const (
+	EmailHardBounce = "hard_bounce"
+	EmailSoftBounce = "soft_bounce"
+	EmailComplaint  = "complaint"
+)
+
+// An EmailEvent is a bounce or complaint notification.
+type EmailEvent struct {
+	Type       string    `json:"type"`
+	Email      string    `json:"email"`
+	Diagnostic string    `json:"diagnostic"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// An EmailSuppression is an address nothing is sent to any more.
+type EmailSuppression struct {
+	Email      string    `json:"email"`
+	Reason     string    `json:"reason"`
+	Diagnostic string    `json:"diagnostic"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func ValidateEmailEvent(v *validator.Validator, event *EmailEvent) {
+	v.Check(validator.PermittedValue(event.Type, EmailHardBounce, EmailSoftBounce, EmailComplaint), "type", "must be hard_bounce, soft_bounce or complaint")
+	ValidateEmail(v, event.Email)
+	v.Check(len(event.Diagnostic) <= 1000, "diagnostic", "must not be more than 1000 bytes long")
+}
+
+/* MODEL */
+
+type EmailSuppressionModel struct {
+	DB DBTX
+}
+
+// RecordEvent stores the notification and, for hard bounces and complaints, suppresses
+// the address. It reports whether the address is suppressed now.
+func (m EmailSuppressionModel) RecordEvent(event *EmailEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO email_events (email, type, diagnostic, occurred_at) VALUES ($1, $2, $3, $4)`,
+		event.Email, event.Type, event.Diagnostic, event.OccurredAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if event.Type == EmailSoftBounce {
+		return false, tx.Commit()
+	}
+
+	// The first reason an address was suppressed for is kept.
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO email_suppressions (email, reason, diagnostic)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (email) DO NOTHING`,
+		event.Email, event.Type, event.Diagnostic,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Select returns the suppression of the address, or ErrNotFoundRecord if email can be
+// sent to it.
+func (m EmailSuppressionModel) Select(email string) (*EmailSuppression, error) {
+	query := `
+		SELECT email, reason, diagnostic, created_at
+		FROM email_suppressions
+		WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s EmailSuppression
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&s.Email, &s.Reason, &s.Diagnostic, &s.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &s, nil
+}
+
+// Suppressed reports whether the address is suppressed. It makes the model a
+// mailer.SuppressionList.
+func (m EmailSuppressionModel) Suppressed(email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var suppressed bool
+	err := m.DB.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM email_suppressions WHERE email = $1)`,
+		email,
+	).Scan(&suppressed)
+	return suppressed, err
+}
+
+// Delete lifts the suppression of the address, returning ErrNotFoundRecord if there is
+// none.
+func (m EmailSuppressionModel) Delete(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM email_suppressions WHERE email = $1`, email)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// A LoginThrottle counts the recent login attempts for one subject, which is either an
+// email address ("email:alice@example.com") or a client IP address ("ip:203.0.113.7").
+// Attempts are counted before the credentials are checked, so that guesses made in
+// parallel can't all slip through before the first of them is counted, and a correct
+// one is forgiven afterwards. Failures and LastFailedAt are thus really attempts.
+// Throttling by the email address as typed, rather than by user ID, means that
+// addresses which don't belong to any account behave exactly like ones that do, so
+// the lockout can't be used to find out who is registered.
+type LoginThrottle struct {
+	Subject      string     `json:"subject"`
+	UserID       *int64     `json:"user_id"`
+	Failures     int        `json:"failures"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
+
+// ThrottlePolicy describes how quickly failed logins slow down and then lock a subject.
+// Backing off is a short lock of its own: the subject may not try again until
+// LockedUntil either way.
+type ThrottlePolicy struct {
+	// Failures older than Window are forgotten.
+	Window time.Duration
+	// The first FreeAttempts failures aren't delayed at all. After that, each further
+	// failure doubles the wait, starting at BackoffBase, up to MaxBackoff.
+	FreeAttempts int
+	BackoffBase  time.Duration
+	MaxBackoff   time.Duration
+	// LockAfter failures within the window lock the subject for LockFor.
+	LockAfter int
+	LockFor   time.Duration
+}
+
+func EmailThrottleSubject(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func IPThrottleSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Locked reports whether the subject is currently locked out.
+func (t *LoginThrottle) Locked() bool {
+	return t.LockedUntil != nil && time.Now().Before(*t.LockedUntil)
+}
+
+/* MODEL */
+
+type LoginThrottleModel struct {
+	DB DBTX
+}
+
+// Select returns the throttles for the given subjects. Subjects without any recorded
+// failures are simply missing from the result.
+func (m LoginThrottleModel) Select(subjects ...string) ([]*LoginThrottle, error) {
+	query := `
+		SELECT subject, user_id, failures, last_failed_at, locked_until
+		FROM login_throttles
+		WHERE subject = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(subjects))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanLoginThrottles(rows)
+}
+
+// SelectActive returns every subject which is locked out or has failures inside the
+// given window, most recent first. It is used to show administrators what is going on.
+func (m LoginThrottleModel) SelectActive(window time.Duration) ([]*LoginThrottle, error) {
+	query := `
+		SELECT subject, user_id, failures, last_failed_at, locked_until
+		FROM login_throttles
+		WHERE locked_until > NOW() OR last_failed_at > $1
+		ORDER BY last_failed_at DESC
+		LIMIT 500`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now().Add(-window))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanLoginThrottles(rows)
+}
+
+func scanLoginThrottles(rows *sql.Rows) ([]*LoginThrottle, error) {
+	throttles := []*LoginThrottle{}
+	for rows.Next() {
+		var t LoginThrottle
+		err := rows.Scan(&t.Subject, &t.UserID, &t.Failures, &t.LastFailedAt, &t.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		throttles = append(throttles, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return throttles, nil
+}
+
+// RecordAttempt counts a login attempt for the subject, unless it is locked. Counting
+// and checking the lock is one statement, so that concurrent attempts are counted one
+// after the other, and each sees the locks set by those before it. The attempt which
+// takes the subject past the policy's free attempts locks it for the backoff, and the
+// one which reaches LockAfter locks it for LockFor. The counter starts again from one
+// when the previous attempt is older than the window.
+//
+// The returned bool is false if the subject was locked and the attempt wasn't counted.
+// The throttle is still returned then, to tell the client how long to wait.
+func (m LoginThrottleModel) RecordAttempt(subject string, userID *int64, p ThrottlePolicy) (*LoginThrottle, bool, error) {
+	query := `
+		INSERT INTO login_throttles (subject, user_id, failures, last_failed_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (subject) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failed_at < NOW() - make_interval(secs => $3) THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			user_id = COALESCE(EXCLUDED.user_id, login_throttles.user_id),
+			last_failed_at = NOW(),
+			locked_until = CASE
+				WHEN login_throttles.last_failed_at < NOW() - make_interval(secs => $3) THEN NULL
+				WHEN login_throttles.failures + 1 >= $7 THEN NOW() + make_interval(secs => $8)
+				WHEN login_throttles.failures + 1 > $4
+					THEN NOW() + make_interval(secs => LEAST($6, $5 * power(2, login_throttles.failures - $4)))
+				ELSE NULL
+			END
+		WHERE login_throttles.locked_until IS NULL OR login_throttles.locked_until <= NOW()
+		RETURNING subject, user_id, failures, last_failed_at, locked_until`
+
+	args := []any{
+		subject,
+		userID,
+		p.Window.Seconds(),
+		p.FreeAttempts,
+		p.BackoffBase.Seconds(),
+		p.MaxBackoff.Seconds(),
+		p.LockAfter,
+		p.LockFor.Seconds(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t LoginThrottle
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&t.Subject,
+		&t.UserID,
+		&t.Failures,
+		&t.LastFailedAt,
+		&t.LockedUntil,
+	)
+	switch {
+	case err == nil:
+		return &t, true, nil
+	// The WHERE clause kept the locked row from being updated.
+	case errors.Is(err, sql.ErrNoRows):
+		throttles, err := m.Select(subject)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(throttles) == 0 {
+			// Reset in the meantime; the client may simply try again.
+			return &LoginThrottle{Subject: subject}, false, nil
+		}
+		return throttles[0], false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// Forgive takes back one attempt counted for the subject, once its credentials have
+// turned out to be correct. Any lock the attempt set stays in force, so that entering
+// a known password again doesn't clear the way for guessing a two-factor code.
+func (m LoginThrottleModel) Forgive(subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE login_throttles SET failures = GREATEST(failures - 1, 0) WHERE subject = $1`,
+		subject,
+	)
+	return err
+}
+
+// Reset forgets the failures for a subject, after a successful login or when an
+// administrator lifts a lockout. It reports whether there was anything to forget.
+func (m LoginThrottleModel) Reset(subject string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM login_throttles WHERE subject = $1`, subject)
+	if err != nil {
+		return false, err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsnum > 0, nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"letsgofurther/internal/validator"
 	"time"
@@ -15,6 +14,14 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	// A short-lived token handed out after a correct password when the account has
+	// two-factor authentication on. It can only be exchanged, together with a TOTP
+	// or recovery code, for an authentication token.
+	ScopeTwoFactorPending = "2fa-pending"
+	// Sent to a user who has been invited to join an organization.
+	ScopeInvitation = "invitation"
+	// Protects the download link of a personal data export.
+	ScopeDataExport = "data-export"
 )
 
 // Define a Token struct to hold the data for an individual token. This includes the
@@ -79,7 +86,7 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
@@ -124,3 +131,37 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	)
 	return err
 }
+
+// SelectAllForUser() returns the user's unexpired tokens. Only the hashes are stored,
+// so the plaintext is never filled in; this is for showing what exists, not using it.
+func (m TokenModel) SelectAllForUser(userID int64) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(
+		ctx,
+		`SELECT hash, user_id, expiry, scope FROM tokens
+		WHERE user_id = $1 AND expiry > NOW()
+		ORDER BY expiry;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var tkn Token
+		err := rows.Scan(&tkn.Hash, &tkn.UserID, &tkn.Expiry, &tkn.Scope)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &tkn)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"letsgofurther/internal/validator"
+	"strings"
+	"time"
+)
+
+// The number of recovery codes handed out when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// TwoFactor holds a user's TOTP enrollment. The secret has to be stored in a form we
+// can read back, because the server computes the same HMAC as the authenticator app.
+// An enrollment only takes effect once it is Confirmed with a first valid code.
+type TwoFactor struct {
+	UserID      int64     `json:"-"`
+	Secret      []byte    `json:"-"`
+	Confirmed   bool      `json:"confirmed"`
+	LastCounter int64     `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Enabled reports whether logins for the user need a second factor.
+func (tf *TwoFactor) Enabled() bool {
+	return tf != nil && tf.Confirmed
+}
+
+// A two-factor code is either a 6 digit TOTP code or one of the recovery codes, which
+// look like "abcde-fghij-klmno-pqrst".
+func ValidateTwoFactorCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 32, "code", "must not be more than 32 bytes long")
+}
+
+// generateRecoveryCode returns a random, human friendly recovery code. As with tokens,
+// only the SHA-256 hash is stored in the database.
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 12)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	return code[0:5] + "-" + code[5:10] + "-" + code[10:15] + "-" + code[15:], nil
+}
+
+// Recovery codes are normalized before hashing so that users can type them in upper
+// case or without the dashes.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+/* MODEL */
+
+type TwoFactorModel struct {
+	DB DBTX
+}
+
+// SelectForUser returns the TOTP enrollment for the user, or ErrNotFoundRecord if they
+// never started one.
+func (m TwoFactorModel) SelectForUser(userID int64) (*TwoFactor, error) {
+	query := `
+		SELECT user_id, secret, confirmed, last_counter, created_at
+		FROM users_totp
+		WHERE user_id = $1`
+
+	var tf TwoFactor
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&tf.UserID,
+		&tf.Secret,
+		&tf.Confirmed,
+		&tf.LastCounter,
+		&tf.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &tf, nil
+}
+
+// Upsert stores a new, unconfirmed secret for the user. Starting the enrollment again
+// simply replaces a secret that was never confirmed.
+func (m TwoFactorModel) Upsert(tf *TwoFactor) error {
+	query := `
+		INSERT INTO users_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, confirmed = false, last_counter = 0, created_at = NOW()
+		RETURNING confirmed, last_counter, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, tf.UserID, tf.Secret).Scan(&tf.Confirmed, &tf.LastCounter, &tf.CreatedAt)
+}
+
+// UseCounter records that the code for the given time step has been used. The update
+// only succeeds if the counter is newer than the last one used, which stops a code
+// from being replayed within its validity window. An ErrEditConflict is returned for
+// a replayed code.
+func (m TwoFactorModel) UseCounter(userID int64, counter int64) error {
+	query := `
+		UPDATE users_totp
+		SET last_counter = $2
+		WHERE user_id = $1 AND last_counter < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Confirm switches the enrollment on and replaces any existing recovery codes with a
+// fresh set, all in one transaction. The plaintext recovery codes are returned so they
+// can be shown to the user exactly once.
+func (m TwoFactorModel) Confirm(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users_totp SET confirmed = true WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO recovery_codes (hash, user_id) VALUES ($1, $2)`,
+			hashRecoveryCode(code), userID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// ConsumeRecoveryCode deletes the matching recovery code, so each one works only once.
+// It reports whether a code was found.
+func (m TwoFactorModel) ConsumeRecoveryCode(userID int64, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx,
+		`DELETE FROM recovery_codes WHERE user_id = $1 AND hash = $2`,
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsnum > 0, nil
+}
+
+// Delete turns two-factor authentication off and removes the remaining recovery codes.
+func (m TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
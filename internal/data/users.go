@@ -2,8 +2,10 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"letsgofurther/internal/validator"
 	"time"
@@ -14,11 +16,13 @@ import (
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
+	ID        int64    `json:"id"`
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+	Password  password `json:"-"`
+	Activated bool     `json:"activated"`
+	// The language emails to the user are written in, such as "de".
+	Locale    string    `json:"locale"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Version   int16     `json:"-"`
@@ -46,6 +50,26 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
+// SetRandom sets a random password which nobody knows. It is used for accounts that
+// were created through a social login and so never sign in with a password.
+func (p *password) SetRandom() error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(base64.RawStdEncoding.EncodeToString(randomBytes)), 12)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = nil
+	p.hash = hash
+
+	return nil
+}
+
 func (p *password) Matches(plaintextPassword string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
 	if err != nil {
@@ -101,7 +125,7 @@ var (
 )
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and
@@ -110,11 +134,11 @@ type UserModel struct {
 // that we did when creating a listing.
 func (um UserModel) Insert(user *User) error {
 	query := `
-			INSERT INTO users (name, email, password_hash, activated) 
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO users (name, email, password_hash, activated, locale) 
+			VALUES ($1, $2, $3, $4, $5)
 			RETURNING id, created_at, version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -144,7 +168,7 @@ func (um UserModel) Insert(user *User) error {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (um UserModel) SelectByEmail(email string) (*User, error) {
 	query := `
-			SELECT id, created_at, name, email, password_hash, activated, version
+			SELECT id, created_at, name, email, password_hash, activated, locale, version
 			FROM users
 			WHERE email = $1`
 
@@ -160,6 +184,46 @@ func (um UserModel) SelectByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the User details from the database based on the user's ID.
+func (um UserModel) Select(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrNotFoundRecord
+	}
+
+	query := `
+			SELECT id, created_at, name, email, password_hash, activated, locale, version
+			FROM users
+			WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 
@@ -183,8 +247,8 @@ func (um UserModel) SelectByEmail(email string) (*User, error) {
 func (um UserModel) Update(user *User) error {
 	query := `
 			UPDATE users 
-			SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			WHERE id = $5 AND version = $6
+			SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5, version = version + 1
+			WHERE id = $6 AND version = $7
 			RETURNING version`
 
 	args := []any{
@@ -192,6 +256,7 @@ func (um UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
 		user.ID,
 		user.Version,
 	}
@@ -223,7 +288,7 @@ func (um UserModel) SelectForToken(tokenScope, tokenPlaintext string) (*User, er
 
 	row := um.DB.QueryRowContext(
 		ctx,
-		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		`SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -240,6 +305,7 @@ func (um UserModel) SelectForToken(tokenScope, tokenPlaintext string) (*User, er
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
 		&user.Version,
 	)
 	if err != nil {
@@ -0,0 +1,490 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"letsgofurther/internal/validator"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The domain events downstream systems can subscribe to. Their payload is the data of
+// the event.
+var WebhookEventTypes = []string{
+	EventListingCreated,
+	EventListingUpdated,
+	EventListingDeleted,
+	EventUserActivated,
+}
+
+// The states of a delivery. A pending delivery is retried until it succeeds or runs
+// out of attempts, at which point it fails.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// A Webhook is a subscription to events. The secret is only shown when the
+// subscription is created.
+type Webhook struct {
+	ID         int64     `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedBy  *int64    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	Version    int32     `json:"version"`
+}
+
+// A WebhookDelivery is one event on its way to one subscription. URL and Secret are
+// those of the subscription, filled in when the delivery is claimed.
+type WebhookDelivery struct {
+	ID            int64             `json:"id"`
+	WebhookID     int64             `json:"webhook_id"`
+	EventID       *int64            `json:"event_id"`
+	EventType     string            `json:"event_type"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt *time.Time        `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time        `json:"delivered_at"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Log           []*WebhookAttempt `json:"log,omitempty"`
+	URL           string            `json:"-"`
+	Secret        string            `json:"-"`
+}
+
+// A WebhookAttempt is the record of one try at a delivery. StatusCode is nil when no
+// response came back at all, and Error says why.
+type WebhookAttempt struct {
+	ID           int64     `json:"id"`
+	DeliveryID   int64     `json:"-"`
+	StatusCode   *int      `json:"status_code"`
+	Error        string    `json:"error,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+	DurationMS   int64     `json:"duration_ms"`
+	AttemptedAt  time.Time `json:"attempted_at"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	if webhook.URL != "" {
+		u, err := url.Parse(webhook.URL)
+		v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an absolute http or https URL")
+	}
+
+	v.Check(len(webhook.EventTypes) > 0, "event_types", "must contain at least one event type")
+	v.Check(validator.Unique(webhook.EventTypes), "event_types", "must not contain duplicate values")
+	for _, eventType := range webhook.EventTypes {
+		v.Check(validator.PermittedValue(eventType, WebhookEventTypes...), "event_types", "must only contain known event types")
+	}
+}
+
+/* MODEL */
+
+type WebhookModel struct {
+	DB DBTX
+}
+
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, event_types, active, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{webhook.URL, webhook.Secret, pq.Array(webhook.EventTypes), webhook.Active, webhook.CreatedBy}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Select returns the subscription, without its secret.
+func (m WebhookModel) Select(id int64) (*Webhook, error) {
+	query := `
+		SELECT id, url, event_types, active, created_by, created_at, version
+		FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook Webhook
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.URL,
+		pq.Array(&webhook.EventTypes),
+		&webhook.Active,
+		&webhook.CreatedBy,
+		&webhook.CreatedAt,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// SelectAll returns every subscription, without their secrets.
+func (m WebhookModel) SelectAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, url, event_types, active, created_by, created_at, version
+		FROM webhooks
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.URL,
+			pq.Array(&webhook.EventTypes),
+			&webhook.Active,
+			&webhook.CreatedBy,
+			&webhook.CreatedAt,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Update saves the URL, event types and active flag. The secret can't be changed.
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, event_types = $2, active = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{webhook.URL, pq.Array(webhook.EventTypes), webhook.Active, webhook.ID, webhook.Version}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the subscription together with its deliveries.
+func (m WebhookModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
+
+// Enqueue queues a delivery of the event for every active subscription to its type,
+// and returns how many were queued. The payload is marshalled now, so that it shows
+// the data as it was when the event happened however late it is delivered. An event
+// is only queued once for each subscription, so that it can safely be enqueued again
+// when dispatching it is retried.
+func (m WebhookModel) Enqueue(eventID int64, eventType string, payload any) (int64, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO webhooks_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT id, $1, $2, $3
+		FROM webhooks
+		WHERE active AND $2 = ANY(event_types)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, eventID, eventType, js)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Claim takes the pending delivery which has been waiting longest, if any is due, and
+// returns ErrNotFoundRecord if none is. It works like EmailOutboxModel.Claim: the
+// attempt is counted and the delivery leased to the caller, so that it comes back if
+// the caller dies. Deliveries to inactive subscriptions wait until they are active
+// again.
+func (m WebhookModel) Claim(lease time.Duration) (*WebhookDelivery, error) {
+	query := `
+		UPDATE webhooks_deliveries
+		SET attempts = webhooks_deliveries.attempts + 1, next_attempt_at = NOW() + $1 * interval '1 millisecond'
+		FROM webhooks
+		WHERE webhooks_deliveries.id = (
+			SELECT webhooks_deliveries.id
+			FROM webhooks_deliveries
+			INNER JOIN webhooks ON webhooks.id = webhooks_deliveries.webhook_id
+			WHERE webhooks_deliveries.status = 'pending' AND webhooks_deliveries.next_attempt_at <= NOW() AND webhooks.active
+			ORDER BY webhooks_deliveries.next_attempt_at, webhooks_deliveries.id
+			LIMIT 1
+			FOR UPDATE OF webhooks_deliveries SKIP LOCKED
+		) AND webhooks.id = webhooks_deliveries.webhook_id
+		RETURNING webhooks_deliveries.id, webhooks_deliveries.webhook_id, webhooks_deliveries.event_id, webhooks_deliveries.event_type,
+			webhooks_deliveries.payload, webhooks_deliveries.status, webhooks_deliveries.attempts,
+			webhooks_deliveries.created_at, webhooks.url, webhooks.secret`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var delivery WebhookDelivery
+	err := m.DB.QueryRowContext(ctx, query, lease.Milliseconds()).Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.CreatedAt,
+		&delivery.URL,
+		&delivery.Secret,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+
+	return &delivery, nil
+}
+
+// RecordAttempt logs an attempt at a delivery and moves the delivery to the given
+// status. A pending delivery is tried again at nextAttemptAt.
+func (m WebhookModel) RecordAttempt(attempt *WebhookAttempt, status string, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO webhooks_attempts (delivery_id, status_code, error, response_body, duration_ms)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, attempted_at`,
+		attempt.DeliveryID, attempt.StatusCode, attempt.Error, attempt.ResponseBody, attempt.DurationMS,
+	).Scan(&attempt.ID, &attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE webhooks_deliveries
+		SET status = $2, next_attempt_at = $3,
+			delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() ELSE delivered_at END
+		WHERE id = $1`,
+		attempt.DeliveryID, status, nextAttemptAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SelectDeliveries returns a page of the deliveries to the subscription, newest first.
+func (m WebhookModel) SelectDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, delivered_at, created_at
+		FROM webhooks_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var nextAttemptAt time.Time
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&nextAttemptAt,
+			&delivery.DeliveredAt,
+			&delivery.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if delivery.Status == WebhookDeliveryPending {
+			delivery.NextAttemptAt = &nextAttemptAt
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return deliveries, metadata, nil
+}
+
+// SelectDelivery returns the delivery with the log of its attempts, oldest first.
+func (m WebhookModel) SelectDelivery(id int64) (*WebhookDelivery, error) {
+	query := `
+		SELECT id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, delivered_at, created_at
+		FROM webhooks_deliveries
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var delivery WebhookDelivery
+	var nextAttemptAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&nextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFoundRecord
+		default:
+			return nil, err
+		}
+	}
+	if delivery.Status == WebhookDeliveryPending {
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+
+	rows, err := m.DB.QueryContext(
+		ctx,
+		`SELECT id, status_code, error, response_body, duration_ms, attempted_at
+		FROM webhooks_attempts
+		WHERE delivery_id = $1
+		ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	delivery.Log = []*WebhookAttempt{}
+	for rows.Next() {
+		attempt := WebhookAttempt{DeliveryID: id}
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.StatusCode,
+			&attempt.Error,
+			&attempt.ResponseBody,
+			&attempt.DurationMS,
+			&attempt.AttemptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Log = append(delivery.Log, &attempt)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// Redeliver queues the delivery again, whatever its status, with a fresh set of
+// attempts. The payload is sent as it was originally.
+func (m WebhookModel) Redeliver(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(
+		ctx,
+		`UPDATE webhooks_deliveries SET status = 'pending', attempts = 0, next_attempt_at = NOW() WHERE id = $1`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsnum, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsnum < 1 {
+		return ErrNotFoundRecord
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Package feed renders syndication feeds in the Atom (RFC 4287) and RSS 2.0 formats
+// from one description of the feed.
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"time"
+)
+
+const (
+	AtomContentType = "application/atom+xml; charset=utf-8"
+	RSSContentType  = "application/rss+xml; charset=utf-8"
+)
+
+// A Feed is a list of entries, the newest first. Its ID and the entries' IDs must never
+// change, since feed readers use them to tell which entries they have seen.
+type Feed struct {
+	ID          string
+	Title       string
+	Description string
+	// The URL the feed is served at, and the page it is about.
+	SelfURL string
+	Link    string
+	Entries []*Entry
+}
+
+type Entry struct {
+	ID         string
+	Title      string
+	Link       string
+	Summary    string
+	Categories []string
+	Published  time.Time
+	Updated    time.Time
+}
+
+// Updated returns when the feed last changed, which is when its most recently updated
+// entry did. It is the zero time for an empty feed.
+func (f *Feed) Updated() time.Time {
+	var updated time.Time
+	for _, e := range f.Entries {
+		if e.Updated.After(updated) {
+			updated = e.Updated
+		}
+	}
+	return updated
+}
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Summary string       `xml:"subtitle,omitempty"`
+	Updated string       `xml:"updated"`
+	Links   []atomLink   `xml:"link"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+}
+
+// Atom renders the feed as an Atom document.
+func Atom(f *Feed) ([]byte, error) {
+	updated := f.Updated()
+	if updated.IsZero() {
+		// Atom requires a date, and an empty feed has none. The Unix epoch at least
+		// stays the same from one request to the next.
+		updated = time.Unix(0, 0)
+	}
+
+	doc := atomFeed{
+		ID:      f.ID,
+		Title:   f.Title,
+		Summary: f.Description,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.SelfURL},
+			{Rel: "alternate", Href: f.Link},
+		},
+	}
+
+	for _, e := range f.Entries {
+		entry := &atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Links:     []atomLink{{Rel: "alternate", Href: e.Link}},
+			Summary:   e.Summary,
+			Published: e.Published.UTC().Format(time.RFC3339),
+			Updated:   e.Updated.UTC().Format(time.RFC3339),
+		}
+		for _, c := range e.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: c})
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+
+	return marshal(doc)
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	SelfLink      atomLink   `xml:"atom:link"`
+	LastBuildDate string     `xml:"lastBuildDate,omitempty"`
+	Items         []*rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description,omitempty"`
+	Categories  []string `xml:"category"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+// RSS renders the feed as an RSS 2.0 document. RSS has no notion of an entry being
+// updated, so readers only see that through the feed's lastBuildDate.
+func RSS(f *Feed) ([]byte, error) {
+	doc := rssDocument{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.Link,
+			Description: f.Description,
+			// The Atom namespace's self link is the recommended way for an RSS feed to
+			// name its own URL.
+			SelfLink: atomLink{Rel: "self", Type: "application/rss+xml", Href: f.SelfURL},
+		},
+	}
+	if updated := f.Updated(); !updated.IsZero() {
+		doc.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, e := range f.Entries {
+		doc.Channel.Items = append(doc.Channel.Items, &rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Summary,
+			Categories:  e.Categories,
+			// The entry's ID doubles as its permanent link only if the two are the same.
+			GUID:    rssGUID{IsPermaLink: e.ID == e.Link, Value: e.ID},
+			PubDate: e.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	return marshal(doc)
+}
+
+func marshal(doc any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
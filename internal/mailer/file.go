@@ -0,0 +1,220 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FileSender writes emails into a maildir on disk instead of sending them, so they can
+// be read with any mail client which understands the format (or just with cat) during
+// development.
+//
+// Following the maildir convention, each message is first written to the tmp
+// subdirectory and then renamed into new, so readers never see half-written files.
+type FileSender struct {
+	dir      string
+	hostname string
+	count    atomic.Int64
+}
+
+// NewFileSender creates the maildir at dir, if it doesn't exist yet.
+func NewFileSender(dir string) (*FileSender, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &FileSender{dir: dir, hostname: hostname}, nil
+}
+
+// Dir returns the maildir the sender writes to.
+func (s *FileSender) Dir() string {
+	return s.dir
+}
+
+func (s *FileSender) Send(msg *Message) error {
+	// Unique file names in the maildir style: time, process ID and a counter, and the
+	// host name. Sorting them by name sorts them by the time they were written.
+	name := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().UnixNano(), os.Getpid(), s.count.Add(1), s.hostname)
+	tmp := filepath.Join(s.dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, "new", name))
+}
+
+// A SpooledMessage is a message read back from a maildir. Name is its file name.
+type SpooledMessage struct {
+	Name string
+	Message
+}
+
+// ReadSpool reads the messages a FileSender wrote to the maildir at dir, newest first.
+// Messages which can't be parsed are skipped.
+func ReadSpool(dir string) ([]*SpooledMessage, error) {
+	var messages []*SpooledMessage
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			msg, err := readSpooledMessage(filepath.Join(dir, sub, entry.Name()))
+			if err != nil {
+				continue
+			}
+			msg.Name = entry.Name()
+			messages = append(messages, msg)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Date.After(messages[j].Date)
+	})
+
+	return messages, nil
+}
+
+// ReadSpooledMessage reads a single message from the maildir at dir by its file name.
+func ReadSpooledMessage(dir, name string) (*SpooledMessage, error) {
+	// Only plain file names, so that nothing outside the maildir can be read.
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fs.ErrNotExist
+	}
+
+	for _, sub := range []string{"new", "cur"} {
+		msg, err := readSpooledMessage(filepath.Join(dir, sub, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg.Name = name
+		return msg, nil
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+func readSpooledMessage(file string) (*SpooledMessage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var dec mime.WordDecoder
+	msg := &SpooledMessage{}
+
+	msg.To, _ = dec.DecodeHeader(m.Header.Get("To"))
+	msg.From, _ = dec.DecodeHeader(m.Header.Get("From"))
+	msg.Subject, _ = dec.DecodeHeader(m.Header.Get("Subject"))
+	msg.Date, _ = m.Header.Date()
+
+	err = readParts(&msg.Message, textproto.MIMEHeader(m.Header), m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// readParts fills in the message bodies from a MIME entity, descending into multipart
+// ones.
+func readParts(msg *Message, header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = readParts(msg, part.Header, part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The multipart reader already decodes quoted-printable parts, and removes the
+	// header when it does.
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case "text/plain":
+		msg.PlainBody = string(content)
+	case "text/html":
+		msg.HTMLBody = string(content)
+	}
+	return nil
+}
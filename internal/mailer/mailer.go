@@ -3,10 +3,13 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
+	"io/fs"
+	"sort"
+	"strings"
 	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold
@@ -18,44 +21,191 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for your emails (the name and address you
-// want the email to be from, such as "Alice Smith <alice@example.com>").
+// DefaultLocale is the language of the templates which have no locale in their file
+// name, such as "user_welcome.tmpl". Translations carry the locale before the
+// extension, such as "user_welcome.de.tmpl".
+const DefaultLocale = "en"
+
+// ErrSuppressed is returned by Send for recipients on the suppression list.
+var ErrSuppressed = errors.New("mailer: recipient address is suppressed")
+
+// A SuppressionList knows the addresses which must not be sent to any more, because
+// they bounced or their owner complained.
+type SuppressionList interface {
+	Suppressed(address string) (bool, error)
+}
+
+// The blocks every template file has to define.
+var templateBlocks = []string{"subject", "plainBody", "htmlBody"}
+
+// Define a Mailer struct which contains the Sender used to deliver emails, the
+// sender information for your emails (the name and address you want the email to be
+// from, such as "Alice Smith <alice@example.com>"), and the parsed templates, keyed by
+// file name.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	sender    Sender
+	from      string
+	templates map[string]*template.Template
+	locales   []string
+	// Optional; without one, every recipient is sent to.
+	suppressions SuppressionList
+}
+
+// New parses all the templates up front, so that a broken or incomplete template stops
+// the application from starting rather than surfacing when the first email is sent.
+func New(sender Sender, from string) (Mailer, error) {
+	templates, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return Mailer{}, err
+	}
+	return NewFromFS(sender, from, templates)
+}
+
+// NewFromFS is like New, but uses the templates in fsys rather than the embedded ones.
+// The mail preview server uses it to read the templates straight from disk.
+func NewFromFS(sender Sender, from string, fsys fs.FS) (Mailer, error) {
+	files, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return Mailer{}, err
+	}
+
+	templates := make(map[string]*template.Template, len(files))
+	locales := map[string]bool{DefaultLocale: true}
+
+	for _, name := range files {
+		// Use the ParseFS() method to parse the template file from the file system.
+		tmpl, err := template.New("email").ParseFS(fsys, name)
+		if err != nil {
+			return Mailer{}, err
+		}
+
+		for _, block := range templateBlocks {
+			if tmpl.Lookup(block) == nil {
+				return Mailer{}, fmt.Errorf("mailer: template %s has no %q block", name, block)
+			}
+		}
+
+		templates[name] = tmpl
+	}
+
+	for name := range templates {
+		if base, locale, ok := splitLocale(name); ok {
+			locales[locale] = true
+			if _, ok := templates[base]; !ok {
+				return Mailer{}, fmt.Errorf("mailer: template %s is a translation of %s, which doesn't exist", name, base)
+			}
+		}
+	}
+
+	m := Mailer{
+		sender:    sender,
+		from:      from,
+		templates: templates,
+	}
+	for locale := range locales {
+		m.locales = append(m.locales, locale)
+	}
+	sort.Strings(m.locales)
+
+	return m, nil
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
-	// also configure this to use a 5-second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// WithSuppressionList returns a copy of the mailer which doesn't send to the addresses
+// on the list.
+func (m Mailer) WithSuppressionList(list SuppressionList) Mailer {
+	m.suppressions = list
+	return m
+}
 
-	// Return a Mailer instance containing the dialer and sender information.
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+// splitLocale splits a translated template's file name, such as "user_welcome.de.tmpl",
+// into the name of the default template and the locale: "user_welcome.tmpl" and "de".
+func splitLocale(name string) (base, locale string, ok bool) {
+	stem := strings.TrimSuffix(name, ".tmpl")
+	i := strings.LastIndexByte(stem, '.')
+	if i < 0 {
+		return "", "", false
 	}
+	return stem[:i] + ".tmpl", strings.ToLower(stem[i+1:]), true
+}
+
+// Templates returns the names of the default templates, such as "user_welcome.tmpl",
+// without the translations.
+func (m Mailer) Templates() []string {
+	var names []string
+	for name := range m.templates {
+		if _, _, ok := splitLocale(name); !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Locales returns the locales there are templates for, including DefaultLocale.
+func (m Mailer) Locales() []string {
+	return m.locales
+}
+
+// lookup returns the template for the locale. A locale with a region, such as "de-at",
+// falls back to the language, "de", and then to the default template.
+func (m Mailer) lookup(templateFile, locale string) (*template.Template, error) {
+	stem := strings.TrimSuffix(templateFile, ".tmpl")
+
+	locale = strings.ToLower(locale)
+	for locale != "" {
+		if tmpl, ok := m.templates[stem+"."+locale+".tmpl"]; ok {
+			return tmpl, nil
+		}
+
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+
+	tmpl, ok := m.templates[templateFile]
+	if !ok {
+		return nil, fmt.Errorf("mailer: no template %s", templateFile)
+	}
+	return tmpl, nil
 }
 
 // Define a Send() method on the Mailer type. This takes the recipient email address
-// as the first parameter, the name of the file containing the templates, and any
-// dynamic data for the templates as an any parameter.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
-	// Use the ParseFS() method to parse the required template file from the embedded
-	// file system.
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// as the first parameter, the name of the file containing the templates, the locale of
+// the recipient, and any dynamic data for the templates as an any parameter. Nothing is
+// sent to suppressed recipients; ErrSuppressed is returned instead.
+func (m Mailer) Send(recipient, templateFile, locale string, data any) error {
+	if m.suppressions != nil {
+		suppressed, err := m.suppressions.Suppressed(recipient)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			return ErrSuppressed
+		}
+	}
+
+	msg, err := m.Render(recipient, templateFile, locale, data)
 	if err != nil {
 		return err
 	}
+	return m.sender.Send(msg)
+}
+
+// Render executes the template without sending the result.
+func (m Mailer) Render(recipient, templateFile, locale string, data any) (*Message, error) {
+	tmpl, err := m.lookup(templateFile, locale)
+	if err != nil {
+		return nil, err
+	}
 
 	// Execute the named template "subject", passing in the dynamic data and storing the
 	// result in a bytes.Buffer variable.
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Follow the same pattern to execute the "plainBody" template and store the result
@@ -63,40 +213,22 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
-	}
-
-	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
-	// Then we use the SetHeader() method to set the email recipient, sender and subject
-	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
-	// method to set the HTML body. It's important to note that AddAlternative() should
-	// always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Try sending the email up to three times before aborting and returning the final
-	// error. We sleep for 500 milliseconds between each attempt.
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		// If everything worked, return nil.
-		if nil == err {
-			return nil
-		}
-
-		// If it didn't work, sleep for a short time and retry.
-		time.Sleep(time.Duration(10*i) * time.Second)
+		return nil, err
 	}
 
-	return err
+	return &Message{
+		To:        recipient,
+		From:      m.from,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Date:      time.Now(),
+	}, nil
 }
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testFrom = "Diggo <info@diggo.com>"
+
+var welcomeData = map[string]any{"userID": 42, "activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"}
+
+// A suppressionList suppresses the addresses in it.
+type suppressionList map[string]bool
+
+func (l suppressionList) Suppressed(address string) (bool, error) {
+	return l[address], nil
+}
+
+func TestSend(t *testing.T) {
+	sender := NewMemorySender()
+	m, err := New(sender, testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send("alice@example.com", "user_welcome.tmpl", DefaultLocale, welcomeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := sender.Last("alice@example.com")
+	if msg == nil {
+		t.Fatal("no email was sent to alice@example.com")
+	}
+	if msg.From != testFrom || msg.Subject != "Diggo welcomes you!" {
+		t.Errorf("got from %q, subject %q", msg.From, msg.Subject)
+	}
+	for name, body := range map[string]string{"plain": msg.PlainBody, "HTML": msg.HTMLBody} {
+		if !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") || !strings.Contains(body, "42") {
+			t.Errorf("the %s body doesn't contain the user ID and token: %s", name, body)
+		}
+	}
+
+	if got := sender.Last("bob@example.com"); got != nil {
+		t.Errorf("got an email to bob@example.com: %+v", got)
+	}
+}
+
+func TestSendLocale(t *testing.T) {
+	tests := []struct {
+		locale  string
+		subject string
+	}{
+		{"en", "Diggo welcomes you!"},
+		{"de", "Willkommen bei Diggo!"},
+		{"DE", "Willkommen bei Diggo!"},
+		// A region falls back to the language...
+		{"de-at", "Willkommen bei Diggo!"},
+		// ...and a language without translations to the default templates.
+		{"fr", "Diggo welcomes you!"},
+		{"", "Diggo welcomes you!"},
+	}
+
+	sender := NewMemorySender()
+	m, err := New(sender, testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		err := m.Send("alice@example.com", "user_welcome.tmpl", tt.locale, welcomeData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sender.Last("alice@example.com").Subject; got != tt.subject {
+			t.Errorf("locale %q: got subject %q; want %q", tt.locale, got, tt.subject)
+		}
+	}
+
+	if got := len(sender.Messages()); got != len(tests) {
+		t.Errorf("got %d emails; want %d", got, len(tests))
+	}
+	sender.Reset()
+	if got := len(sender.Messages()); got != 0 {
+		t.Errorf("got %d emails after Reset; want none", got)
+	}
+}
+
+func TestSendSuppressed(t *testing.T) {
+	sender := NewMemorySender()
+	m, err := New(sender, testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = m.WithSuppressionList(suppressionList{"bounced@example.com": true})
+
+	err = m.Send("bounced@example.com", "user_welcome.tmpl", DefaultLocale, welcomeData)
+	if !errors.Is(err, ErrSuppressed) {
+		t.Errorf("got error %v; want %v", err, ErrSuppressed)
+	}
+	err = m.Send("alice@example.com", "user_welcome.tmpl", DefaultLocale, welcomeData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := sender.Messages()
+	if len(messages) != 1 || messages[0].To != "alice@example.com" {
+		t.Errorf("got %d emails; want just the one to alice@example.com", len(messages))
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	sender := NewMemorySender()
+	m, err := New(sender, testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Send("alice@example.com", "no_such_template.tmpl", DefaultLocale, nil)
+	if err == nil {
+		t.Error("got no error for a template which doesn't exist")
+	}
+	if got := len(sender.Messages()); got != 0 {
+		t.Errorf("got %d emails; want none", got)
+	}
+}
+
+// Every email is available in German.
+func TestGermanTranslations(t *testing.T) {
+	m, err := New(NewMemorySender(), testFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range m.Templates() {
+		stem := strings.TrimSuffix(name, ".tmpl")
+		if _, ok := m.templates[stem+".de.tmpl"]; !ok {
+			t.Errorf("%s has no German translation", name)
+		}
+	}
+}
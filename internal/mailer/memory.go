@@ -0,0 +1,53 @@
+package mailer
+
+import "sync"
+
+// MemorySender keeps the emails it is given in memory instead of sending them, so
+// tests can check what would have been sent.
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages returns the emails sent so far, oldest first.
+func (s *MemorySender) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]*Message, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
+
+// Last returns the most recent email sent to the recipient, or nil if there is none.
+func (s *MemorySender) Last(recipient string) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].To == recipient {
+			return s.messages[i]
+		}
+	}
+	return nil
+}
+
+// Reset forgets all emails sent so far.
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+}
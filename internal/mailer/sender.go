@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"io"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// A Message is a fully rendered email, ready to be handed to a Sender.
+type Message struct {
+	To        string
+	From      string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	Date      time.Time
+}
+
+// Sender is implemented by anything that can deliver a rendered email: an SMTP server
+// in production, and a directory on disk or memory in development and tests.
+type Sender interface {
+	Send(msg *Message) error
+}
+
+// WriteTo writes the message to w in the RFC 5322 format, with the plain-text and the
+// HTML bodies as alternative parts.
+func (msg *Message) WriteTo(w io.Writer) (int64, error) {
+	return msg.mailMessage().WriteTo(w)
+}
+
+func (msg *Message) mailMessage() *mail.Message {
+	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
+	// Then we use the SetHeader() method to set the email recipient, sender and subject
+	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
+	// method to set the HTML body. It's important to note that AddAlternative() should
+	// always be called *after* SetBody().
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetDateHeader("Date", msg.Date)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+	return m
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// SMTPSender delivers emails through an SMTP server.
+type SMTPSender struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPSender(host string, port int, username, password string) *SMTPSender {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPSender{dialer: dialer}
+}
+
+// Send makes a single attempt at delivering the email. Retrying is left to the caller,
+// which knows better how long it can afford to wait.
+func (s *SMTPSender) Send(msg *Message) error {
+	return s.dialer.DialAndSend(msg.mailMessage())
+}
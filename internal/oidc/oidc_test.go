@@ -0,0 +1,387 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "diggo-test"
+
+// A mockIssuer is an OpenID Connect provider which lets every user in: its
+// authorization endpoint isn't visited, authorize() hands out codes directly. Its
+// token endpoint checks the PKCE verifier like a real provider does.
+type mockIssuer struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa-1", "use": "sig", "alg": "RS256",
+				"n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC", "kid": "ec-1", "use": "sig", "alg": "ES256", "crv": "P-256",
+				"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		}})
+	})
+	mux.HandleFunc("/token", m.token)
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize() does what the authorization endpoint does when the user agrees: it
+// remembers the PKCE challenge and the nonce of the request, and returns a code.
+func (m *mockIssuer) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := u.Query()
+	if params.Get("code_challenge_method") != "S256" || params.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + params.Get("state")
+	m.codes[code] = mockGrant{challenge: params.Get("code_challenge"), nonce: params.Get("nonce")}
+	return code
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || b64(sum[:]) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	claims := m.claims(grant.nonce)
+	claims["email"] = "alice@example.com"
+	claims["email_verified"] = true
+	claims["name"] = "Alice Smith"
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign("RS256", "rsa-1", claims), "token_type": "Bearer"})
+}
+
+// sign() returns an ID token with the claims, signed with the issuer's key of the
+// algorithm.
+func (m *mockIssuer) sign(alg, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, m.ecKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(signature)
+}
+
+func (m *mockIssuer) claims(nonce string) map[string]any {
+	return map[string]any{
+		"iss":   m.URL,
+		"sub":   "user-1",
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": nonce,
+	}
+}
+
+func (m *mockIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Name:        "mock",
+		Issuer:      m.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost:4000/v1/oidc/mock/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	ar, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") || !strings.Contains(authURL, "scope=openid+email") {
+		t.Errorf("got authorization URL %s", authURL)
+	}
+
+	claims, err := p.Exchange(ctx, issuer.authorize(t, authURL), ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !bool(claims.EmailVerified) || claims.Name != "Alice Smith" {
+		t.Errorf("got claims %+v", claims)
+	}
+}
+
+func TestExchangePKCEMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	ar, _ := NewAuthRequest()
+	authURL, err := p.AuthCodeURL(ctx, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.authorize(t, authURL)
+
+	// Someone who intercepted the code doesn't have the verifier.
+	other, _ := NewAuthRequest()
+	other.Nonce = ar.Nonce
+
+	_, err = p.Exchange(ctx, code, other)
+	if !errors.Is(err, ErrExchange) {
+		t.Errorf("got %v; want ErrExchange", err)
+	}
+}
+
+func TestExchangeNonceMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	ar, _ := NewAuthRequest()
+	authURL, err := p.AuthCodeURL(ctx, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.authorize(t, authURL)
+
+	// The ID token carries the nonce of the authorization request, which isn't the
+	// one of this login.
+	ar.Nonce = "another-login"
+
+	_, err = p.Exchange(ctx, code, ar)
+	if !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("got %v; want a nonce mismatch", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := issuer.provider()
+	ctx := context.Background()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes map[string]any) map[string]any {
+		claims := issuer.claims("n-1")
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		valid bool
+	}{
+		{"RS256", func() string { return issuer.sign("RS256", "rsa-1", with(nil)) }, true},
+		{"ES256", func() string { return issuer.sign("ES256", "ec-1", with(nil)) }, true},
+		{"audience list with azp", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"aud": []string{testClientID, "other"}, "azp": testClientID}))
+		}, true},
+		{"within leeway", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"exp": time.Now().Add(-30 * time.Second).Unix()}))
+		}, true},
+		{"bad signature", func() string {
+			token := issuer.sign("RS256", "rsa-1", with(nil))
+			saved := issuer.rsaKey
+			issuer.rsaKey = otherKey
+			forged := issuer.sign("RS256", "rsa-1", with(nil))
+			issuer.rsaKey = saved
+			return token[:strings.LastIndex(token, ".")] + forged[strings.LastIndex(forged, "."):]
+		}, false},
+		{"tampered claims", func() string {
+			parts := strings.Split(issuer.sign("RS256", "rsa-1", with(nil)), ".")
+			payload, _ := json.Marshal(with(map[string]any{"sub": "admin"}))
+			return parts[0] + "." + b64(payload) + "." + parts[2]
+		}, false},
+		{"alg none", func() string {
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa-1"})
+			payload, _ := json.Marshal(with(nil))
+			return b64(header) + "." + b64(payload) + "."
+		}, false},
+		{"HS256 keyed with the public key", func() string {
+			header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa-1"})
+			payload, _ := json.Marshal(with(nil))
+			input := b64(header) + "." + b64(payload)
+			mac := hmac.New(sha256.New, issuer.rsaKey.PublicKey.N.Bytes())
+			mac.Write([]byte(input))
+			return input + "." + b64(mac.Sum(nil))
+		}, false},
+		{"RS256 header on the EC key", func() string {
+			token := issuer.sign("ES256", "ec-1", with(nil))
+			parts := strings.Split(token, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "ec-1"})
+			return b64(header) + "." + parts[1] + "." + parts[2]
+		}, false},
+		{"unknown key", func() string { return issuer.sign("RS256", "rsa-2", with(nil)) }, false},
+		{"other issuer", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"iss": "https://evil.example.com"}))
+		}, false},
+		{"other audience", func() string { return issuer.sign("RS256", "rsa-1", with(map[string]any{"aud": "other"})) }, false},
+		{"audience list without azp", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"aud": []string{testClientID, "other"}}))
+		}, false},
+		{"no subject", func() string { return issuer.sign("RS256", "rsa-1", with(map[string]any{"sub": ""})) }, false},
+		{"expired", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"exp": time.Now().Add(-2 * time.Minute).Unix()}))
+		}, false},
+		{"issued in the future", func() string {
+			return issuer.sign("RS256", "rsa-1", with(map[string]any{"iat": time.Now().Add(5 * time.Minute).Unix()}))
+		}, false},
+		{"no nonce", func() string { return issuer.sign("RS256", "rsa-1", with(map[string]any{"nonce": nil})) }, false},
+		{"malformed", func() string { return "not-a-token" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Verify(ctx, tt.token(), "n-1")
+			switch {
+			case tt.valid && err != nil:
+				t.Errorf("got %v; want a valid token", err)
+			case !tt.valid && !errors.Is(err, ErrInvalidToken):
+				t.Errorf("got %v; want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+
+	// A discovery document which names another issuer than the one it was fetched
+	// from.
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	}))
+	defer impostor.Close()
+
+	p := NewProvider(Config{Name: "mock", Issuer: impostor.URL, ClientID: testClientID, RedirectURL: "http://localhost"})
+
+	ar, _ := NewAuthRequest()
+	_, err := p.AuthCodeURL(context.Background(), ar)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("got %v; want an issuer mismatch", err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("name=google,issuer=https://accounts.google.com/,client-id=abc,client-secret=s3cret,redirect-url=https://example.com/cb,scopes=openid email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "google" || cfg.Issuer != "https://accounts.google.com" || cfg.ClientID != "abc" ||
+		cfg.ClientSecret != "s3cret" || cfg.RedirectURL != "https://example.com/cb" || strings.Join(cfg.Scopes, " ") != "openid email" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		"name=google,issuer=https://accounts.google.com,client-id=abc",
+		"name=google,issuer=https://accounts.google.com,client-id=abc,redirect-url=https://example.com/cb,colour=blue",
+		"name=google,issuer",
+	} {
+		_, err := ParseConfig(bad)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParseConfig(%q) = %v; want ErrInvalidConfig", bad, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package pubsub fans out PostgreSQL notifications (LISTEN/NOTIFY) to in-process
+// subscribers. Every API instance runs one Listener, so anything published with Notify
+// reaches all of them, which is how state such as caches is kept coherent across
+// instances.
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Handler is called with the payload of every notification on a subscribed channel.
+// Handlers run on the listener's goroutine, so they must not block.
+type Handler func(payload string)
+
+type Listener struct {
+	listener *pq.Listener
+
+	mu          sync.RWMutex
+	handlers    map[string][]Handler
+	onReconnect []func()
+	onError     func(error)
+}
+
+// NewListener opens a dedicated connection for LISTEN, separate from the sql.DB pool.
+// If the connection drops it is re-established automatically, and the OnReconnect
+// callbacks run since notifications sent in the meantime were lost.
+func NewListener(dsn string, onError func(error)) *Listener {
+	l := &Listener{
+		handlers: make(map[string][]Handler),
+		onError:  onError,
+	}
+
+	l.listener = pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil && l.onError != nil {
+			l.onError(err)
+		}
+	})
+
+	return l
+}
+
+// Subscribe registers a handler for a channel, issuing LISTEN the first time the
+// channel is subscribed to.
+func (l *Listener) Subscribe(channel string, fn Handler) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.handlers[channel]; !ok {
+		err := l.listener.Listen(channel)
+		if err != nil && err != pq.ErrChannelAlreadyOpen {
+			return err
+		}
+	}
+
+	l.handlers[channel] = append(l.handlers[channel], fn)
+	return nil
+}
+
+// OnReconnect registers a function to be called after the connection was lost and
+// re-established.
+func (l *Listener) OnReconnect(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.onReconnect = append(l.onReconnect, fn)
+}
+
+// Run dispatches notifications until the context is cancelled. It also pings the
+// connection every 90 seconds when idle, to notice a dead connection in time.
+func (l *Listener) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-l.listener.Notify:
+			l.mu.RLock()
+			// A nil notification means the connection was re-established.
+			if n == nil {
+				for _, fn := range l.onReconnect {
+					fn()
+				}
+			} else {
+				for _, fn := range l.handlers[n.Channel] {
+					fn(n.Extra)
+				}
+			}
+			l.mu.RUnlock()
+		case <-time.After(90 * time.Second):
+			go func() {
+				err := l.listener.Ping()
+				if err != nil && l.onError != nil {
+					l.onError(err)
+				}
+			}()
+		}
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Notify publishes a payload on a channel to every listening instance, including this
+// one. When called with a transaction, the notification is only delivered if and when
+// the transaction commits. Postgres limits payloads to just under 8000 bytes.
+func Notify(ctx context.Context, db Execer, channel, payload string) error {
+	_, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
@@ -0,0 +1,155 @@
+// Package totp implements the time-based one-time password algorithm described in
+// RFC 6238, which in turn builds on the HMAC-based one-time password algorithm from
+// RFC 4226. It is compatible with the common authenticator apps (Google
+// Authenticator, Authy, 1Password, ...) when used with the Default configuration.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SecretSize is the number of random bytes in a generated secret. RFC 4226 requires
+// at least 128 bits and recommends 160 bits, which is also the SHA-1 block output
+// size.
+const SecretSize = 20
+
+var ErrInvalidSecret = errors.New("totp: invalid secret")
+
+// Config holds the parameters of the algorithm. Authenticator apps generally only
+// support the defaults, but the RFC test vectors also exercise 8 digits together with
+// SHA-256 and SHA-512, so the parameters are kept configurable.
+type Config struct {
+	Digits int
+	Period time.Duration
+	Hash   func() hash.Hash
+	// Algorithm is the name of the hash function as it appears in the otpauth://
+	// URI ("SHA1", "SHA256" or "SHA512").
+	Algorithm string
+}
+
+// Default is the configuration understood by every mainstream authenticator app:
+// 6 digits, a 30 second time step and HMAC-SHA1.
+var Default = Config{
+	Digits:    6,
+	Period:    30 * time.Second,
+	Hash:      sha1.New,
+	Algorithm: "SHA1",
+}
+
+var powers = [...]uint32{1, 10, 100, 1_000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000, 1_000_000_000}
+
+// Counter returns the time step number T for the given time, i.e. the number of
+// whole periods elapsed since the Unix epoch (T0 = 0).
+func (c Config) Counter(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(c.Period/time.Second)
+}
+
+// HOTP computes the RFC 4226 one-time password for the given key and counter value,
+// zero-padded to the configured number of digits.
+func (c Config) HOTP(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(c.Hash, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low four bits of the last byte select an offset, and
+	// the 31 bits starting at that offset form the binary code.
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", c.Digits, code%powers[c.Digits])
+}
+
+// Code returns the one-time password which is valid at time t.
+func (c Config) Code(key []byte, t time.Time) string {
+	return c.HOTP(key, c.Counter(t))
+}
+
+// Validate checks a user supplied code against the codes for time t and up to skew
+// periods either side of it, to allow for clock drift and the time it takes to type
+// the code in. On success the matching counter value is returned so that callers can
+// reject a code which has already been used.
+func (c Config) Validate(key []byte, code string, t time.Time, skew int) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != c.Digits {
+		return 0, false
+	}
+
+	current := c.Counter(t)
+	for i := -skew; i <= skew; i++ {
+		if i < 0 && uint64(-i) > current {
+			continue
+		}
+		counter := current + uint64(i)
+		// Compare in constant time so that the response time doesn't reveal how
+		// many leading digits were right.
+		if subtle.ConstantTimeCompare([]byte(c.HOTP(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// URI returns the otpauth:// key URI which authenticator apps import, usually by
+// scanning it as a QR code. See
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func (c Config) URI(issuer, account string, key []byte) string {
+	params := url.Values{}
+	params.Set("secret", EncodeSecret(key))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", c.Algorithm)
+	params.Set("digits", fmt.Sprint(c.Digits))
+	params.Set("period", fmt.Sprint(int(c.Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// GenerateSecret returns SecretSize bytes from the operating system's CSPRNG.
+func GenerateSecret() ([]byte, error) {
+	key := make([]byte, SecretSize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EncodeSecret returns the unpadded base-32 form of the key, which is what users
+// type into an authenticator app when they can't scan the QR code.
+func EncodeSecret(key []byte) string {
+	return encoding.EncodeToString(key)
+}
+
+// DecodeSecret reverses EncodeSecret. It is lenient about case, spaces and padding
+// since the secret may have been copied by hand.
+func DecodeSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	s = strings.TrimRight(s, "=")
+	key, err := encoding.DecodeString(s)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
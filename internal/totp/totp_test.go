@@ -0,0 +1,143 @@
+package totp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The seeds of RFC 6238 Appendix B, which are the ASCII digits repeated to the output
+// size of each hash function.
+var (
+	seedSHA1   = []byte("12345678901234567890")
+	seedSHA256 = []byte("12345678901234567890123456789012")
+	seedSHA512 = []byte("1234567890123456789012345678901234567890123456789012345678901234")
+)
+
+func TestCodeRFC6238(t *testing.T) {
+	configs := map[string]Config{
+		"SHA1":   {Digits: 8, Period: 30 * time.Second, Hash: sha1.New, Algorithm: "SHA1"},
+		"SHA256": {Digits: 8, Period: 30 * time.Second, Hash: sha256.New, Algorithm: "SHA256"},
+		"SHA512": {Digits: 8, Period: 30 * time.Second, Hash: sha512.New, Algorithm: "SHA512"},
+	}
+	seeds := map[string][]byte{
+		"SHA1":   seedSHA1,
+		"SHA256": seedSHA256,
+		"SHA512": seedSHA512,
+	}
+
+	tests := []struct {
+		unix int64
+		mode string
+		want string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, tt := range tests {
+		got := configs[tt.mode].Code(seeds[tt.mode], time.Unix(tt.unix, 0))
+		if got != tt.want {
+			t.Errorf("T=%d %s: got %s; want %s", tt.unix, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	counter := Default.Counter(now)
+
+	tests := []struct {
+		name   string
+		offset int
+		skew   int
+		valid  bool
+	}{
+		{"current period", 0, 0, true},
+		{"previous period without skew", -1, 0, false},
+		{"previous period", -1, 1, true},
+		{"next period", 1, 1, true},
+		{"two periods back", -2, 1, false},
+		{"two periods ahead", 2, 1, false},
+		{"two periods back with skew 2", -2, 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := Default.HOTP(seedSHA1, uint64(int64(counter)+int64(tt.offset)))
+
+			got, ok := Default.Validate(seedSHA1, code, now, tt.skew)
+			if ok != tt.valid {
+				t.Fatalf("got valid %t; want %t", ok, tt.valid)
+			}
+			if ok && got != uint64(int64(counter)+int64(tt.offset)) {
+				t.Errorf("got counter %d; want %d", got, int64(counter)+int64(tt.offset))
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := Default.Code(seedSHA1, now)
+
+	for _, bad := range []string{"", code[:5], code + "0", strings.Repeat("x", 6)} {
+		if _, ok := Default.Validate(seedSHA1, bad, now, 1); ok {
+			t.Errorf("code %q was accepted", bad)
+		}
+	}
+
+	// Surrounding whitespace, as pasted from an authenticator app, is fine.
+	if _, ok := Default.Validate(seedSHA1, " "+code+"\n", now, 0); !ok {
+		t.Errorf("code %q with whitespace was rejected", code)
+	}
+}
+
+func TestValidateNearEpoch(t *testing.T) {
+	// At T=0 there is no previous period, which must not wrap around.
+	now := time.Unix(10, 0)
+	code := Default.Code(seedSHA1, now)
+
+	got, ok := Default.Validate(seedSHA1, code, now, 1)
+	if !ok || got != 0 {
+		t.Errorf("got (%d, %t); want (0, true)", got, ok)
+	}
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	key, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := EncodeSecret(key)
+	// Users may type the secret in lower case and in groups.
+	typed := strings.ToLower(encoded[:4] + " " + encoded[4:])
+
+	decoded, err := DecodeSecret(typed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != string(key) {
+		t.Errorf("got %x; want %x", decoded, key)
+	}
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+func TestSignature(t *testing.T) {
+	// HMAC-SHA256("whsec_test", "1700000000.{}"), as computed by Python's hmac module.
+	got := Signature(testSecret, time.Unix(1700000000, 0), []byte("{}"))
+	want := "sha256=35495024f4ef3f94e5a93e22221544c4b75e9a42300cd965ab81cb85cd994e91"
+	if got != want {
+		t.Fatalf("got %s; want %s", got, want)
+	}
+
+	// The signature covers the timestamp, the body and the secret.
+	for name, other := range map[string]string{
+		"timestamp": Signature(testSecret, time.Unix(1700000001, 0), []byte("{}")),
+		"body":      Signature(testSecret, time.Unix(1700000000, 0), []byte("{ }")),
+		"secret":    Signature("whsec_other", time.Unix(1700000000, 0), []byte("{}")),
+	} {
+		if other == got {
+			t.Errorf("changing the %s didn't change the signature", name)
+		}
+	}
+}
+
+// A receiver verifies what a sender signed, over HTTP.
+func TestSignAndVerify(t *testing.T) {
+	now := time.Now()
+
+	received := make(chan error, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			received <- err
+			return
+		}
+		received <- Verify(r.Header, testSecret, body, 5*time.Minute, now)
+	}))
+	defer receiver.Close()
+
+	body := `{"id":1,"event":"listing.created"}`
+	req, err := http.NewRequest(http.MethodPost, receiver.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sign(req.Header, testSecret, now, []byte(body))
+
+	if got := req.Header.Get(HeaderTimestamp); got != strconv.FormatInt(now.Unix(), 10) {
+		t.Errorf("got timestamp header %q; want %d", got, now.Unix())
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if err := <-received; err != nil {
+		t.Errorf("receiver rejected the request: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":1}`)
+
+	signed := func(secret string, at time.Time) http.Header {
+		header := make(http.Header)
+		Sign(header, secret, at, body)
+		return header
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		want   error
+	}{
+		{"valid", signed(testSecret, now), body, nil},
+		{"within tolerance", signed(testSecret, now.Add(-4*time.Minute)), body, nil},
+		{"clock ahead within tolerance", signed(testSecret, now.Add(4*time.Minute)), body, nil},
+		{"too old", signed(testSecret, now.Add(-6*time.Minute)), body, ErrTooOld},
+		{"too far ahead", signed(testSecret, now.Add(6*time.Minute)), body, ErrTooOld},
+		{"wrong secret", signed("whsec_other", now), body, ErrInvalidSignature},
+		{"tampered body", signed(testSecret, now), []byte(`{"id":2}`), ErrInvalidSignature},
+		{"no headers", http.Header{}, body, ErrMissingSignature},
+		{"no prefix", http.Header{
+			HeaderSignature: {strings.TrimPrefix(signed(testSecret, now).Get(HeaderSignature), signaturePrefix)},
+			HeaderTimestamp: {strconv.FormatInt(now.Unix(), 10)},
+		}, body, ErrMissingSignature},
+		{"bad timestamp", http.Header{
+			HeaderSignature: {signed(testSecret, now).Get(HeaderSignature)},
+			HeaderTimestamp: {"yesterday"},
+		}, body, ErrMissingSignature},
+		{"timestamp changed", http.Header{
+			HeaderSignature: {signed(testSecret, now).Get(HeaderSignature)},
+			HeaderTimestamp: {strconv.FormatInt(now.Unix()+1, 10)},
+		}, body, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.header, testSecret, tt.body, 5*time.Minute, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v; want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(a, "whsec_") || len(a) != len("whsec_")+64 {
+		t.Errorf("got %q; want whsec_ and 64 hex digits", a)
+	}
+	if a == b {
+		t.Error("got the same secret twice")
+	}
+}
@@ -0,0 +1,422 @@
+// Package websocket implements the server side of the WebSocket protocol described in
+// RFC 6455: the opening handshake, and the framing of messages with fragmentation,
+// control frames and the closing handshake. Extensions such as compression aren't
+// supported, so none are ever negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The GUID which the accept key is derived with (RFC 6455, section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes (section 5.2).
+const (
+	opContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close status codes (section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+	CloseInternalError   = 1011
+)
+
+// The largest payload a control frame may have (section 5.5).
+const maxControlPayload = 125
+
+var (
+	ErrBadHandshake       = errors.New("websocket: not a valid handshake request")
+	ErrUnsupportedVersion = errors.New("websocket: unsupported protocol version")
+)
+
+// A CloseError is returned by ReadMessage once the connection is closed, by the peer
+// or because it broke the protocol. Code is CloseNoStatus if the peer's close frame
+// had no status code.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with status %d %s", e.Code, e.Reason)
+}
+
+// IsUpgradeRequest reports whether the request asks for a WebSocket.
+func IsUpgradeRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade completes the opening handshake (section 4.2) and takes over the connection.
+// The protocol, if not empty, is sent as the selected subprotocol and must be one the
+// client offered. If the request isn't a valid handshake, ErrBadHandshake is returned,
+// or ErrUnsupportedVersion with the Sec-WebSocket-Version header set to the supported
+// version; the caller then sends the error response, 400 Bad Request and 426 Upgrade
+// Required respectively.
+//
+// The server's read and write deadlines for the request are lifted; use
+// SetReadDeadline and SetWriteTimeout on the returned Conn instead.
+func Upgrade(w http.ResponseWriter, r *http.Request, protocol string) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+
+	switch {
+	case r.Method != http.MethodGet, !IsUpgradeRequest(r), err != nil, len(decoded) != 16:
+		return nil, ErrBadHandshake
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, ErrUnsupportedVersion
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	err = netConn.SetDeadline(time.Time{})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n")
+	if protocol != "" {
+		b.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	_, err = netConn.Write([]byte(b.String()))
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	// The server's reader may already hold the first frames, so keep reading through it.
+	return &Conn{conn: netConn, br: rw.Reader, readLimit: 64 * 1024}, nil
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Subprotocols returns the subprotocols the client offered, in order of preference.
+func Subprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a server-side WebSocket connection. One goroutine may read from it while
+// others write to it.
+type Conn struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	readLimit int64
+
+	writeMu      sync.Mutex
+	writeTimeout time.Duration
+	// Set once a close frame was sent; nothing may be sent after it.
+	closeSent bool
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts. A peer sending a larger
+// one is disconnected with CloseTooBig. The default is 64 KiB.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteTimeout sets how long sending a frame may take, including the pongs and
+// close frames sent while reading. Zero, the default, means no limit.
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.writeTimeout = d
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments. Pings are answered while reading and pongs are passed to onPong, if set.
+// When the peer closes the connection, the close is echoed and a *CloseError
+// returned; the same happens, with the appropriate status, when the peer breaks the
+// protocol.
+func (c *Conn) ReadMessage(onPong func()) (int, []byte, error) {
+	var opcode int
+	var message []byte
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				c.WriteClose(closeErr.Code, closeErr.Reason)
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			err = c.writeFrame(OpPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			if onPong != nil {
+				onPong()
+			}
+			continue
+		case OpClose:
+			closeErr := parseClose(payload)
+			if closeErr.Code == CloseProtocolError || closeErr.Code == CloseInvalidPayload {
+				c.WriteClose(closeErr.Code, closeErr.Reason)
+			} else {
+				// Echo the status the peer sent (section 5.5.1).
+				c.WriteClose(closeErr.Code, "")
+			}
+			return 0, nil, closeErr
+		case opContinuation:
+			if message == nil {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		case OpText, OpBinary:
+			if message != nil {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			opcode = op
+			message = []byte{}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(message))+int64(len(payload)) > c.readLimit {
+			return 0, nil, c.fail(CloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+
+		if fin {
+			if opcode == OpText && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// fail closes the connection with the status, and returns the matching error.
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// readFrame reads and unmasks one frame (section 5.2). Protocol violations are
+// returned as *CloseError.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	// No extensions are negotiated, so the reserved bits must be clear.
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	// Clients must mask every frame they send (section 5.1).
+	if !masked {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "frame not masked"}
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if opcode >= OpClose && (!fin || length > maxControlPayload) {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+	}
+	if length < 0 || length > c.readLimit {
+		return false, 0, nil, &CloseError{Code: CloseTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.br, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.br, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// parseClose reads the status code and reason of a close frame (section 5.5.1).
+func parseClose(payload []byte) *CloseError {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatus}
+	case len(payload) == 1:
+		return &CloseError{Code: CloseProtocolError, Reason: "invalid close frame"}
+	}
+
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+
+	// Codes which must not be sent, or aren't assigned (section 7.4).
+	valid := (code >= 1000 && code <= 1003) || (code >= 1007 && code <= 1011) || (code >= 3000 && code <= 4999)
+	if !valid {
+		return &CloseError{Code: CloseProtocolError, Reason: "invalid close status"}
+	}
+	if !utf8.Valid(reason) {
+		return &CloseError{Code: CloseInvalidPayload, Reason: "close reason is not valid UTF-8"}
+	}
+	return &CloseError{Code: code, Reason: string(reason)}
+}
+
+// WriteMessage sends a text or binary message in a single frame.
+func (c *Conn) WriteMessage(opcode int, payload []byte) error {
+	if opcode != OpText && opcode != OpBinary {
+		return errors.New("websocket: not a data opcode")
+	}
+	return c.writeFrame(opcode, payload)
+}
+
+// Ping sends a ping, which the peer answers with a pong.
+func (c *Conn) Ping() error {
+	return c.writeFrame(OpPing, nil)
+}
+
+// WriteClose starts or completes the closing handshake. The caller should close the
+// connection once the peer has answered, or after a timeout.
+func (c *Conn) WriteClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		if len(reason) > maxControlPayload-2 {
+			reason = reason[:maxControlPayload-2]
+		}
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+	return c.writeFrame(OpClose, payload)
+}
+
+var errCloseSent = errors.New("websocket: close already sent")
+
+// writeFrame sends one unfragmented, unmasked frame, as servers must (section 5.1).
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+	if opcode == OpClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	if c.writeTimeout > 0 {
+		err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,501 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The example of RFC 6455, section 1.3.
+	got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, "chat")
+		switch {
+		case errors.Is(err, ErrBadHandshake):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrUnsupportedVersion):
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		case err != nil:
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		opcode, msg, err := conn.ReadMessage(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteMessage(opcode, msg)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		status  int
+		version string
+	}{
+		{"valid", nil, http.StatusSwitchingProtocols, ""},
+		{"unsupported version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired, "13"},
+		{"short key", map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, http.StatusBadRequest, ""},
+		{"no upgrade", map[string]string{"Upgrade": ""}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{
+				"Connection":            "keep-alive, Upgrade",
+				"Upgrade":               "websocket",
+				"Sec-WebSocket-Version": "13",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			}
+			for name, value := range tt.header {
+				header[name] = value
+			}
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			var b strings.Builder
+			b.WriteString("GET /chat HTTP/1.1\r\nHost: example.com\r\n")
+			for name, value := range header {
+				if value != "" {
+					b.WriteString(name + ": " + value + "\r\n")
+				}
+			}
+			b.WriteString("\r\n")
+			_, err = conn.Write([]byte(b.String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("got status %d; want %d", res.StatusCode, tt.status)
+			}
+			if got := res.Header.Get("Sec-WebSocket-Version"); got != tt.version {
+				t.Errorf("got Sec-WebSocket-Version %q; want %q", got, tt.version)
+			}
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				return
+			}
+
+			if got := res.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("got Sec-WebSocket-Accept %q", got)
+			}
+			if got := res.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+				t.Errorf("got Sec-WebSocket-Protocol %q; want chat", got)
+			}
+
+			writeTestFrame(t, conn, true, OpText, []byte("echo"), true)
+			fin, opcode, payload := readTestFrame(t, br)
+			if !fin || opcode != OpText || string(payload) != "echo" {
+				t.Errorf("got frame (%t, %d, %q); want (true, %d, \"echo\")", fin, opcode, payload, OpText)
+			}
+		})
+	}
+}
+
+func TestReadMessageFragmented(t *testing.T) {
+	conn, client, br := newTestConn(t)
+
+	writeTestFrame(t, client, false, OpText, []byte("Hel"), true)
+	writeTestFrame(t, client, false, opContinuation, []byte("lo, "), true)
+	writeTestFrame(t, client, true, opContinuation, []byte("world"), true)
+
+	opcode, msg, err := conn.ReadMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != OpText || string(msg) != "Hello, world" {
+		t.Errorf("got (%d, %q); want (%d, \"Hello, world\")", opcode, msg, OpText)
+	}
+
+	// Nothing is sent back for a data message.
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("got a reply to a data message")
+	}
+}
+
+func TestReadMessagePingBetweenFragments(t *testing.T) {
+	conn, client, br := newTestConn(t)
+
+	// Control frames may be interleaved with the fragments of a message (section 5.4).
+	writeTestFrame(t, client, false, OpBinary, []byte{1, 2}, true)
+	writeTestFrame(t, client, true, OpPing, []byte("are you there"), true)
+	writeTestFrame(t, client, true, OpPong, nil, true)
+	writeTestFrame(t, client, true, opContinuation, []byte{3}, true)
+
+	pongs := 0
+	opcode, msg, err := conn.ReadMessage(func() { pongs++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != OpBinary || string(msg) != "\x01\x02\x03" {
+		t.Errorf("got (%d, %v); want (%d, [1 2 3])", opcode, msg, OpBinary)
+	}
+	if pongs != 1 {
+		t.Errorf("got %d pongs; want 1", pongs)
+	}
+
+	fin, op, payload := readTestFrame(t, br)
+	if !fin || op != OpPong || string(payload) != "are you there" {
+		t.Errorf("got frame (%t, %d, %q); want the ping echoed in a pong", fin, op, payload)
+	}
+}
+
+func TestReadMessageProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames func(t *testing.T, client net.Conn)
+		limit  int64
+		code   int
+	}{
+		{
+			name: "unmasked frame",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, OpText, []byte("hi"), false)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "reserved bits",
+			frames: func(t *testing.T, client net.Conn) {
+				client.Write([]byte{0x80 | 0x40 | OpText, 0x80, 0, 0, 0, 0})
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "unknown opcode",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, 0x3, nil, true)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "continuation without a message",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, opContinuation, []byte("x"), true)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "new message before the last one ended",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, false, OpText, []byte("a"), true)
+				writeTestFrame(t, client, true, OpText, []byte("b"), true)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "fragmented ping",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, false, OpPing, []byte("a"), true)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "control frame too long",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, OpPing, make([]byte, maxControlPayload+1), true)
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name: "frame over the limit",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, OpBinary, make([]byte, 11), true)
+			},
+			limit: 10,
+			code:  CloseTooBig,
+		},
+		{
+			name: "fragments over the limit",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, false, OpBinary, make([]byte, 6), true)
+				writeTestFrame(t, client, true, opContinuation, make([]byte, 6), true)
+			},
+			limit: 10,
+			code:  CloseTooBig,
+		},
+		{
+			name: "huge length",
+			frames: func(t *testing.T, client net.Conn) {
+				header := []byte{0x80 | OpBinary, 0x80 | 127}
+				header = binary.BigEndian.AppendUint64(header, 1<<62)
+				client.Write(header)
+			},
+			code: CloseTooBig,
+		},
+		{
+			name: "invalid UTF-8",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, true, OpText, []byte{0xff, 0xfe}, true)
+			},
+			code: CloseInvalidPayload,
+		},
+		{
+			name: "UTF-8 sequence split across fragments",
+			frames: func(t *testing.T, client net.Conn) {
+				writeTestFrame(t, client, false, OpText, []byte{0xc3}, true)
+				writeTestFrame(t, client, true, opContinuation, []byte{0xa4, 0xc3}, true)
+			},
+			code: CloseInvalidPayload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client, br := newTestConn(t)
+			if tt.limit > 0 {
+				conn.SetReadLimit(tt.limit)
+			}
+
+			tt.frames(t, client)
+
+			_, _, err := conn.ReadMessage(nil)
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+				t.Fatalf("got error %v; want close status %d", err, tt.code)
+			}
+
+			if code := readTestClose(t, br); code != tt.code {
+				t.Errorf("got close frame with status %d; want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    int
+		// The status of the close frame sent back; CloseNoStatus for an empty one.
+		reply int
+	}{
+		{"normal", closePayload(CloseNormal, "bye"), CloseNormal, CloseNormal},
+		{"going away", closePayload(CloseGoingAway, ""), CloseGoingAway, CloseGoingAway},
+		{"private use", closePayload(4000, ""), 4000, 4000},
+		{"no status", nil, CloseNoStatus, CloseNoStatus},
+		{"one byte", []byte{0x03}, CloseProtocolError, CloseProtocolError},
+		{"below the range", closePayload(999, ""), CloseProtocolError, CloseProtocolError},
+		{"reserved 1004", closePayload(1004, ""), CloseProtocolError, CloseProtocolError},
+		{"no status sent", closePayload(CloseNoStatus, ""), CloseProtocolError, CloseProtocolError},
+		{"abnormal closure sent", closePayload(1006, ""), CloseProtocolError, CloseProtocolError},
+		{"TLS handshake sent", closePayload(1015, ""), CloseProtocolError, CloseProtocolError},
+		{"unassigned", closePayload(2999, ""), CloseProtocolError, CloseProtocolError},
+		{"above the range", closePayload(5000, ""), CloseProtocolError, CloseProtocolError},
+		{"invalid UTF-8 reason", closePayload(CloseNormal, "\xff"), CloseInvalidPayload, CloseInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client, br := newTestConn(t)
+
+			writeTestFrame(t, client, true, OpClose, tt.payload, true)
+
+			_, _, err := conn.ReadMessage(nil)
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+				t.Fatalf("got error %v; want close status %d", err, tt.code)
+			}
+
+			if code := readTestClose(t, br); code != tt.reply {
+				t.Errorf("got close frame with status %d; want %d", code, tt.reply)
+			}
+
+			// Nothing may follow a close frame.
+			if err := conn.WriteMessage(OpText, []byte("late")); err == nil {
+				t.Error("sent a message after the close frame")
+			}
+		})
+	}
+}
+
+func TestWriteMessageLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		conn, _, br := newTestConn(t)
+
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+
+		go conn.WriteMessage(OpBinary, payload)
+
+		fin, opcode, got := readTestFrame(t, br)
+		if !fin || opcode != OpBinary || len(got) != size || string(got) != string(payload) {
+			t.Errorf("size %d: got frame (%t, %d) with %d bytes", size, fin, opcode, len(got))
+		}
+	}
+}
+
+// newTestConn() returns a server-side Conn connected over loopback TCP to a client
+// connection, and a reader for what the server sends.
+func newTestConn(t *testing.T) (*Conn, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+
+	conn := &Conn{conn: server, br: bufio.NewReader(server), readLimit: 64 * 1024}
+	return conn, client, bufio.NewReader(client)
+}
+
+// writeTestFrame() sends a frame as a client would, masked unless told otherwise.
+func writeTestFrame(t *testing.T, w io.Writer, fin bool, opcode int, payload []byte, masked bool) {
+	t.Helper()
+
+	var frame []byte
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame = append(frame, b0)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	body := append([]byte(nil), payload...)
+	if masked {
+		mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+		frame = append(frame, mask[:]...)
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+	frame = append(frame, body...)
+
+	_, err := w.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFrame() reads a frame sent by the server, which must not be masked.
+func readTestFrame(t *testing.T, br *bufio.Reader) (bool, int, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server sent a masked frame")
+	}
+
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(br, ext[:])
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(br, ext[:])
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(br, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header[0]&0x80 != 0, int(header[0] & 0x0F), payload
+}
+
+// readTestClose() reads a close frame sent by the server and returns its status, or
+// CloseNoStatus if it has none.
+func readTestClose(t *testing.T, br *bufio.Reader) int {
+	t.Helper()
+
+	_, opcode, payload := readTestFrame(t, br)
+	if opcode != OpClose {
+		t.Fatalf("got opcode %d; want a close frame", opcode)
+	}
+	if len(payload) < 2 {
+		return CloseNoStatus
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users_identities;
+
+DROP TABLE IF EXISTS oidc_auth_requests;
\ No newline at end of file
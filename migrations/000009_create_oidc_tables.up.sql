@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS oidc_auth_requests (
+  state_hash bytea PRIMARY KEY,
+  provider text NOT NULL,
+  nonce text NOT NULL,
+  code_verifier text NOT NULL,
+  expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_identities (
+  provider text NOT NULL,
+  subject text NOT NULL,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  email citext NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS users_identities_user_id_idx ON users_identities (user_id);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'users:admin';
+
+DROP TABLE IF EXISTS login_throttles;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS login_throttles (
+  subject text PRIMARY KEY,
+  user_id bigint REFERENCES users ON DELETE CASCADE,
+  failures integer NOT NULL DEFAULT 0,
+  last_failed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  locked_until timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS login_throttles_locked_until_idx ON login_throttles (locked_until);
+
+-- Administrators need this permission to inspect and lift lockouts.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('users:admin');
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS users_roles;
+
+DROP TABLE IF EXISTS roles_permissions;
+
+DROP TABLE IF EXISTS roles;
+
+DELETE FROM
+  permissions
+WHERE
+  code IN ('listings:*', 'users:*', 'roles:admin', '*');
+
+ALTER TABLE
+  permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
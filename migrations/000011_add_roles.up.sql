@@ -0,0 +1,80 @@
+ALTER TABLE
+  permissions
+ADD
+  CONSTRAINT permissions_code_key UNIQUE (code);
+
+-- Wildcard codes grant every permission with the same prefix, and '*' grants all of
+-- them.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('listings:*'),
+  ('users:*'),
+  ('roles:admin'),
+  ('*');
+
+CREATE TABLE IF NOT EXISTS roles (
+  id bigserial PRIMARY KEY,
+  name text UNIQUE NOT NULL,
+  description text NOT NULL DEFAULT '',
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+  role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+  permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+  PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+  PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_roles_role_id_idx ON users_roles (role_id);
+
+INSERT INTO
+  roles (name, description)
+VALUES
+  ('user', 'Every registered user'),
+  ('seller', 'Can create and edit listings'),
+  ('moderator', 'Can manage all listings'),
+  ('admin', 'Can do everything');
+
+INSERT INTO
+  roles_permissions
+SELECT
+  roles.id,
+  permissions.id
+FROM
+  roles
+  INNER JOIN permissions ON (roles.name, permissions.code) IN (
+    ('user', 'listings:read'),
+    ('seller', 'listings:read'),
+    ('seller', 'listings:write'),
+    ('moderator', 'listings:*'),
+    ('admin', '*')
+  );
+
+-- Move the existing direct grants over to the matching roles.
+INSERT INTO
+  users_roles
+SELECT
+  users.id,
+  roles.id
+FROM
+  users
+  INNER JOIN roles ON roles.name = 'user';
+
+INSERT INTO
+  users_roles
+SELECT
+  DISTINCT users_permissions.user_id,
+  roles.id
+FROM
+  users_permissions
+  INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+  INNER JOIN roles ON roles.name = 'seller'
+WHERE
+  permissions.code = 'listings:write';
@@ -0,0 +1,15 @@
+DELETE FROM
+  permissions
+WHERE
+  code = 'listings:moderate';
+
+DROP INDEX IF EXISTS listings_organization_id_idx;
+
+ALTER TABLE
+  listings DROP COLUMN IF EXISTS organization_id;
+
+DROP TABLE IF EXISTS organizations_invitations;
+
+DROP TABLE IF EXISTS organizations_members;
+
+DROP TABLE IF EXISTS organizations;
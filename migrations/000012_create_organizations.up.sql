@@ -0,0 +1,41 @@
+CREATE TABLE IF NOT EXISTS organizations (
+  id bigserial PRIMARY KEY,
+  name text NOT NULL,
+  description text NOT NULL DEFAULT '',
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  version integer NOT NULL DEFAULT 1
+);
+
+-- Members are ranked owner > manager > editor. Editors can change the organization's
+-- listings, managers can also manage members, and owners can do everything.
+CREATE TABLE IF NOT EXISTS organizations_members (
+  organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  role text NOT NULL CHECK (role IN ('owner', 'manager', 'editor')),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS organizations_members_user_id_idx ON organizations_members (user_id);
+
+-- An invitation hangs off the invitee's token in the tokens table, so it expires and
+-- is used up together with it.
+CREATE TABLE IF NOT EXISTS organizations_invitations (
+  token_hash bytea PRIMARY KEY REFERENCES tokens (hash) ON DELETE CASCADE,
+  organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+  role text NOT NULL CHECK (role IN ('owner', 'manager', 'editor')),
+  invited_by bigint REFERENCES users ON DELETE SET NULL
+);
+
+ALTER TABLE
+  listings
+ADD
+  COLUMN organization_id bigint REFERENCES organizations ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS listings_organization_id_idx ON listings (organization_id);
+
+-- Lets moderators edit listings regardless of who owns them.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('listings:moderate');
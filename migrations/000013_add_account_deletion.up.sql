@@ -0,0 +1,24 @@
+-- Every table with personal data must reference users with ON DELETE CASCADE (or SET
+-- NULL where the row has to outlive the user), so that deleting the users row removes
+-- all of it. The tables created so far already do.
+
+-- Users who asked for their account to be deleted. The account is deleted for good
+-- once the grace period is over, unless they cancel before.
+CREATE TABLE IF NOT EXISTS users_deletions (
+  user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+  requested_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  scheduled_for timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS users_deletions_scheduled_for_idx ON users_deletions (scheduled_for);
+
+-- Finished data exports. The download link carries a token from the tokens table, so
+-- the archive goes away with it.
+CREATE TABLE IF NOT EXISTS data_exports (
+  token_hash bytea PRIMARY KEY REFERENCES tokens (hash) ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  archive bytea NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id);
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS reviews_reports;
+
+DROP TABLE IF EXISTS reviews;
+
+DROP INDEX IF EXISTS listings_user_id_idx;
+
+ALTER TABLE
+  listings DROP COLUMN IF EXISTS sold_at,
+  DROP COLUMN IF EXISTS buyer_id,
+  DROP COLUMN IF EXISTS status,
+  DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,41 @@
+-- Listings created from now on record who is selling. Older listings have no seller
+-- and so can't be reviewed.
+ALTER TABLE
+  listings
+ADD
+  COLUMN user_id bigint REFERENCES users ON DELETE SET NULL,
+ADD
+  COLUMN status text NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'sold')),
+ADD
+  COLUMN buyer_id bigint REFERENCES users ON DELETE SET NULL,
+ADD
+  COLUMN sold_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS listings_user_id_idx ON listings (user_id);
+
+-- Each side of a deal can review the other once. reviewer_role says which side the
+-- review was written from, so "buyer" reviews are the ones rating a seller.
+CREATE TABLE IF NOT EXISTS reviews (
+  id bigserial PRIMARY KEY,
+  listing_id bigint NOT NULL REFERENCES listings ON DELETE CASCADE,
+  reviewer_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  reviewee_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  reviewer_role text NOT NULL CHECK (reviewer_role IN ('buyer', 'seller')),
+  rating integer NOT NULL CHECK (rating BETWEEN 1 AND 5),
+  text text NOT NULL,
+  reply text,
+  replied_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (listing_id, reviewer_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_reviewee_id_idx ON reviews (reviewee_id, reviewer_role);
+
+CREATE TABLE IF NOT EXISTS reviews_reports (
+  id bigserial PRIMARY KEY,
+  review_id bigint NOT NULL REFERENCES reviews ON DELETE CASCADE,
+  reporter_id bigint REFERENCES users ON DELETE SET NULL,
+  reason text NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  UNIQUE (review_id, reporter_id)
+);
@@ -0,0 +1,12 @@
+-- A block stops all contact between the two users and hides each one's listings from
+-- the other. A mute only hides the muted user's listings from the one who muted them.
+CREATE TABLE IF NOT EXISTS users_blocks (
+  blocker_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  blocked_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  kind text NOT NULL CHECK (kind IN ('block', 'mute')),
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (blocker_id, blocked_id),
+  CHECK (blocker_id <> blocked_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_blocks_blocked_id_idx ON users_blocks (blocked_id);
@@ -0,0 +1,17 @@
+-- Emails waiting to be sent. Rows are written in the same transaction as whatever
+-- the email is about, and deleted once the email has been sent. An email which keeps
+-- failing is eventually dead-lettered: dead_at is set and it is never tried again, but
+-- it stays here to be looked at.
+CREATE TABLE IF NOT EXISTS email_outbox (
+  id bigserial PRIMARY KEY,
+  recipient citext NOT NULL,
+  template text NOT NULL,
+  data jsonb NOT NULL DEFAULT '{}',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  last_error text NOT NULL DEFAULT '',
+  dead_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_next_attempt_at_idx ON email_outbox (next_attempt_at) WHERE dead_at IS NULL;
@@ -0,0 +1,5 @@
+-- The language emails are written in. Everybody who signed up before this gets the
+-- English ones they have been getting so far.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
+
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT 'en';
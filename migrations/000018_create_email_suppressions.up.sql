@@ -0,0 +1,21 @@
+-- Bounce and complaint notifications received from the mail provider, as they came.
+CREATE TABLE IF NOT EXISTS email_events (
+  id bigserial PRIMARY KEY,
+  email citext NOT NULL,
+  type text NOT NULL CHECK (type IN ('hard_bounce', 'soft_bounce', 'complaint')),
+  diagnostic text NOT NULL DEFAULT '',
+  occurred_at timestamp(0) with time zone NOT NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS email_events_email_idx ON email_events (email);
+
+-- Addresses nothing is sent to any more: those which bounced hard, and those whose
+-- owner marked our email as spam. Keyed by address rather than user, so that a user
+-- who changes to a working address gets email again.
+CREATE TABLE IF NOT EXISTS email_suppressions (
+  email citext PRIMARY KEY,
+  reason text NOT NULL CHECK (reason IN ('hard_bounce', 'complaint')),
+  diagnostic text NOT NULL DEFAULT '',
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,23 @@
+-- The in-app inbox. data holds whatever the notification type needs to be shown, such
+-- as the IDs and titles of the listing and review it is about.
+CREATE TABLE IF NOT EXISTS notifications (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  type text NOT NULL,
+  data jsonb NOT NULL DEFAULT '{}',
+  read_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+
+-- Which channels each user wants each type of notification on. Types without a row
+-- use the defaults in the code.
+CREATE TABLE IF NOT EXISTS notifications_preferences (
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  type text NOT NULL,
+  email boolean NOT NULL,
+  in_app boolean NOT NULL,
+  PRIMARY KEY (user_id, type)
+);
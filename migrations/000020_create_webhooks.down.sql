@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'webhooks:admin';
+
+DROP TABLE IF EXISTS webhooks_attempts;
+DROP TABLE IF EXISTS webhooks_deliveries;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,48 @@
+-- Subscriptions of downstream systems to events. Each delivery is signed with the
+-- subscription's secret.
+CREATE TABLE IF NOT EXISTS webhooks (
+  id bigserial PRIMARY KEY,
+  url text NOT NULL,
+  secret text NOT NULL,
+  event_types text[] NOT NULL,
+  active boolean NOT NULL DEFAULT true,
+  created_by bigint REFERENCES users ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  version integer NOT NULL DEFAULT 1
+);
+
+-- One row per event and subscription. The payload is kept as it was when the event
+-- happened, so retries and redeliveries send the same data.
+CREATE TABLE IF NOT EXISTS webhooks_deliveries (
+  id bigserial PRIMARY KEY,
+  webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+  event_type text NOT NULL,
+  payload jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  delivered_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_deliveries_webhook_id_idx ON webhooks_deliveries (webhook_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS webhooks_deliveries_next_attempt_at_idx ON webhooks_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- Every attempt at a delivery, with what the receiver answered.
+CREATE TABLE IF NOT EXISTS webhooks_attempts (
+  id bigserial PRIMARY KEY,
+  delivery_id bigint NOT NULL REFERENCES webhooks_deliveries ON DELETE CASCADE,
+  status_code integer,
+  error text NOT NULL DEFAULT '',
+  response_body text NOT NULL DEFAULT '',
+  duration_ms integer NOT NULL,
+  attempted_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_attempts_delivery_id_idx ON webhooks_attempts (delivery_id);
+
+-- Administrators need this permission to manage subscriptions and redeliver.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('webhooks:admin');
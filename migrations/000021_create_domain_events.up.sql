@@ -0,0 +1,18 @@
+-- Domain events, such as a listing being created or a user activating their account.
+-- Rows are written in the same transaction as the change they describe, so an event is
+-- recorded if and only if the change was committed. The dispatcher hands each event to
+-- the in-process subscribers and sets dispatched_at once they have all handled it. An
+-- event whose subscribers keep failing is eventually dead-lettered like an email.
+CREATE TABLE IF NOT EXISTS domain_events (
+  id bigserial PRIMARY KEY,
+  type text NOT NULL,
+  data jsonb NOT NULL DEFAULT '{}',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamp with time zone NOT NULL DEFAULT NOW(),
+  last_error text NOT NULL DEFAULT '',
+  dispatched_at timestamp(0) with time zone,
+  dead_at timestamp(0) with time zone,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS domain_events_next_attempt_at_idx ON domain_events (next_attempt_at) WHERE dispatched_at IS NULL AND dead_at IS NULL;
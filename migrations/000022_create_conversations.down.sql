@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversations_participants;
+DROP TABLE IF EXISTS conversations;
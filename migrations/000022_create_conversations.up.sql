@@ -0,0 +1,25 @@
+-- A conversation between two or more users, optionally about a listing. Participants
+-- whose account is deleted drop out of it, but their messages stay with a NULL sender.
+CREATE TABLE IF NOT EXISTS conversations (
+  id bigserial PRIMARY KEY,
+  listing_id bigint REFERENCES listings ON DELETE SET NULL,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS conversations_participants (
+  conversation_id bigint NOT NULL REFERENCES conversations ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS conversations_participants_user_id_idx ON conversations_participants (user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+  id bigserial PRIMARY KEY,
+  conversation_id bigint NOT NULL REFERENCES conversations ON DELETE CASCADE,
+  sender_id bigint REFERENCES users ON DELETE SET NULL,
+  body text NOT NULL,
+  created_at timestamp(3) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id);
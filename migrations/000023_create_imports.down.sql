@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS imports_errors;
+DROP TABLE IF EXISTS imports;
+DROP INDEX IF EXISTS listings_user_id_external_ref_idx;
+ALTER TABLE listings DROP COLUMN IF EXISTS external_ref;
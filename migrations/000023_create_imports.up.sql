@@ -0,0 +1,32 @@
+-- Listings imported from a dealer's inventory system carry the dealer's own reference
+-- for them, which makes importing the same listing again update it instead.
+ALTER TABLE listings ADD COLUMN IF NOT EXISTS external_ref text;
+CREATE UNIQUE INDEX IF NOT EXISTS listings_user_id_external_ref_idx ON listings (user_id, external_ref);
+
+-- One upload of listings. The counters are updated after every batch, so that the
+-- uploader can follow the progress of a large import.
+CREATE TABLE IF NOT EXISTS imports (
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  format text NOT NULL,
+  status text NOT NULL DEFAULT 'processing' CHECK (status IN ('processing', 'completed', 'failed')),
+  rows_read integer NOT NULL DEFAULT 0,
+  inserted integer NOT NULL DEFAULT 0,
+  updated integer NOT NULL DEFAULT 0,
+  unchanged integer NOT NULL DEFAULT 0,
+  failed integer NOT NULL DEFAULT 0,
+  error text NOT NULL DEFAULT '',
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  finished_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS imports_user_id_idx ON imports (user_id);
+
+-- The rows of an import which were rejected, and why.
+CREATE TABLE IF NOT EXISTS imports_errors (
+  import_id bigint NOT NULL REFERENCES imports ON DELETE CASCADE,
+  row_number integer NOT NULL,
+  external_ref text NOT NULL DEFAULT '',
+  errors jsonb NOT NULL,
+  PRIMARY KEY (import_id, row_number)
+);
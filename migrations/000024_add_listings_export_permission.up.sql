@@ -0,0 +1,6 @@
+-- Exporting every listing at once is for analysts, so it takes a permission of its
+-- own. Moderators and administrators have it through their wildcards.
+INSERT INTO
+  permissions (code)
+VALUES
+  ('listings:export');
@@ -0,0 +1,16 @@
+-- The first response to a request made with an Idempotency-Key, which retries of the
+-- request get instead of having it run again. Anonymous requests, like signing up,
+-- have a user_id of 0. The status is NULL while the first request is still running.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  user_id bigint NOT NULL,
+  key text NOT NULL,
+  request_hash bytea NOT NULL,
+  status integer,
+  header jsonb NOT NULL DEFAULT '{}',
+  body bytea NOT NULL DEFAULT '',
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  expires_at timestamp(0) with time zone NOT NULL,
+  PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,2 @@
+ALTER TABLE listings DROP COLUMN IF EXISTS sale_offered_at;
+ALTER TABLE listings DROP COLUMN IF EXISTS pending_buyer_id;
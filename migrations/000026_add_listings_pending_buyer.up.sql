@@ -0,0 +1,8 @@
+-- A sale the seller recorded waits for the buyer to confirm it before the listing is
+-- sold, so that sellers can't make up sales to anyone they like.
+ALTER TABLE
+  listings
+ADD
+  COLUMN pending_buyer_id bigint REFERENCES users ON DELETE SET NULL,
+ADD
+  COLUMN sale_offered_at timestamp(0) with time zone;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS webhooks_deliveries_webhook_id_event_id_idx;
+ALTER TABLE webhooks_deliveries DROP COLUMN IF EXISTS event_id;
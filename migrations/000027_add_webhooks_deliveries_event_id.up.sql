@@ -0,0 +1,9 @@
+-- The domain event a delivery is for. An event whose dispatch is retried is only
+-- queued once per subscription, and receivers get its ID to recognise duplicates.
+-- Deliveries queued before the column existed have none.
+ALTER TABLE
+  webhooks_deliveries
+ADD
+  COLUMN event_id bigint;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_deliveries_webhook_id_event_id_idx ON webhooks_deliveries (webhook_id, event_id);
@@ -0,0 +1,10 @@
+-- The domain events each user has been notified about. Events are dispatched at least
+-- once, so a subscriber which fails half way is run again, and this is how the users
+-- it already notified are skipped. Rows go away with the event.
+CREATE TABLE IF NOT EXISTS notifications_events (
+  event_id bigint NOT NULL REFERENCES domain_events ON DELETE CASCADE,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  PRIMARY KEY (event_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS notifications_events_user_id_idx ON notifications_events (user_id);